@@ -0,0 +1,427 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/smarterclayton/node-conntrack/pkg/conntrack"
+	"github.com/smarterclayton/node-conntrack/pkg/otlp"
+)
+
+// config is the file based configuration of the daemon, encoded as JSON. YAML is not
+// accepted, since no YAML decoder is vendored. Unset fields use the defaults of the tracker.
+type config struct {
+	// Interval is how often failures are merged into the reported state, such as "15s".
+	Interval duration `json:"interval"`
+	// ExpireAfter is the number of intervals without events after which a down
+	// destination is forgotten.
+	ExpireAfter uint16 `json:"expireAfter"`
+	// MaxAddresses caps the number of destination addresses tracked as down.
+	MaxAddresses int `json:"maxAddresses"`
+	// MaxDestinationsPerAddress caps the number of ports tracked per address.
+	MaxDestinationsPerAddress int `json:"maxDestinationsPerAddress"`
+	// FlapWindow and FlapThreshold report a destination as flapping if it starts or stops
+	// being down more than FlapThreshold times within FlapWindow, such as "10m".
+	FlapWindow    duration `json:"flapWindow"`
+	FlapThreshold int      `json:"flapThreshold"`
+	// SynRetries estimates SYN retransmissions per destination from the delay before the
+	// first reply, at the cost of receiving an event for every new connection.
+	SynRetries bool `json:"synRetries"`
+	// Nodes is the path to a JSON Kubernetes node list, see the -nodes flag.
+	Nodes string `json:"nodes"`
+	// Policies is the path to a JSON Kubernetes list of pods, namespaces, and network
+	// policies, see the -policies flag.
+	Policies string `json:"policies"`
+	// StallTimeout is how long the listener may go without events before the conntrack
+	// table is checked and the listener restarted if connections are changing, such as
+	// "5m". The check is disabled if unset.
+	StallTimeout duration `json:"stallTimeout"`
+	// ReadBufferSize is the initial size in bytes of the netlink receive buffer, which
+	// grows up to MaxReadBufferSize while events arrive faster than they are processed
+	// and shrinks back when the node is quiet.
+	ReadBufferSize    int `json:"readBufferSize"`
+	MaxReadBufferSize int `json:"maxReadBufferSize"`
+	// Filters select which flows are tracked. Flows matching any exclude rule are
+	// ignored, and if any include rules are present a flow must match one of them.
+	Filters []conntrack.FilterRule `json:"filters"`
+	// ScanDetection, if set, reports sources that fail to connect to many distinct
+	// destinations, and may stop recording their failures.
+	ScanDetection *scanDetection `json:"scanDetection"`
+	// Aggregation, if set, reports the number of down destinations per CIDR and may
+	// replace the series of individual destinations during large outages.
+	Aggregation *conntrack.AggregationOptions `json:"aggregation"`
+	// Dependencies, if set, records a graph of the connections between workloads that is
+	// served at /api/v1/dependencies.
+	Dependencies *dependencies `json:"dependencies"`
+	// Sinks export individual events. Changes to sinks take effect on restart.
+	Sinks sinks `json:"sinks"`
+}
+
+// sinks are the optional destinations of individual events.
+type sinks struct {
+	// FlowLog writes each failure as a JSON line to a file or standard output.
+	FlowLog *conntrack.FlowLogOptions `json:"flowLog"`
+	// OTLP pushes metrics, and optionally failures as log records, to an OpenTelemetry
+	// collector.
+	OTLP *otlpSink `json:"otlp"`
+}
+
+// otlpSink configures the OTLP/HTTP exporter, see otlp.Options.
+type otlpSink struct {
+	Endpoint string            `json:"endpoint"`
+	Headers  map[string]string `json:"headers"`
+	Interval duration          `json:"interval"`
+	Timeout  duration          `json:"timeout"`
+	Logs     bool              `json:"logs"`
+}
+
+// options returns the exporter options for the sink, describing the process as running on
+// nodeName.
+func (s *otlpSink) options(nodeName string) otlp.Options {
+	resource := map[string]string{"service.name": "node-conntrack"}
+	if len(nodeName) > 0 {
+		resource["host.name"] = nodeName
+	}
+	return otlp.Options{
+		Endpoint: s.Endpoint,
+		Headers:  s.Headers,
+		Interval: time.Duration(s.Interval),
+		Timeout:  time.Duration(s.Timeout),
+		Logs:     s.Logs,
+		Resource: resource,
+	}
+}
+
+// scanDetection configures the detection of scanning sources, see conntrack.ScanDetection.
+type scanDetection struct {
+	Window    duration `json:"window"`
+	Addresses int      `json:"addresses"`
+	Ports     int      `json:"ports"`
+	Exclude   bool     `json:"exclude"`
+}
+
+// dependencies configures the dependency graph, see conntrack.DependencyOptions.
+type dependencies struct {
+	Workloads []conntrack.Workload `json:"workloads"`
+	MaxEdges  int                  `json:"maxEdges"`
+	Retention duration             `json:"retention"`
+}
+
+func (d *dependencies) options() conntrack.DependencyOptions {
+	return conntrack.DependencyOptions{
+		Workloads: d.Workloads,
+		MaxEdges:  d.MaxEdges,
+		Retention: time.Duration(d.Retention),
+	}
+}
+
+// duration is a time.Duration encoded as a string in JSON.
+type duration time.Duration
+
+func (d *duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("durations must be strings such as \"15s\": %v", err)
+	}
+	value, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = duration(value)
+	return nil
+}
+
+// readConfig decodes and validates a config, rejecting unknown fields.
+func readConfig(data []byte) (*config, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	var cfg config
+	if err := dec.Decode(&cfg); err != nil {
+		if _, ok := err.(*json.SyntaxError); ok {
+			return nil, fmt.Errorf("config must be JSON, YAML is not supported: %v", err)
+		}
+		return nil, err
+	}
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
+
+func (c *config) validate() error {
+	if c.Interval != 0 && time.Duration(c.Interval) < time.Second {
+		return fmt.Errorf("interval must be at least one second")
+	}
+	if c.FlapWindow < 0 || c.FlapThreshold < 0 {
+		return fmt.Errorf("flapWindow and flapThreshold may not be negative")
+	}
+	if c.StallTimeout < 0 {
+		return fmt.Errorf("stallTimeout may not be negative")
+	}
+	if c.ReadBufferSize < 0 || c.MaxReadBufferSize < 0 {
+		return fmt.Errorf("readBufferSize and maxReadBufferSize may not be negative")
+	}
+	if c.MaxReadBufferSize > 0 && c.MaxReadBufferSize < c.ReadBufferSize {
+		return fmt.Errorf("maxReadBufferSize may not be smaller than readBufferSize")
+	}
+	if c.MaxAddresses < 0 {
+		return fmt.Errorf("maxAddresses may not be negative")
+	}
+	if c.MaxDestinationsPerAddress < 0 {
+		return fmt.Errorf("maxDestinationsPerAddress may not be negative")
+	}
+	if s := c.ScanDetection; s != nil {
+		if s.Window < 0 || s.Addresses < 0 || s.Ports < 0 {
+			return fmt.Errorf("scanDetection values may not be negative")
+		}
+	}
+	if c.Dependencies != nil {
+		if err := conntrack.ValidateDependencyOptions(c.Dependencies.options()); err != nil {
+			return err
+		}
+	}
+	if c.Aggregation != nil {
+		if _, err := conntrack.NewAggregation(*c.Aggregation); err != nil {
+			return err
+		}
+	}
+	if _, err := conntrack.NewFilter(c.Filters); err != nil {
+		return err
+	}
+	if c.Sinks.FlowLog != nil && len(c.Sinks.FlowLog.Path) == 0 {
+		return fmt.Errorf("sinks.flowLog.path is required, use - for standard output")
+	}
+	if c.Sinks.OTLP != nil {
+		if len(c.Sinks.OTLP.Endpoint) == 0 {
+			return fmt.Errorf("sinks.otlp.endpoint is required")
+		}
+		if c.Sinks.OTLP.Interval < 0 || c.Sinks.OTLP.Timeout < 0 {
+			return fmt.Errorf("sinks.otlp durations may not be negative")
+		}
+	}
+	return nil
+}
+
+// arguments returns the tracker arguments described by the config and options. Files
+// referenced by the config are loaded, so an error is returned if they are invalid.
+func (c *config) arguments(o *options) (conntrack.Arguments, error) {
+	args := conntrack.Arguments{
+		NodeName: o.NodeName,
+	}
+	nodes, policies := c.files(o)
+	if c != nil {
+		args.Interval = time.Duration(c.Interval)
+		args.ExpireAfter = conntrack.UIntCounter(c.ExpireAfter)
+		args.MaxAddresses = c.MaxAddresses
+		args.MaxDestinationsPerAddress = c.MaxDestinationsPerAddress
+		args.FlapWindow = time.Duration(c.FlapWindow)
+		args.FlapThreshold = c.FlapThreshold
+		args.StallTimeout = time.Duration(c.StallTimeout)
+		args.SynRetries = c.SynRetries
+		args.ReadBufferSize = c.ReadBufferSize
+		args.MaxReadBufferSize = c.MaxReadBufferSize
+		if s := c.ScanDetection; s != nil {
+			args.Scan = &conntrack.ScanDetection{
+				Window:    time.Duration(s.Window),
+				Addresses: s.Addresses,
+				Ports:     s.Ports,
+				Exclude:   s.Exclude,
+			}
+		}
+		if c.Dependencies != nil {
+			deps := c.Dependencies.options()
+			args.Dependencies = &deps
+		}
+		if len(c.Filters) > 0 {
+			filter, err := conntrack.NewFilter(c.Filters)
+			if err != nil {
+				return args, err
+			}
+			args.Filter = filter
+		}
+		if c.Aggregation != nil {
+			aggregation, err := conntrack.NewAggregation(*c.Aggregation)
+			if err != nil {
+				return args, err
+			}
+			args.Aggregation = aggregation
+		}
+	}
+	if len(nodes) > 0 {
+		// the list may not have been written yet, and is loaded when it appears
+		m, err := conntrack.LoadNodeMap(nodes)
+		switch {
+		case os.IsNotExist(err):
+			logger.Warn("Node list does not exist yet", "path", nodes)
+		case err != nil:
+			return args, err
+		default:
+			logger.Info("Loaded nodes", "path", nodes, "nodes", m.Len())
+			args.Nodes = m
+		}
+	}
+	if len(policies) > 0 {
+		m, err := conntrack.LoadPolicyMap(policies)
+		switch {
+		case os.IsNotExist(err):
+			logger.Warn("Policy list does not exist yet", "path", policies)
+		case err != nil:
+			return args, err
+		default:
+			pods, count := m.Len()
+			logger.Info("Loaded network policies", "path", policies, "pods", pods, "policies", count)
+			args.Policies = m
+		}
+	}
+	return args.WithDefaults(), nil
+}
+
+// files returns the paths of the node and policy lists, which the config may override.
+func (c *config) files(o *options) (nodes, policies string) {
+	nodes, policies = o.Nodes, o.Policies
+	if c != nil {
+		if len(c.Nodes) > 0 {
+			nodes = c.Nodes
+		}
+		if len(c.Policies) > 0 {
+			policies = c.Policies
+		}
+	}
+	return nodes, policies
+}
+
+// inputs returns the files loaded by arguments other than the config itself, which are
+// reloaded when they change.
+func (c *config) inputs(o *options) []string {
+	var paths []string
+	nodes, policies := c.files(o)
+	if len(nodes) > 0 {
+		paths = append(paths, nodes)
+	}
+	if len(policies) > 0 {
+		paths = append(paths, policies)
+	}
+	return paths
+}
+
+// fileStamp identifies a version of a file by its size and modification time. Writers
+// replace the files read by the daemon atomically, so a change of either is a new version.
+type fileStamp struct {
+	size    int64
+	modTime time.Time
+}
+
+// stampFiles returns the stamps of paths, with a zero stamp for files that are missing.
+func stampFiles(paths []string) []fileStamp {
+	stamps := make([]fileStamp, len(paths))
+	for i, path := range paths {
+		if info, err := os.Stat(path); err == nil {
+			stamps[i] = fileStamp{size: info.Size(), modTime: info.ModTime()}
+		}
+	}
+	return stamps
+}
+
+func equalStamps(a, b []fileStamp) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].size != b[i].size || !a[i].modTime.Equal(b[i].modTime) {
+			return false
+		}
+	}
+	return true
+}
+
+// watchConfig invokes fn with the config whenever the process receives SIGHUP, the
+// contents of the config at o.Config change, or one of the node or policy lists it refers
+// to is replaced, so that the lists can be kept up to date without a restart. cfg and data
+// are the config and contents that were already applied, and cfg is nil if o.Config is
+// unset. Invalid changes are logged and ignored.
+func watchConfig(o *options, cfg *config, data []byte, interval time.Duration, fn func(*config) error) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	w := newConfigWatcher(o, cfg, data, fn)
+	for {
+		select {
+		case <-hup:
+			w.reload(true)
+		case <-ticker.C:
+			w.reload(false)
+		}
+	}
+}
+
+// configWatcher tracks the config and input files that were last applied.
+type configWatcher struct {
+	o   *options
+	fn  func(*config) error
+	cfg *config
+	// data and stamps are the contents of the config and the versions of its inputs that
+	// were applied
+	data   []byte
+	stamps []fileStamp
+	// rejectedData and rejectedStamps are the last versions that could not be applied if
+	// rejected is set, so that they are only reported once
+	rejected       bool
+	rejectedData   []byte
+	rejectedStamps []fileStamp
+}
+
+func newConfigWatcher(o *options, cfg *config, data []byte, fn func(*config) error) *configWatcher {
+	return &configWatcher{o: o, fn: fn, cfg: cfg, data: data, stamps: stampFiles(cfg.inputs(o))}
+}
+
+// reload applies the config on disk if it or its inputs changed since they were last
+// applied, or if force is set. It returns true if the config was applied. The previously
+// applied config stays in effect if the new one is invalid or cannot be applied.
+func (w *configWatcher) reload(force bool) bool {
+	o := w.o
+	next, data := w.cfg, w.data
+	changed := force
+	if len(o.Config) > 0 {
+		latest, err := ioutil.ReadFile(o.Config)
+		if err != nil {
+			logger.Warn("Unable to read config", "path", o.Config, "err", err)
+			return false
+		}
+		if !bytes.Equal(latest, w.data) {
+			data, changed = latest, true
+		}
+	}
+	stamps := stampFiles(next.inputs(o))
+	if !changed && equalStamps(stamps, w.stamps) {
+		return false
+	}
+	if !force && w.rejected && bytes.Equal(data, w.rejectedData) && equalStamps(stamps, w.rejectedStamps) {
+		return false
+	}
+	if !bytes.Equal(data, w.data) {
+		var err error
+		if next, err = readConfig(data); err != nil {
+			w.rejected, w.rejectedData, w.rejectedStamps = true, data, stamps
+			logger.Warn("Ignoring invalid config", "path", o.Config, "err", err)
+			return false
+		}
+		// the config may refer to other inputs
+		stamps = stampFiles(next.inputs(o))
+	}
+	if err := w.fn(next); err != nil {
+		w.rejected, w.rejectedData, w.rejectedStamps = true, data, stamps
+		logger.Warn("Unable to apply config", "path", o.Config, "err", err)
+		return false
+	}
+	w.cfg, w.data, w.stamps = next, data, stamps
+	w.rejected = false
+	logger.Info("Reloaded config", "path", o.Config, "inputs", next.inputs(o))
+	return true
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadConfig(t *testing.T) {
+	cfg, err := readConfig([]byte(`{
+		"interval": "30s",
+		"expireAfter": 5,
+		"maxAddresses": 100,
+		"maxDestinationsPerAddress": 4,
+		"flapWindow": "5m",
+		"flapThreshold": 2,
+		"synRetries": true,
+		"filters": [{"name": "ssh", "action": "exclude", "ports": ["22"]}],
+		"scanDetection": {"window": "1m", "addresses": 10},
+		"aggregation": {"ipv4PrefixLength": 24},
+		"dependencies": {"maxEdges": 10}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	args, err := cfg.arguments(&options{NodeName: "node-1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if args.NodeName != "node-1" || args.Interval != 30*time.Second || args.ExpireAfter != 5 || args.MaxAddresses != 100 || args.MaxDestinationsPerAddress != 4 {
+		t.Fatalf("unexpected limits %#v", args)
+	}
+	if args.FlapWindow != 5*time.Minute || args.FlapThreshold != 2 || !args.SynRetries {
+		t.Fatalf("unexpected options %#v", args)
+	}
+	if hits := args.Filter.Hits(); len(hits) != 1 || hits[0].Name != "ssh" {
+		t.Fatalf("unexpected filter %v", hits)
+	}
+	if args.Scan == nil || args.Scan.Window != time.Minute || args.Scan.Addresses != 10 || args.Scan.Ports == 0 {
+		t.Fatalf("expected scan detection with defaults: %#v", args.Scan)
+	}
+	if args.Aggregation == nil || args.Dependencies == nil || args.Dependencies.MaxEdges != 10 {
+		t.Fatalf("expected aggregation and dependencies: %#v", args)
+	}
+
+	// a missing config uses the defaults of the tracker
+	var empty *config
+	if args, err = empty.arguments(&options{}); err != nil || args.Interval != 15*time.Second || args.Filter != nil {
+		t.Fatalf("unexpected defaults %#v %v", args, err)
+	}
+}
+
+func TestReadConfigInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		err  string
+	}{
+		{name: "YAML", data: "interval: 15s\n", err: "YAML is not supported"},
+		{name: "unknown field", data: `{"intervals": "15s"}`, err: "unknown field"},
+		{name: "numeric duration", data: `{"interval": 15}`, err: "durations must be strings"},
+		{name: "short interval", data: `{"interval": "500ms"}`, err: "interval must be at least one second"},
+		{name: "negative flap threshold", data: `{"flapThreshold": -1}`, err: "may not be negative"},
+		{name: "negative stall timeout", data: `{"stallTimeout": "-1s"}`, err: "may not be negative"},
+		{name: "small maximum read buffer", data: `{"readBufferSize": 2048, "maxReadBufferSize": 1024}`, err: "may not be smaller"},
+		{name: "negative maximum addresses", data: `{"maxAddresses": -1}`, err: "may not be negative"},
+		{name: "negative scan window", data: `{"scanDetection": {"window": "-1m"}}`, err: "may not be negative"},
+		{name: "unnamed workload", data: `{"dependencies": {"workloads": [{"addresses": ["10.0.0.0/8"]}]}}`, err: "name"},
+		{name: "invalid aggregation", data: `{"aggregation": {"ipv4PrefixLength": 33}}`, err: "ipv4PrefixLength"},
+		{name: "invalid filter", data: `{"filters": [{"action": "drop"}]}`, err: "action must be"},
+		{name: "duplicate filter names", data: `{"filters": [{"name": "a", "action": "include"}, {"name": "a", "action": "exclude"}]}`, err: "name is used"},
+		{name: "flow log without path", data: `{"sinks": {"flowLog": {}}}`, err: "path is required"},
+		{name: "OTLP without endpoint", data: `{"sinks": {"otlp": {}}}`, err: "endpoint is required"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := readConfig([]byte(test.data))
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Fatalf("expected an error containing %q, got %v", test.err, err)
+			}
+		})
+	}
+}
+
+func TestConfigArgumentsFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	nodes := filepath.Join(dir, "nodes.json")
+
+	// a list that has not been written yet is loaded when it appears
+	args, err := (&config{Nodes: nodes}).arguments(&options{Nodes: "ignored.json"})
+	if err != nil || args.Nodes != nil {
+		t.Fatalf("expected a missing node list to be tolerated: %v", err)
+	}
+	if err := ioutil.WriteFile(nodes, []byte(`{"items":[{"metadata":{"name":"node-1"},"spec":{"podCIDR":"10.128.0.0/23"}}]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if args, err = (&config{Nodes: nodes}).arguments(&options{}); err != nil || args.Nodes.Len() != 1 {
+		t.Fatalf("expected the node list to be loaded: %v", err)
+	}
+	if err := ioutil.WriteFile(nodes, []byte(`{"items":[{"metadata":{"name":"node-1"},"spec":{"podCIDR":"10.128.0.0/33"}}]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := (&config{}).arguments(&options{Nodes: nodes}); err == nil {
+		t.Fatal("expected an invalid node list to be rejected")
+	}
+}
+
+func TestConfigWatcherReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config.json")
+	write := func(data string) {
+		if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(`{"interval": "15s"}`)
+	data, _ := ioutil.ReadFile(path)
+	cfg, err := readConfig(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var applied []time.Duration
+	var fail bool
+	w := newConfigWatcher(&options{Config: path}, cfg, data, func(cfg *config) error {
+		if fail {
+			return os.ErrInvalid
+		}
+		applied = append(applied, time.Duration(cfg.Interval))
+		return nil
+	})
+
+	if w.reload(false) {
+		t.Fatal("expected an unchanged config not to be applied")
+	}
+	write(`{"interval": "20s"}`)
+	if !w.reload(false) || w.reload(false) {
+		t.Fatal("expected a changed config to be applied once")
+	}
+
+	// an invalid config is not applied, even on SIGHUP
+	write(`{"interval": 20}`)
+	if w.reload(false) || w.reload(true) {
+		t.Fatal("expected an invalid config to be ignored")
+	}
+
+	// a config that fails to apply is retried on SIGHUP instead of the previous config
+	write(`{"interval": "30s"}`)
+	fail = true
+	if w.reload(false) || w.reload(false) {
+		t.Fatal("expected a failure to apply the config")
+	}
+	fail = false
+	if !w.reload(true) {
+		t.Fatal("expected SIGHUP to apply the config on disk")
+	}
+	if len(applied) != 2 || applied[0] != 20*time.Second || applied[1] != 30*time.Second {
+		t.Fatalf("unexpected applied configs %v", applied)
+	}
+	if !w.reload(true) || applied[2] != 30*time.Second {
+		t.Fatalf("expected SIGHUP to reapply the config on disk: %v", applied)
+	}
+}
+
+func TestConfigWatcherInputs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	nodes := filepath.Join(dir, "nodes.json")
+
+	o := &options{Nodes: nodes}
+	var loaded []int
+	w := newConfigWatcher(o, nil, nil, func(cfg *config) error {
+		args, err := cfg.arguments(o)
+		if err != nil {
+			return err
+		}
+		loaded = append(loaded, args.Nodes.Len())
+		return nil
+	})
+	if w.reload(false) {
+		t.Fatal("expected a missing list not to trigger a reload")
+	}
+	list := `{"items":[{"metadata":{"name":"node-1"},"spec":{"podCIDR":"10.128.0.0/23"}}]}`
+	if err := ioutil.WriteFile(nodes, []byte(list), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if !w.reload(false) || w.reload(false) {
+		t.Fatal("expected a new list to be loaded once")
+	}
+	if err := ioutil.WriteFile(nodes, []byte("{"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if w.reload(false) || w.reload(false) {
+		t.Fatal("expected an invalid list to be rejected")
+	}
+	if len(loaded) != 1 || loaded[0] != 1 {
+		t.Fatalf("unexpected loads %v", loaded)
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/smarterclayton/node-conntrack/pkg/conntrack"
+)
+
+// dump prints the destinations of connections in the conntrack table that have not seen
+// a reply, which are the connections this node is currently failing to complete.
+func dump(args []string) error {
+	flags := flag.NewFlagSet("dump", flag.ExitOnError)
+	output := flags.String("o", "table", "Output format, one of table or json")
+	proto := flags.String("proto", "tcp", "Only show connections of this protocol, or all protocols if 'all'")
+	flags.Parse(args)
+
+	var protocol uint8
+	if *proto != "all" {
+		p, err := conntrack.ParseProtocol(*proto)
+		if err != nil {
+			return err
+		}
+		protocol = p
+	}
+
+	destinations, err := conntrack.DumpUnreplied(protocol)
+	if err != nil {
+		return err
+	}
+
+	switch *output {
+	case "json":
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(destinations)
+	case "table":
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "DESTINATION\tPROTO\tPORT\tCONNECTIONS\tSOURCES")
+		for _, d := range destinations {
+			fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%d\n", d.IP, d.Protocol, d.Port, d.Connections, d.Sources)
+		}
+		return w.Flush()
+	default:
+		return fmt.Errorf("unrecognized output format %q, must be table or json", *output)
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"flag"
+	"strings"
+
+	"github.com/smarterclayton/node-conntrack/pkg/logging"
+)
+
+// logger logs the progress of the daemon and its subcommands.
+var logger = logging.Named("main")
+
+// logOptions configure the structured logger.
+type logOptions struct {
+	Verbose          bool
+	Format           string
+	Level            string
+	Subsystems       string
+	SampleFirst      int
+	SampleThereafter int
+}
+
+// bind registers the logging flags on flags.
+func (o *logOptions) bind(flags *flag.FlagSet) {
+	flags.BoolVar(&o.Verbose, "v", o.Verbose, "Log at the debug level, the same as -log-level=debug")
+	flags.StringVar(&o.Format, "log-format", "logfmt", "The format of log lines, logfmt or json")
+	flags.StringVar(&o.Level, "log-level", "info", "Log messages at this level or more severe: error, warn, info, or debug")
+	flags.StringVar(&o.Subsystems, "log-levels", "", "Comma delimited SUBSYSTEM=LEVEL pairs that override -log-level, such as tracker=debug. Subsystems are "+strings.Join(logging.Subsystems(), ", "))
+	flags.IntVar(&o.SampleFirst, "log-sample-first", 0, "Write only this many identical debug or info messages per subsystem every second, or all if zero")
+	flags.IntVar(&o.SampleThereafter, "log-sample-thereafter", 0, "After -log-sample-first messages in a second, write every Nth identical message, or none if zero")
+}
+
+// configure applies the options to every logger.
+func (o *logOptions) configure() error {
+	level, err := logging.ParseLevel(o.Level)
+	if err != nil {
+		return err
+	}
+	if o.Verbose {
+		level = logging.LevelDebug
+	}
+	subsystems, err := logging.ParseSubsystemLevels(o.Subsystems)
+	if err != nil {
+		return err
+	}
+	return logging.Configure(logging.Config{
+		Format:           logging.Format(o.Format),
+		Level:            level,
+		Subsystems:       subsystems,
+		SampleFirst:      o.SampleFirst,
+		SampleThereafter: o.SampleThereafter,
+	})
+}
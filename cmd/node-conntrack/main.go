@@ -13,62 +13,319 @@
 //   query (so we could report which pods are down) - endpoints in particular can tell
 //   us the node as well. This is best colocated with the kube-proxy or SDN agent.
 // * Verify assomptions about connection tracking and check memory consumption on
-//   fast systems - i.e. will we also catch connections that time out abnormally?
+//   fast systems.
 // * Make this an easily includeable package for vendoring
 // * Make sure we can have multiple netlink connections from within a single process
 //   if we include it.
-// * Consider treating localhost special (exclude?) or maybe that's still useful
 //
 package main
 
 import (
 	"context"
 	"flag"
-	"log"
+	"fmt"
+	"io/ioutil"
 	"net/http"
-	_ "net/http/pprof"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/smarterclayton/node-conntrack/pkg/conntrack"
+	"github.com/smarterclayton/node-conntrack/pkg/otlp"
 )
 
 type options struct {
-	Listen  string
-	Verbose bool
+	Listen   string
+	Nodes    string
+	Policies string
+	NodeName string
+	Config   string
+	MaxIdle  time.Duration
+
+	StateFile     string
+	StateInterval time.Duration
+
+	RunAs   string
+	Seccomp bool
+
+	ICMPErrors bool
+
+	Log   logOptions
+	Serve serveOptions
+}
+
+// commands are the subcommands that can be run instead of the daemon.
+var commands = map[string]func(args []string) error{
+	"dump":   dump,
+	"top":    top,
+	"record": record,
+	"replay": replay,
+	"sync":   syncLists,
 }
 
 func main() {
+	if len(os.Args) > 1 {
+		if command, ok := commands[os.Args[1]]; ok {
+			if err := command(os.Args[2:]); err != nil {
+				logger.Fatal("Command failed", "command", os.Args[1], "err", err)
+			}
+			return
+		}
+	}
+
 	o := options{
-		Listen: ":9179",
+		Listen:   ":9179",
+		NodeName: os.Getenv("NODE_NAME"),
+		MaxIdle:  10 * time.Minute,
+
+		StateInterval: time.Minute,
 	}
 	flag.CommandLine.StringVar(&o.Listen, "listen", o.Listen, "Address and port to listen on for metrics")
-	flag.CommandLine.BoolVar(&o.Verbose, "v", o.Verbose, "Write verbose output")
+	flag.CommandLine.StringVar(&o.Nodes, "nodes", o.Nodes, "A JSON Kubernetes node list (kubectl get nodes -o json) used to report failed connections between nodes, reloaded when the file is replaced. See the sync command")
+	flag.CommandLine.StringVar(&o.Policies, "policies", o.Policies, "A JSON Kubernetes list of pods, namespaces, and network policies (kubectl get pods,namespaces,networkpolicies --all-namespaces -o json) used to report failed connections denied by a policy, reloaded when the file is replaced. See the sync command")
+	flag.CommandLine.StringVar(&o.NodeName, "node-name", o.NodeName, "The name of the node this process runs on, defaults to the NODE_NAME environment variable")
+	flag.CommandLine.StringVar(&o.Config, "config", o.Config, "A JSON config file for the tracker, reloaded on SIGHUP or when it changes. YAML is not supported")
+	flag.CommandLine.DurationVar(&o.MaxIdle, "max-idle", o.MaxIdle, "Report unhealthy if no conntrack events are received for this long, or never if zero")
+	flag.CommandLine.StringVar(&o.StateFile, "state-file", o.StateFile, "Periodically save the tracked destinations to this file and restore them on startup. With -run-as, the path must be absolute and its directory may hold nothing else")
+	flag.CommandLine.DurationVar(&o.StateInterval, "state-interval", o.StateInterval, "How often to save the tracked destinations to -state-file")
+	flag.CommandLine.StringVar(&o.RunAs, "run-as", o.RunAs, "Once started, switch to this UID or UID:GID keeping only CAP_NET_ADMIN. Requires starting as root")
+	flag.CommandLine.BoolVar(&o.Seccomp, "seccomp", o.Seccomp, "With -run-as, deny system calls used to escalate privileges or tamper with the host")
+	flag.CommandLine.BoolVar(&o.ICMPErrors, "icmp-errors", o.ICMPErrors, "Report ICMP destination unreachable errors received for failed connections as their reason. Only errors delivered to the network namespace of the process are seen, so connections opened by pods in their own namespaces are still reported as unreplied. Requires CAP_NET_RAW at startup")
+	o.Log.bind(flag.CommandLine)
+	o.Serve.bind(flag.CommandLine)
 	flag.Parse()
+	if err := o.Log.configure(); err != nil {
+		logger.Fatal("Invalid logging options", "err", err)
+	}
 
-	tracker := conntrack.New(conntrack.Arguments{Log: o.Verbose})
+	var cfg *config
+	var cfgData []byte
+	if len(o.Config) > 0 {
+		data, err := ioutil.ReadFile(o.Config)
+		if err != nil {
+			logger.Fatal("Unable to read config", "path", o.Config, "err", err)
+		}
+		if cfg, err = readConfig(data); err != nil {
+			logger.Fatal("Invalid config", "path", o.Config, "err", err)
+		}
+		cfgData = data
+	}
+	args, err := cfg.arguments(&o)
+	if err != nil {
+		logger.Fatal("Invalid config", "path", o.Config, "err", err)
+	}
+	if err := run(&o, cfg, cfgData, args); err != nil {
+		logger.Fatal("Daemon failed", "err", err)
+	}
+}
+
+// run watches for failed connections until the process is interrupted or fails. Errors are
+// returned instead of exiting so that the flow log is closed and the exporter drained.
+func run(o *options, cfg *config, cfgData []byte, args conntrack.Arguments) error {
+	tracker := conntrack.New(args)
+	if len(o.StateFile) > 0 {
+		if err := tracker.RestoreStateFile(o.StateFile); err != nil {
+			if !os.IsNotExist(err) {
+				logger.Warn("Unable to restore state, starting empty", "err", err)
+			}
+		} else {
+			logger.Info("Restored state", "path", o.StateFile)
+		}
+	}
+	if len(o.Config) > 0 || len(cfg.inputs(o)) > 0 {
+		go watchConfig(o, cfg, cfgData, 10*time.Second, func(cfg *config) error {
+			args, err := cfg.arguments(o)
+			if err != nil {
+				return err
+			}
+			tracker.Reconfigure(args)
+			return nil
+		})
+	}
+	events := conntrack.NewBroadcaster()
+	tracker.AddObserver(events)
+	if cfg != nil && cfg.Sinks.FlowLog != nil {
+		flowLog, err := conntrack.NewFlowLog(*cfg.Sinks.FlowLog)
+		if err != nil {
+			return fmt.Errorf("unable to open flow log %s: %v", cfg.Sinks.FlowLog.Path, err)
+		}
+		defer func() {
+			if err := flowLog.Close(); err != nil {
+				logger.Warn("Unable to close flow log", "path", cfg.Sinks.FlowLog.Path, "err", err)
+			}
+		}()
+		tracker.AddObserver(flowLog)
+	}
 
+	ctx, cancel := interruptible(context.Background())
+	defer cancel()
+
+	metrics := prometheus.NewRegistry()
+	metrics.MustRegister(tracker)
+	if cfg != nil && cfg.Sinks.OTLP != nil {
+		exporter, err := otlp.New(metrics, cfg.Sinks.OTLP.options(o.NodeName))
+		if err != nil {
+			return fmt.Errorf("invalid OTLP sink: %v", err)
+		}
+		tracker.AddObserver(exporter)
+		exported := make(chan struct{})
+		// stop and drain the exporter before returning, including on errors
+		defer func() {
+			cancel()
+			<-exported
+		}()
+		go func() {
+			defer close(exported)
+			exporter.Run(ctx)
+		}()
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/healthz", healthHandler(func() error { return tracker.Healthy(o.MaxIdle) }))
+	mux.Handle("/readyz", healthHandler(func() error {
+		if ctx.Err() != nil {
+			return fmt.Errorf("shutting down")
+		}
+		return tracker.Ready()
+	}))
+	server, serve, err := o.Serve.server(ctx, o.Listen, mux, map[string]http.Handler{
+		"/metrics":             promhttp.HandlerFor(metrics, promhttp.HandlerOpts{}),
+		"/api/v1/events":       conntrack.EventsHandler(events),
+		"/api/v1/dependencies": conntrack.DependenciesHandler(tracker, o.NodeName),
+	})
+	if err != nil {
+		return fmt.Errorf("unable to configure the server: %v", err)
+	}
+	server.RegisterOnShutdown(events.Close)
+	// a failure to serve stops the daemon
+	serveErr := make(chan error, 1)
 	go func() {
-		metrics := prometheus.NewRegistry()
-		metrics.MustRegister(tracker)
-		http.Handle("/metrics", promhttp.HandlerFor(metrics, promhttp.HandlerOpts{}))
-		if err := http.ListenAndServe(o.Listen, nil); err != nil {
-			log.Fatal(err)
+		if err := serve(); err != nil && err != http.ErrServerClosed {
+			serveErr <- fmt.Errorf("unable to serve metrics on %s: %v", o.Listen, err)
+			cancel()
 		}
 	}()
+	if len(o.Serve.PprofListen) > 0 {
+		go servePprof(o.Serve.PprofListen)
+	}
 
-	log.Printf("Watching for failed TCP connections, metrics served on %s", o.Listen)
-	ctx := context.Background()
+	if o.ICMPErrors {
+		icmpListener, err := conntrack.NewICMPListener(tracker)
+		if err != nil {
+			return fmt.Errorf("unable to receive ICMP errors: %v", err)
+		}
+		go icmpListener.Run(ctx)
+	}
+	if len(o.StateFile) > 0 {
+		go saveStateEvery(ctx, tracker, o.StateFile, o.StateInterval)
+	}
+	if len(o.RunAs) > 0 {
+		if err := dropPrivileges(o.RunAs, o.Seccomp, o.StateFile); err != nil {
+			return fmt.Errorf("unable to drop privileges: %v", err)
+		}
+		logger.Info("Dropped privileges", "user", o.RunAs, "seccomp", o.Seccomp)
+		if err := o.Serve.check(); err != nil {
+			return fmt.Errorf("unable to authenticate clients after dropping privileges, the service account token must be readable by the group of -run-as: %v", err)
+		}
+	} else if o.Seccomp {
+		return fmt.Errorf("-seccomp requires -run-as")
+	}
+
+	logger.Info("Watching for failed TCP connections and SCTP associations", "listen", o.Listen)
+	if err := listen(ctx, tracker); ctx.Err() == nil {
+		return fmt.Errorf("unable to watch for connections: %v", err)
+	}
+
+	logger.Info("Shutting down")
+	if len(o.StateFile) > 0 {
+		if err := tracker.SaveStateFile(o.StateFile); err != nil {
+			logger.Warn("Unable to save state", "path", o.StateFile, "err", err)
+		}
+	}
+	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer shutdownCancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		logger.Warn("Unable to shut down the server cleanly", "err", err)
+	}
+	select {
+	case err := <-serveErr:
+		return err
+	default:
+		return nil
+	}
+}
+
+// listen runs the tracker until ctx is done or it fails, restarting it whenever the receive
+// buffer fills up.
+func listen(ctx context.Context, tracker *conntrack.ConnectionTracker) error {
 	for {
+		size := tracker.ReadBufferSize()
 		err := tracker.Listen(ctx)
 		if err == conntrack.ErrBufferFull {
-			log.Printf("warning: Receive buffer filled up, restarting")
-			time.Sleep(5 * time.Second)
+			if tracker.ReadBufferSize() > size {
+				logger.Warn("Receive buffer filled up, restarting with a larger buffer", "bytes", tracker.ReadBufferSize())
+				continue
+			}
+			logger.Warn("Receive buffer filled up at its maximum size, restarting")
+			select {
+			case <-time.After(5 * time.Second):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
 			continue
 		}
-		if err != nil {
-			log.Fatal(err)
+		if err == conntrack.ErrListenerStalled {
+			logger.Warn("No conntrack events received although connections are changing, restarting")
+			continue
+		}
+		if err == nil && ctx.Err() == nil {
+			continue
+		}
+		return err
+	}
+}
+
+// saveStateEvery writes the state of the tracker to path on every interval until ctx is done.
+func saveStateEvery(ctx context.Context, tracker *conntrack.ConnectionTracker, path string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := tracker.SaveStateFile(path); err != nil {
+				logger.Warn("Unable to save state", "path", path, "err", err)
+			}
+		case <-ctx.Done():
+			return
 		}
 	}
 }
+
+// healthHandler reports success if check returns no error.
+func healthHandler(check func() error) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if err := check(); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+}
+
+// interruptible returns a context that is cancelled when the process is interrupted.
+func interruptible(parent context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(parent)
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		select {
+		case <-signals:
+			cancel()
+		case <-ctx.Done():
+		}
+		signal.Stop(signals)
+	}()
+	return ctx, cancel
+}
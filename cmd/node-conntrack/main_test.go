@@ -0,0 +1,30 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHealthHandler(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		code int
+		body string
+	}{
+		{name: "healthy", code: http.StatusOK, body: "ok\n"},
+		{name: "unhealthy", err: fmt.Errorf("not listening for conntrack events"), code: http.StatusServiceUnavailable, body: "not listening for conntrack events\n"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			healthHandler(func() error { return test.err }).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+			if w.Code != test.code || !strings.HasPrefix(w.Body.String(), test.body) {
+				t.Fatalf("expected %d %q, got %d %q", test.code, test.body, w.Code, w.Body.String())
+			}
+		})
+	}
+}
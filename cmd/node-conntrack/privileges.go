@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/smarterclayton/node-conntrack/pkg/privileges"
+)
+
+// dropPrivileges switches to the user in runAs, formatted as UID or UID:GID, keeping only
+// CAP_NET_ADMIN. The directory of the state file is given to the user first so that state
+// can still be saved, which requires the directory to be dedicated to the state file.
+func dropPrivileges(runAs string, seccomp bool, stateFile string) error {
+	opts, err := parseUser(runAs)
+	if err != nil {
+		return err
+	}
+	opts.Seccomp = seccomp
+	if len(stateFile) > 0 {
+		dir, err := stateDirectory(stateFile)
+		if err != nil {
+			return err
+		}
+		if err := os.Chown(dir, opts.UID, opts.GID); err != nil {
+			return fmt.Errorf("unable to give the state directory to the user: %v", err)
+		}
+		if err := os.Chown(stateFile, opts.UID, opts.GID); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("unable to give the state file to the user: %v", err)
+		}
+	}
+	return privileges.Drop(opts)
+}
+
+// stateDirectory returns the directory of the state file if it is safe to give to another
+// user: the path must be absolute, and the directory may hold nothing but the state file
+// and the temporary files it is written through.
+func stateDirectory(stateFile string) (string, error) {
+	if !filepath.IsAbs(stateFile) {
+		return "", fmt.Errorf("-state-file must be an absolute path when used with -run-as")
+	}
+	dir, base := filepath.Split(filepath.Clean(stateFile))
+	dir = filepath.Clean(dir)
+	if dir == "/" {
+		return "", fmt.Errorf("-state-file must be in a directory dedicated to it when used with -run-as")
+	}
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return "", fmt.Errorf("unable to read the state directory: %v", err)
+	}
+	for _, entry := range entries {
+		if name := entry.Name(); name != base && !strings.HasPrefix(name, "."+base) {
+			return "", fmt.Errorf("-state-file must be in a directory dedicated to it when used with -run-as, %s contains %s", dir, name)
+		}
+	}
+	return dir, nil
+}
+
+func parseUser(s string) (privileges.Options, error) {
+	var opts privileges.Options
+	parts := strings.SplitN(s, ":", 2)
+	uid, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return opts, fmt.Errorf("-run-as must be UID or UID:GID: %v", err)
+	}
+	gid := uid
+	if len(parts) == 2 {
+		if gid, err = strconv.Atoi(parts[1]); err != nil {
+			return opts, fmt.Errorf("-run-as must be UID or UID:GID: %v", err)
+		}
+	}
+	opts.UID, opts.GID = uid, gid
+	return opts, nil
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestStateDirectory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "state.json")
+
+	if got, err := stateDirectory(path); err != nil || got != dir {
+		t.Fatalf("expected an empty directory to be accepted: %q %v", got, err)
+	}
+	for _, name := range []string{"state.json", ".state.json123456"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := stateDirectory(path); err != nil {
+		t.Fatalf("expected the state file and its temporary files to be accepted: %v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "other"), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stateDirectory(path); err == nil {
+		t.Fatal("expected a shared directory to be rejected")
+	}
+
+	for _, path := range []string{"state.json", "./state.json", "/state.json", filepath.Join(dir, "missing", "state.json")} {
+		if _, err := stateDirectory(path); err == nil {
+			t.Errorf("expected %s to be rejected", path)
+		}
+	}
+}
+
+func TestParseUser(t *testing.T) {
+	tests := []struct {
+		runAs    string
+		uid, gid int
+		err      bool
+	}{
+		{runAs: "65534", uid: 65534, gid: 65534},
+		{runAs: "1000:2000", uid: 1000, gid: 2000},
+		{runAs: "nobody", err: true},
+		{runAs: "1000:staff", err: true},
+	}
+	for _, test := range tests {
+		opts, err := parseUser(test.runAs)
+		if (err != nil) != test.err || (err == nil && (opts.UID != test.uid || opts.GID != test.gid)) {
+			t.Errorf("%s: unexpected %#v %v", test.runAs, opts, err)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/expfmt"
+
+	"github.com/smarterclayton/node-conntrack/pkg/conntrack"
+)
+
+// record writes conntrack events to a file until interrupted or the duration elapses.
+func record(args []string) error {
+	flags := flag.NewFlagSet("record", flag.ExitOnError)
+	duration := flags.Duration("duration", 0, "Stop recording after this duration, or record until interrupted if zero")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s record [flags] FILE\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	f, err := os.Create(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	w, err := conntrack.NewFlowWriter(f)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := interruptible(context.Background())
+	defer cancel()
+	if *duration > 0 {
+		ctx, cancel = context.WithTimeout(ctx, *duration)
+		defer cancel()
+	}
+
+	logger.Info("Recording conntrack events", "path", flags.Arg(0))
+	if err := conntrack.Record(ctx, w); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// replay feeds a recording through a tracker and prints the resulting metrics.
+func replay(args []string) error {
+	flags := flag.NewFlagSet("replay", flag.ExitOnError)
+	speed := flags.Float64("speed", 0, "Replay at this multiple of the recorded speed, or as fast as possible if zero")
+	var trackerArgs conntrack.Arguments
+	var expireAfter uint
+	flags.DurationVar(&trackerArgs.Interval, "interval", 0, "The interval between flushes of the tracker, defaults to 15s")
+	flags.UintVar(&expireAfter, "expire-after", 0, "The number of intervals without events after which a destination is forgotten, defaults to 3")
+	flags.IntVar(&trackerArgs.MaxAddresses, "max-addresses", 0, "The maximum number of tracked addresses, defaults to 4096")
+	flags.IntVar(&trackerArgs.MaxDestinationsPerAddress, "max-destinations-per-address", 0, "The maximum number of tracked ports per address, defaults to 16")
+	flags.BoolVar(&trackerArgs.SynRetries, "syn-retries", false, "Estimate SYN retries from the delay between new connection events and their first reply")
+	policies := flags.String("policies", "", "A JSON Kubernetes list of pods, namespaces, and network policies used to report failures denied by a policy")
+	var logs logOptions
+	logs.bind(flags)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s replay [flags] FILE\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	trackerArgs.ExpireAfter = conntrack.UIntCounter(expireAfter)
+	if len(*policies) > 0 {
+		m, err := conntrack.LoadPolicyMap(*policies)
+		if err != nil {
+			return err
+		}
+		trackerArgs.Policies = m
+	}
+	if err := logs.configure(); err != nil {
+		return err
+	}
+
+	f, err := os.Open(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	r, err := conntrack.NewFlowReader(f)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := interruptible(context.Background())
+	defer cancel()
+
+	tracker := conntrack.New(trackerArgs)
+	start := time.Now()
+	count, err := tracker.Replay(ctx, r, *speed)
+	if err != nil {
+		return err
+	}
+	logger.Info("Replayed recording", "events", count, "duration", time.Since(start).Truncate(time.Millisecond))
+
+	metrics := prometheus.NewRegistry()
+	metrics.MustRegister(tracker)
+	families, err := metrics.Gather()
+	if err != nil {
+		return err
+	}
+	for _, family := range families {
+		if _, err := expfmt.MetricFamilyToText(os.Stdout, family); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/smarterclayton/node-conntrack/pkg/server"
+)
+
+// serveOptions secure the metrics and API server.
+type serveOptions struct {
+	CertFile       string
+	KeyFile        string
+	ClientCAFile   string
+	KubernetesAuth bool
+	PprofListen    string
+
+	// auth is set by server when bearer tokens are reviewed
+	auth *server.KubernetesAuth
+}
+
+// bind registers the server flags on flags.
+func (o *serveOptions) bind(flags *flag.FlagSet) {
+	flags.StringVar(&o.CertFile, "tls-cert-file", o.CertFile, "Serve over TLS with this PEM certificate, reloaded when it changes")
+	flags.StringVar(&o.KeyFile, "tls-key-file", o.KeyFile, "The PEM private key for -tls-cert-file")
+	flags.StringVar(&o.ClientCAFile, "tls-client-ca-file", o.ClientCAFile, "Require clients of the metrics and API endpoints to present a certificate signed by these CAs, or a bearer token if -authn-kubernetes is set")
+	flags.BoolVar(&o.KubernetesAuth, "authn-kubernetes", o.KubernetesAuth, "Require a bearer token on the metrics and API endpoints that the Kubernetes API server authenticates and authorizes for the request path")
+	flags.StringVar(&o.PprofListen, "pprof-listen", o.PprofListen, "Serve runtime profiles on this separate address, such as localhost:6060. Disabled if empty")
+}
+
+// server returns a server for handler on addr configured by the options, and a function
+// that starts it. Endpoints in protect require authentication if any is configured.
+func (o *serveOptions) server(ctx context.Context, addr string, mux *http.ServeMux, protect map[string]http.Handler) (*http.Server, func() error, error) {
+	if (len(o.CertFile) > 0) != (len(o.KeyFile) > 0) {
+		return nil, nil, fmt.Errorf("-tls-cert-file and -tls-key-file must be set together")
+	}
+	secure := len(o.CertFile) > 0
+	if !secure && (len(o.ClientCAFile) > 0 || o.KubernetesAuth) {
+		return nil, nil, fmt.Errorf("-tls-client-ca-file and -authn-kubernetes require -tls-cert-file")
+	}
+
+	var kube *server.KubernetesAuth
+	if o.KubernetesAuth {
+		var err error
+		if kube, err = server.NewInClusterAuth(); err != nil {
+			return nil, nil, err
+		}
+		o.auth = kube
+	}
+	authenticate := kube != nil || len(o.ClientCAFile) > 0
+	for path, h := range protect {
+		if authenticate {
+			h = server.Protect(h, kube)
+		}
+		mux.Handle(path, h)
+	}
+
+	s := &http.Server{Addr: addr, Handler: mux}
+	if !secure {
+		return s, s.ListenAndServe, nil
+	}
+	certs, err := server.NewCertificateReloader(o.CertFile, o.KeyFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	go certs.Run(ctx, 30*time.Second)
+	s.TLSConfig = &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: certs.GetCertificate,
+	}
+	if len(o.ClientCAFile) > 0 {
+		pool, err := server.LoadCertPool(o.ClientCAFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		s.TLSConfig.ClientCAs = pool
+		// health checks and bearer token clients do not present certificates
+		s.TLSConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return s, func() error { return s.ListenAndServeTLS("", "") }, nil
+}
+
+// check returns an error if the server is unable to review bearer tokens, such as when
+// the service account token is not readable by the user the process switched to.
+func (o *serveOptions) check() error {
+	if o.auth == nil {
+		return nil
+	}
+	return o.auth.CheckToken()
+}
+
+// servePprof serves runtime profiles on addr until the process exits.
+func servePprof(addr string) {
+	logger.Info("Serving runtime profiles", "listen", addr)
+	if err := http.ListenAndServe(addr, server.Profiling()); err != nil {
+		logger.Error("Unable to serve runtime profiles", "listen", addr, "err", err)
+	}
+}
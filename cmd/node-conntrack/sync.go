@@ -0,0 +1,421 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/smarterclayton/node-conntrack/pkg/server"
+)
+
+// syncLists keeps the lists read by -nodes and -policies up to date from the Kubernetes API
+// server, using the service account of the pod. It runs beside the daemon and shares the
+// files through a volume, so that the daemon itself never needs access to the API server.
+//
+// Each resource is listed once from the cache of the API server and then watched, so that
+// the API server only sends the objects that change rather than every object of the cluster
+// from every node on each interval. Changes are written at most once per interval.
+func syncLists(args []string) error {
+	flags := flag.NewFlagSet("sync", flag.ExitOnError)
+	nodes := flags.String("nodes", "", "Write the nodes of the cluster to this file, as read by -nodes")
+	policies := flags.String("policies", "", "Write the pods, namespaces, and network policies of the cluster to this file, as read by -policies")
+	interval := flags.Duration("interval", 10*time.Second, "How often to write changes to the lists, at most")
+	once := flags.Bool("once", false, "Write the lists once and exit")
+	flags.Parse(args)
+
+	if len(*nodes) == 0 && len(*policies) == 0 {
+		return fmt.Errorf("-nodes or -policies is required")
+	}
+	if *interval < time.Second {
+		return fmt.Errorf("-interval must be at least one second")
+	}
+	client, err := server.NewInClusterClient()
+	if err != nil {
+		return err
+	}
+	var lists []*syncList
+	if len(*nodes) > 0 {
+		lists = append(lists, newSyncList(*nodes, []syncResource{
+			{kind: "Node", path: "/api/v1/nodes", strip: stripNodeSpec},
+		}))
+	}
+	if len(*policies) > 0 {
+		lists = append(lists, newSyncList(*policies, []syncResource{
+			{kind: "Namespace", path: "/api/v1/namespaces"},
+			// finished pods are ignored by policy evaluation
+			{kind: "Pod", path: "/api/v1/pods?fieldSelector=status.phase%21%3DSucceeded%2Cstatus.phase%21%3DFailed", strip: stripPodSpec},
+			{kind: "NetworkPolicy", path: "/apis/networking.k8s.io/v1/networkpolicies"},
+		}))
+	}
+
+	ctx, cancel := interruptible(context.Background())
+	defer cancel()
+
+	for _, list := range lists {
+		for i := range list.resources {
+			if _, err := list.list(ctx, client, i); err != nil {
+				if *once {
+					return err
+				}
+				logger.Warn("Unable to list resource", "kind", list.resources[i].kind, "err", err)
+			}
+		}
+		if err := list.write(); err != nil {
+			if *once {
+				return err
+			}
+			logger.Warn("Unable to write list", "path", list.path, "err", err)
+		}
+	}
+	if *once {
+		return nil
+	}
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	for _, list := range lists {
+		for i := range list.resources {
+			wg.Add(1)
+			go func(list *syncList, i int) {
+				defer wg.Done()
+				list.run(ctx, client, i)
+			}(list, i)
+		}
+	}
+
+	ticker := time.NewTicker(*interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+		for _, list := range lists {
+			if err := list.write(); err != nil {
+				logger.Warn("Unable to write list", "path", list.path, "err", err)
+			}
+		}
+	}
+}
+
+// syncRetryInterval is how long to wait before listing a resource again after an error.
+const syncRetryInterval = 10 * time.Second
+
+// syncResource is a kind of object listed from path on the API server.
+type syncResource struct {
+	kind string
+	path string
+	// strip, if set, returns the fields of a spec that the daemon reads
+	strip func(json.RawMessage) (json.RawMessage, error)
+}
+
+// syncList is a file holding a List of the objects of one or more resources.
+type syncList struct {
+	path      string
+	resources []syncResource
+
+	lock sync.Mutex
+	// items holds the objects of each resource by namespace and name, and is nil until the
+	// resource has been listed
+	items    []map[string]syncObject
+	versions []string
+	changed  bool
+}
+
+func newSyncList(path string, resources []syncResource) *syncList {
+	return &syncList{
+		path:      path,
+		resources: resources,
+		items:     make([]map[string]syncObject, len(resources)),
+		versions:  make([]string, len(resources)),
+	}
+}
+
+// syncObject is the subset of an object that the daemon reads. Fields that change
+// without affecting the daemon, such as conditions and resource versions, are left out
+// so that the file is only replaced when something the daemon uses has changed.
+type syncObject struct {
+	Kind     string `json:"kind"`
+	Metadata struct {
+		Name            string            `json:"name"`
+		Namespace       string            `json:"namespace,omitempty"`
+		Labels          map[string]string `json:"labels,omitempty"`
+		ResourceVersion string            `json:"resourceVersion,omitempty"`
+	} `json:"metadata"`
+	Spec   json.RawMessage `json:"spec,omitempty"`
+	Status struct {
+		Phase  string `json:"phase,omitempty"`
+		PodIP  string `json:"podIP,omitempty"`
+		PodIPs []struct {
+			IP string `json:"ip"`
+		} `json:"podIPs,omitempty"`
+		Addresses []struct {
+			Type    string `json:"type"`
+			Address string `json:"address"`
+		} `json:"addresses,omitempty"`
+	} `json:"status"`
+}
+
+// stripPodSpec returns the fields of a pod spec read by policy evaluation, so that the
+// list holds neither the full spec of every pod nor changes to fields it does not use.
+func stripPodSpec(data json.RawMessage) (json.RawMessage, error) {
+	var spec struct {
+		HostNetwork bool `json:"hostNetwork,omitempty"`
+		Containers  []struct {
+			Ports []struct {
+				Name          string `json:"name,omitempty"`
+				ContainerPort int32  `json:"containerPort"`
+				Protocol      string `json:"protocol,omitempty"`
+			} `json:"ports,omitempty"`
+		} `json:"containers,omitempty"`
+	}
+	if err := json.Unmarshal(data, &spec); err != nil {
+		return nil, err
+	}
+	return json.Marshal(spec)
+}
+
+// stripNodeSpec returns the pod networks of a node spec.
+func stripNodeSpec(data json.RawMessage) (json.RawMessage, error) {
+	var spec struct {
+		PodCIDR  string   `json:"podCIDR,omitempty"`
+		PodCIDRs []string `json:"podCIDRs,omitempty"`
+	}
+	if err := json.Unmarshal(data, &spec); err != nil {
+		return nil, err
+	}
+	return json.Marshal(spec)
+}
+
+// run keeps the objects of resource i up to date until ctx is done by watching for
+// changes, and lists the resource again when the watch can no longer be resumed.
+func (l *syncList) run(ctx context.Context, client *server.Client, i int) {
+	l.lock.Lock()
+	version := l.versions[i]
+	l.lock.Unlock()
+	for ctx.Err() == nil {
+		var err error
+		if len(version) == 0 {
+			version, err = l.list(ctx, client, i)
+		} else {
+			version, err = l.watch(ctx, client, i, version)
+		}
+		if err != nil && ctx.Err() == nil {
+			logger.Warn("Unable to sync resource", "kind", l.resources[i].kind, "err", err)
+			version = ""
+			select {
+			case <-ctx.Done():
+			case <-time.After(syncRetryInterval):
+			}
+		}
+	}
+}
+
+// list replaces the objects of resource i and returns the resource version to watch from.
+func (l *syncList) list(ctx context.Context, client *server.Client, i int) (string, error) {
+	var page struct {
+		Metadata struct {
+			ResourceVersion string `json:"resourceVersion"`
+		} `json:"metadata"`
+		Items []syncObject `json:"items"`
+	}
+	// a resource version of 0 is served from the cache of the API server
+	path := l.resources[i].path
+	if strings.Contains(path, "?") {
+		path += "&resourceVersion=0"
+	} else {
+		path += "?resourceVersion=0"
+	}
+	if err := client.Do(ctx, http.MethodGet, path, nil, &page); err != nil {
+		return "", err
+	}
+	items := make(map[string]syncObject, len(page.Items))
+	for _, item := range page.Items {
+		key, item, err := l.object(i, item)
+		if err != nil {
+			return "", err
+		}
+		items[key] = item
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if !reflect.DeepEqual(l.items[i], items) {
+		l.items[i] = items
+		l.changed = true
+	}
+	l.versions[i] = page.Metadata.ResourceVersion
+	return page.Metadata.ResourceVersion, nil
+}
+
+// errWatchExpired is returned by update when the resource version of a watch is too old to
+// resume from.
+var errWatchExpired = fmt.Errorf("the resource version of the watch has expired")
+
+// watch applies the changes to resource i after version until the watch ends, and returns
+// the resource version to resume from, or an empty version if the resource must be listed
+// again.
+func (l *syncList) watch(ctx context.Context, client *server.Client, i int, version string) (string, error) {
+	err := client.Watch(ctx, l.resources[i].path, version, func(e server.WatchEvent) error {
+		next, err := l.update(i, e)
+		if err != nil {
+			return err
+		}
+		version = next
+		return nil
+	})
+	if err == errWatchExpired {
+		return "", nil
+	}
+	return version, err
+}
+
+// update applies a watch event to the objects of resource i and returns the resource
+// version of the event.
+func (l *syncList) update(i int, e server.WatchEvent) (string, error) {
+	if e.Type == "ERROR" {
+		var status struct {
+			Code    int    `json:"code"`
+			Message string `json:"message"`
+		}
+		if err := json.Unmarshal(e.Object, &status); err != nil {
+			return "", err
+		}
+		if status.Code == http.StatusGone {
+			return "", errWatchExpired
+		}
+		return "", fmt.Errorf("watch failed: %s", status.Message)
+	}
+	var item syncObject
+	if err := json.Unmarshal(e.Object, &item); err != nil {
+		return "", err
+	}
+	version := item.Metadata.ResourceVersion
+	if e.Type == "BOOKMARK" {
+		return version, nil
+	}
+	key, item, err := l.object(i, item)
+	if err != nil {
+		return "", err
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	items := l.items[i]
+	if items == nil {
+		items = make(map[string]syncObject)
+		l.items[i] = items
+	}
+	existing, ok := items[key]
+	switch e.Type {
+	case "ADDED", "MODIFIED":
+		if !ok || !reflect.DeepEqual(existing, item) {
+			items[key] = item
+			l.changed = true
+		}
+	case "DELETED":
+		if ok {
+			delete(items, key)
+			l.changed = true
+		}
+	}
+	l.versions[i] = version
+	return version, nil
+}
+
+// object returns the key of an object of resource i and the fields of it that are written.
+func (l *syncList) object(i int, item syncObject) (string, syncObject, error) {
+	resource := l.resources[i]
+	// the items of a list do not include their kind
+	item.Kind = resource.kind
+	item.Metadata.ResourceVersion = ""
+	if resource.strip != nil && len(item.Spec) > 0 {
+		spec, err := resource.strip(item.Spec)
+		if err != nil {
+			return "", item, fmt.Errorf("invalid %s %s/%s: %v", resource.kind, item.Metadata.Namespace, item.Metadata.Name, err)
+		}
+		item.Spec = spec
+	}
+	return item.Metadata.Namespace + "/" + item.Metadata.Name, item, nil
+}
+
+// write replaces the file if the objects changed since it was last written and every
+// resource has been listed.
+func (l *syncList) write() error {
+	list := struct {
+		APIVersion string       `json:"apiVersion"`
+		Kind       string       `json:"kind"`
+		Items      []syncObject `json:"items"`
+	}{APIVersion: "v1", Kind: "List", Items: []syncObject{}}
+
+	l.lock.Lock()
+	if !l.changed {
+		l.lock.Unlock()
+		return nil
+	}
+	for _, items := range l.items {
+		if items == nil {
+			l.lock.Unlock()
+			return nil
+		}
+	}
+	for _, items := range l.items {
+		keys := make([]string, 0, len(items))
+		for key := range items {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			list.Items = append(list.Items, items[key])
+		}
+	}
+	l.changed = false
+	l.lock.Unlock()
+
+	data, err := json.Marshal(list)
+	if err == nil {
+		if existing, readErr := ioutil.ReadFile(l.path); readErr == nil && bytes.Equal(existing, data) {
+			return nil
+		}
+		err = writeFileAtomic(l.path, data)
+	}
+	if err != nil {
+		l.lock.Lock()
+		l.changed = true
+		l.lock.Unlock()
+	}
+	return err
+}
+
+// writeFileAtomic replaces path with data by renaming a temporary file in the same
+// directory, so that readers never see a partial file.
+func writeFileAtomic(path string, data []byte) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Chmod(0644); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/smarterclayton/node-conntrack/pkg/server"
+)
+
+func TestStripPodSpec(t *testing.T) {
+	spec, err := stripPodSpec(json.RawMessage(`{
+		"hostNetwork": true,
+		"nodeName": "node-1",
+		"volumes": [{"name": "data"}],
+		"containers": [{"name": "web", "image": "web:1", "env": [{"name": "A"}], "ports": [{"name": "http", "containerPort": 8080, "protocol": "TCP"}]}]
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(spec) != `{"hostNetwork":true,"containers":[{"ports":[{"name":"http","containerPort":8080,"protocol":"TCP"}]}]}` {
+		t.Fatalf("unexpected spec %s", spec)
+	}
+	if _, err := stripPodSpec(json.RawMessage(`{"containers": {}}`)); err == nil {
+		t.Fatal("expected an invalid spec to be rejected")
+	}
+}
+
+func TestSyncListUpdate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sync")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "policies.json")
+
+	l := newSyncList(path, []syncResource{
+		{kind: "Namespace"},
+		{kind: "Pod", strip: stripPodSpec},
+	})
+	event := func(i int, eventType, object string) (string, error) {
+		return l.update(i, server.WatchEvent{Type: eventType, Object: json.RawMessage(object)})
+	}
+	written := func() string {
+		t.Helper()
+		if err := l.write(); err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil && !os.IsNotExist(err) {
+			t.Fatal(err)
+		}
+		return string(data)
+	}
+
+	if _, err := event(1, "ADDED", `{"metadata":{"name":"web","namespace":"a","resourceVersion":"2"},"spec":{"nodeName":"node-1"},"status":{"phase":"Running","podIP":"10.128.0.5"}}`); err != nil {
+		t.Fatal(err)
+	}
+	// the list is not written until every resource has been listed
+	if data := written(); len(data) != 0 {
+		t.Fatalf("expected no list, got %s", data)
+	}
+	if _, err := event(0, "ADDED", `{"metadata":{"name":"a","resourceVersion":"1"}}`); err != nil {
+		t.Fatal(err)
+	}
+	list := `{"apiVersion":"v1","kind":"List","items":[` +
+		`{"kind":"Namespace","metadata":{"name":"a"},"status":{}},` +
+		`{"kind":"Pod","metadata":{"name":"web","namespace":"a"},"spec":{},"status":{"phase":"Running","podIP":"10.128.0.5"}}]}`
+	if data := written(); data != list {
+		t.Fatalf("unexpected list %s", data)
+	}
+
+	// changes to fields that are not written do not replace the list
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	version, err := event(1, "MODIFIED", `{"metadata":{"name":"web","namespace":"a","resourceVersion":"3"},"spec":{"nodeName":"node-2"},"status":{"phase":"Running","podIP":"10.128.0.5"}}`)
+	if err != nil || version != "3" {
+		t.Fatalf("unexpected version %s: %v", version, err)
+	}
+	if version, err := event(1, "BOOKMARK", `{"metadata":{"resourceVersion":"4"}}`); err != nil || version != "4" {
+		t.Fatalf("unexpected bookmark version %s: %v", version, err)
+	}
+	if data := written(); len(data) != 0 {
+		t.Fatalf("expected the list not to be written, got %s", data)
+	}
+
+	if _, err := event(1, "DELETED", `{"metadata":{"name":"web","namespace":"a","resourceVersion":"5"}}`); err != nil {
+		t.Fatal(err)
+	}
+	if data := written(); data != `{"apiVersion":"v1","kind":"List","items":[{"kind":"Namespace","metadata":{"name":"a"},"status":{}}]}` {
+		t.Fatalf("unexpected list %s", data)
+	}
+
+	if _, err := event(1, "ERROR", `{"kind":"Status","code":410,"message":"too old resource version"}`); err != errWatchExpired {
+		t.Fatalf("expected the watch to expire, got %v", err)
+	}
+	if _, err := event(1, "ERROR", `{"kind":"Status","code":500,"message":"internal error"}`); err == nil || err == errWatchExpired {
+		t.Fatalf("expected the watch to fail, got %v", err)
+	}
+}
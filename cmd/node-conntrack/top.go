@@ -0,0 +1,316 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/smarterclayton/node-conntrack/pkg/conntrack"
+	"github.com/smarterclayton/node-conntrack/pkg/server"
+)
+
+// top shows a continuously updated ranking of the destinations this node is failing to
+// reach, either by listening to the local conntrack table or by streaming events from a
+// running daemon.
+func top(args []string) error {
+	flags := flag.NewFlagSet("top", flag.ExitOnError)
+	server := flags.String("server", "", "The URL of a running daemon (http://host:9179) to stream events from instead of listening locally")
+	window := flags.Duration("window", time.Minute, "The window over which failure rates are calculated")
+	var client clientOptions
+	flags.StringVar(&client.Token, "token", "", "A bearer token to present to -server")
+	flags.StringVar(&client.TokenFile, "token-file", "", "Read the bearer token to present to -server from this file")
+	flags.StringVar(&client.CAFile, "ca-file", "", "Verify the certificate of -server with these PEM CAs instead of the system roots")
+	flags.StringVar(&client.CertFile, "cert-file", "", "Present this PEM client certificate to -server")
+	flags.StringVar(&client.KeyFile, "key-file", "", "The PEM private key for -cert-file")
+	flags.Parse(args)
+
+	if *window < time.Second {
+		return fmt.Errorf("-window must be at least one second")
+	}
+	if len(*server) == 0 && client != (clientOptions{}) {
+		return fmt.Errorf("-token, -token-file, -ca-file, -cert-file and -key-file require -server")
+	}
+
+	ctx, cancel := interruptible(context.Background())
+	defer cancel()
+
+	view := newTopView(*window)
+	errCh := make(chan error, 1)
+	if len(*server) > 0 {
+		c, token, err := client.build()
+		if err != nil {
+			return err
+		}
+		view.source = *server
+		go func() { errCh <- streamEvents(ctx, c, token, *server, view) }()
+	} else {
+		view.source = "local conntrack"
+		tracker := conntrack.New(conntrack.Arguments{})
+		tracker.AddObserver(view)
+		go func() { errCh <- listen(ctx, tracker) }()
+	}
+
+	// hide the cursor while drawing and restore it on exit
+	fmt.Print("\x1b[?25l")
+	defer fmt.Print("\x1b[?25h\n")
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		view.render(os.Stdout, terminalHeight())
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return nil
+		case err := <-errCh:
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+	}
+}
+
+// clientOptions configures how top authenticates to and verifies a daemon served with
+// -tls-cert-file, -tls-client-ca-file or -authn-kubernetes.
+type clientOptions struct {
+	Token     string
+	TokenFile string
+	CAFile    string
+	CertFile  string
+	KeyFile   string
+}
+
+// build returns the client and bearer token described by the options.
+func (o clientOptions) build() (*http.Client, string, error) {
+	if len(o.Token) > 0 && len(o.TokenFile) > 0 {
+		return nil, "", fmt.Errorf("-token and -token-file may not both be set")
+	}
+	if (len(o.CertFile) > 0) != (len(o.KeyFile) > 0) {
+		return nil, "", fmt.Errorf("-cert-file and -key-file must be set together")
+	}
+	token := o.Token
+	if len(o.TokenFile) > 0 {
+		data, err := ioutil.ReadFile(o.TokenFile)
+		if err != nil {
+			return nil, "", fmt.Errorf("unable to read -token-file: %v", err)
+		}
+		token = strings.TrimSpace(string(data))
+	}
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if len(o.CAFile) > 0 {
+		pool, err := server.LoadCertPool(o.CAFile)
+		if err != nil {
+			return nil, "", err
+		}
+		config.RootCAs = pool
+	}
+	if len(o.CertFile) > 0 {
+		cert, err := tls.LoadX509KeyPair(o.CertFile, o.KeyFile)
+		if err != nil {
+			return nil, "", fmt.Errorf("unable to load client certificate: %v", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = config
+	return &http.Client{Transport: transport}, token, nil
+}
+
+// streamEvents reads the JSON event stream of a daemon and passes each event to observer.
+func streamEvents(ctx context.Context, client *http.Client, token, server string, observer conntrack.Observer) error {
+	req, err := http.NewRequest("GET", strings.TrimSuffix(server, "/")+"/api/v1/events", nil)
+	if err != nil {
+		return err
+	}
+	if len(token) > 0 {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unable to stream events from %s: %s", server, resp.Status)
+	}
+	dec := json.NewDecoder(bufio.NewReader(resp.Body))
+	for {
+		var e conntrack.Event
+		if err := dec.Decode(&e); err != nil {
+			if err == io.EOF {
+				return fmt.Errorf("event stream from %s closed", server)
+			}
+			return err
+		}
+		observer.Observe(e)
+	}
+}
+
+// terminalHeight returns the number of rows of the terminal on standard output.
+func terminalHeight() int {
+	ws, err := unix.IoctlGetWinsize(int(os.Stdout.Fd()), unix.TIOCGWINSZ)
+	if err != nil || ws.Row == 0 {
+		return 24
+	}
+	return int(ws.Row)
+}
+
+// maxRecoveries is the number of recent recoveries shown by top.
+const maxRecoveries = 5
+
+type topKey struct {
+	ip       string
+	protocol uint8
+	port     uint16
+}
+
+type topDestination struct {
+	topKey
+	total int
+	last  time.Time
+	rate  *rateCounter
+}
+
+// topView accumulates events for display by top.
+type topView struct {
+	lock       sync.Mutex
+	source     string
+	window     time.Duration
+	failures   int
+	recovered  int
+	dsts       map[topKey]*topDestination
+	recoveries []conntrack.Event
+}
+
+func newTopView(window time.Duration) *topView {
+	return &topView{
+		window: window,
+		dsts:   make(map[topKey]*topDestination),
+	}
+}
+
+func (v *topView) Observe(e conntrack.Event) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	switch e.Type {
+	case conntrack.EventFailure:
+		key := topKey{ip: e.IP.String(), protocol: e.Protocol, port: e.Port}
+		dst, ok := v.dsts[key]
+		if !ok {
+			dst = &topDestination{topKey: key, rate: newRateCounter(v.window)}
+			v.dsts[key] = dst
+		}
+		dst.total++
+		dst.last = e.Time
+		dst.rate.add(e.Time)
+		v.failures++
+	case conntrack.EventRecovery:
+		v.recovered++
+		v.recoveries = append([]conntrack.Event{e}, v.recoveries...)
+		if len(v.recoveries) > maxRecoveries {
+			v.recoveries = v.recoveries[:maxRecoveries]
+		}
+	}
+}
+
+func (v *topView) render(w io.Writer, height int) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	now := time.Now()
+	var active []*topDestination
+	for key, dst := range v.dsts {
+		// forget destinations that have not failed for several windows
+		if now.Sub(dst.last) > 5*v.window {
+			delete(v.dsts, key)
+			continue
+		}
+		active = append(active, dst)
+	}
+	sort.Slice(active, func(i, j int) bool {
+		a, b := active[i].rate.total(now), active[j].rate.total(now)
+		if a != b {
+			return a > b
+		}
+		return active[i].last.After(active[j].last)
+	})
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "node-conntrack top - %s - %s\n", now.Format("15:04:05"), v.source)
+	fmt.Fprintf(&buf, "Destinations: %d failing, failures: %d, recoveries: %d\n\n", len(active), v.failures, v.recovered)
+
+	// leave room for the headers and the recoveries section
+	rows := height - 6 - maxRecoveries - 3
+	if rows < 1 {
+		rows = 1
+	}
+	if len(active) > rows {
+		active = active[:rows]
+	}
+	tw := tabwriter.NewWriter(&buf, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "DESTINATION\tPROTO\tPORT\tRATE/S\tFAILURES/%s\tTOTAL\tLAST\n", v.window)
+	for _, dst := range active {
+		recent := dst.rate.total(now)
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%.2f\t%d\t%d\t%s ago\n", dst.ip, conntrack.ProtocolName(dst.protocol), dst.port, float64(recent)/v.window.Seconds(), recent, dst.total, now.Sub(dst.last).Truncate(time.Second))
+	}
+	tw.Flush()
+
+	fmt.Fprintf(&buf, "\nRECENT RECOVERIES\n")
+	tw = tabwriter.NewWriter(&buf, 0, 4, 2, ' ', 0)
+	for _, e := range v.recoveries {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%d\n", e.Time.Format("15:04:05"), e.IP, conntrack.ProtocolName(e.Protocol), e.Port)
+	}
+	tw.Flush()
+
+	// move to the top left, clear the screen, and draw the view
+	fmt.Fprint(w, "\x1b[H\x1b[2J")
+	w.Write(bytes.TrimRight(buf.Bytes(), "\n"))
+}
+
+// rateCounter counts events in one second buckets over a fixed window.
+type rateCounter struct {
+	seconds []int64
+	counts  []int
+}
+
+func newRateCounter(window time.Duration) *rateCounter {
+	n := int(window / time.Second)
+	return &rateCounter{seconds: make([]int64, n), counts: make([]int, n)}
+}
+
+func (r *rateCounter) add(t time.Time) {
+	s := t.Unix()
+	i := int(s % int64(len(r.counts)))
+	if r.seconds[i] != s {
+		r.seconds[i] = s
+		r.counts[i] = 0
+	}
+	r.counts[i]++
+}
+
+func (r *rateCounter) total(now time.Time) int {
+	var sum int
+	for i, s := range r.seconds {
+		if age := now.Unix() - s; age >= 0 && age < int64(len(r.seconds)) {
+			sum += r.counts[i]
+		}
+	}
+	return sum
+}
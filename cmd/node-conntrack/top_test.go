@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/smarterclayton/node-conntrack/pkg/conntrack"
+)
+
+func TestRateCounter(t *testing.T) {
+	start := time.Unix(1600000000, 0)
+	tests := []struct {
+		name   string
+		events []time.Duration
+		now    time.Duration
+		total  int
+	}{
+		{name: "empty", total: 0},
+		{name: "same second", events: []time.Duration{0, 100 * time.Millisecond, 900 * time.Millisecond}, total: 3},
+		{name: "within the window", events: []time.Duration{0, time.Second, 2 * time.Second}, now: 2 * time.Second, total: 3},
+		{name: "oldest second leaves the window", events: []time.Duration{0, time.Second, 2 * time.Second}, now: 3 * time.Second, total: 2},
+		{name: "all expired", events: []time.Duration{0, time.Second}, now: time.Minute, total: 0},
+		// a bucket reused by a later second forgets the earlier counts
+		{name: "bucket reused", events: []time.Duration{0, 0, 3 * time.Second}, now: 3 * time.Second, total: 1},
+		{name: "events from the future", events: []time.Duration{5 * time.Second}, total: 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := newRateCounter(3 * time.Second)
+			for _, offset := range test.events {
+				r.add(start.Add(offset))
+			}
+			if total := r.total(start.Add(test.now)); total != test.total {
+				t.Fatalf("expected %d, got %d", test.total, total)
+			}
+		})
+	}
+}
+
+func TestTopView(t *testing.T) {
+	now := time.Now()
+	event := func(eventType conntrack.EventType, ip string, port uint16, age time.Duration) conntrack.Event {
+		return conntrack.Event{Type: eventType, Time: now.Add(-age), IP: net.ParseIP(ip), Protocol: 6, Port: port}
+	}
+
+	v := newTopView(time.Minute)
+	v.source = "test"
+	for _, e := range []conntrack.Event{
+		event(conntrack.EventFailure, "10.1.0.1", 80, 2*time.Second),
+		event(conntrack.EventFailure, "10.1.0.2", 443, 3*time.Second),
+		event(conntrack.EventFailure, "10.1.0.2", 443, 2*time.Second),
+		event(conntrack.EventFailure, "10.1.0.2", 443, time.Second),
+		// failing for longer than the window, but still shown until several windows pass
+		event(conntrack.EventFailure, "10.1.0.3", 22, 2*time.Minute),
+		// forgotten after several windows
+		event(conntrack.EventFailure, "10.1.0.4", 22, 10*time.Minute),
+		event(conntrack.EventRecovery, "10.1.0.5", 8080, time.Second),
+		event(conntrack.EventBroken, "10.1.0.6", 8080, time.Second),
+	} {
+		v.Observe(e)
+	}
+	for i := 0; i < maxRecoveries; i++ {
+		v.Observe(event(conntrack.EventRecovery, "10.1.0.7", uint16(9000+i), 0))
+	}
+
+	var out bytes.Buffer
+	v.render(&out, 40)
+	lines := strings.Split(out.String(), "\n")
+	if !strings.Contains(lines[1], "Destinations: 3 failing, failures: 6, recoveries: 6") {
+		t.Fatalf("unexpected summary %q", lines[1])
+	}
+	// destinations are ordered by their failures within the window
+	var order []string
+	for _, line := range lines[4:] {
+		if fields := strings.Fields(line); len(fields) > 4 && strings.HasPrefix(fields[0], "10.1.0.") {
+			order = append(order, fields[0]+" "+fields[4])
+		}
+	}
+	if strings.Join(order, ",") != "10.1.0.2 3,10.1.0.1 1,10.1.0.3 0" {
+		t.Fatalf("unexpected destinations %v", order)
+	}
+	if _, ok := v.dsts[topKey{ip: "10.1.0.4", protocol: 6, port: 22}]; ok {
+		t.Fatal("expected an old destination to be forgotten")
+	}
+	// only the most recent recoveries are kept, newest first
+	if len(v.recoveries) != maxRecoveries || v.recoveries[0].Port != 9000+maxRecoveries-1 {
+		t.Fatalf("unexpected recoveries %v", v.recoveries)
+	}
+
+	// a short terminal shows at least one destination
+	out.Reset()
+	v.render(&out, 5)
+	if strings.Count(out.String(), "10.1.0.") != 1+maxRecoveries {
+		t.Fatalf("expected a single destination:\n%s", out.String())
+	}
+}
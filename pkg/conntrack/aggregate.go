@@ -0,0 +1,113 @@
+package conntrack
+
+import (
+	"fmt"
+	"net"
+)
+
+// AggregationOptions group down destinations into CIDRs. An address belongs to the first
+// of CIDRs that contains it, then to the pod CIDR of its node if NodePodCIDRs is set, and
+// otherwise to the network of the given prefix length for its family. A prefix length of
+// zero leaves addresses of that family ungrouped.
+type AggregationOptions struct {
+	IPv4PrefixLength int      `json:"ipv4PrefixLength"`
+	IPv6PrefixLength int      `json:"ipv6PrefixLength"`
+	CIDRs            []string `json:"cidrs"`
+	NodePodCIDRs     bool     `json:"nodePodCIDRs"`
+	// SuppressThreshold, if set, stops reporting the individual addresses of a CIDR once
+	// at least this many of them are down, so a large outage is reported as one series.
+	SuppressThreshold int `json:"suppressThreshold"`
+}
+
+// Aggregation maps down destinations to the CIDR they are reported under.
+type Aggregation struct {
+	ipv4Mask          net.IPMask
+	ipv6Mask          net.IPMask
+	cidrs             []*net.IPNet
+	nodePodCIDRs      bool
+	suppressThreshold int
+}
+
+// NewAggregation validates the options and returns an aggregation.
+func NewAggregation(opts AggregationOptions) (*Aggregation, error) {
+	if opts.IPv4PrefixLength < 0 || opts.IPv4PrefixLength > 32 {
+		return nil, fmt.Errorf("ipv4PrefixLength must be between 0 and 32")
+	}
+	if opts.IPv6PrefixLength < 0 || opts.IPv6PrefixLength > 128 {
+		return nil, fmt.Errorf("ipv6PrefixLength must be between 0 and 128")
+	}
+	if opts.SuppressThreshold < 0 {
+		return nil, fmt.Errorf("suppressThreshold may not be negative")
+	}
+	cidrs, err := parseCIDRs(opts.CIDRs)
+	if err != nil {
+		return nil, fmt.Errorf("aggregation: %v", err)
+	}
+	a := &Aggregation{
+		cidrs:             cidrs,
+		nodePodCIDRs:      opts.NodePodCIDRs,
+		suppressThreshold: opts.SuppressThreshold,
+	}
+	if opts.IPv4PrefixLength > 0 {
+		a.ipv4Mask = net.CIDRMask(opts.IPv4PrefixLength, 32)
+	}
+	if opts.IPv6PrefixLength > 0 {
+		a.ipv6Mask = net.CIDRMask(opts.IPv6PrefixLength, 128)
+	}
+	return a, nil
+}
+
+// CIDR returns the CIDR ip is reported under, or false if it is not grouped.
+func (a *Aggregation) CIDR(ip net.IP, nodes *NodeMap) (string, bool) {
+	if a == nil {
+		return "", false
+	}
+	for _, cidr := range a.cidrs {
+		if cidr.Contains(ip) {
+			return cidr.String(), true
+		}
+	}
+	if a.nodePodCIDRs {
+		if cidr, ok := nodes.PodCIDR(ip); ok {
+			return cidr.String(), true
+		}
+	}
+	if v4 := ip.To4(); v4 != nil {
+		if a.ipv4Mask == nil {
+			return "", false
+		}
+		return (&net.IPNet{IP: v4.Mask(a.ipv4Mask), Mask: a.ipv4Mask}).String(), true
+	}
+	if a.ipv6Mask == nil {
+		return "", false
+	}
+	return (&net.IPNet{IP: ip.Mask(a.ipv6Mask), Mask: a.ipv6Mask}).String(), true
+}
+
+// downCIDRs counts the addresses reported as down in each CIDR, and returns the CIDRs
+// whose addresses are suppressed. It must be invoked with the lock held.
+func (t *ConnectionTracker) downCIDRs() (map[string]int, map[string]bool) {
+	a := t.args.Aggregation
+	if a == nil {
+		return nil, nil
+	}
+	counts := make(map[string]int)
+	for dst, state := range t.down {
+		if state.Up {
+			continue
+		}
+		if cidr, ok := a.CIDR(net.IP(dst), t.args.Nodes); ok {
+			counts[cidr]++
+		}
+	}
+	var suppressed map[string]bool
+	if a.suppressThreshold > 0 {
+		suppressed = make(map[string]bool)
+		for cidr, count := range counts {
+			if count >= a.suppressThreshold {
+				suppressed[cidr] = true
+			}
+		}
+	}
+	return counts, suppressed
+}
@@ -0,0 +1,129 @@
+package conntrack
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestAggregationCIDR(t *testing.T) {
+	nodes, err := ReadNodeMap(strings.NewReader(`{"items":[{"metadata":{"name":"node-1"},"spec":{"podCIDRs":["10.128.0.0/23","fd01::/64"]}}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		opts AggregationOptions
+		ip   string
+		cidr string
+	}{
+		{
+			name: "ungrouped without a prefix length",
+			ip:   "10.1.0.1",
+		},
+		{
+			name: "IPv4 prefix length",
+			opts: AggregationOptions{IPv4PrefixLength: 24},
+			ip:   "10.1.0.200",
+			cidr: "10.1.0.0/24",
+		},
+		{
+			name: "IPv4 prefix length does not group IPv6 addresses",
+			opts: AggregationOptions{IPv4PrefixLength: 24},
+			ip:   "fd00::1",
+		},
+		{
+			name: "IPv6 prefix length",
+			opts: AggregationOptions{IPv6PrefixLength: 64},
+			ip:   "fd00::1:1",
+			cidr: "fd00::/64",
+		},
+		{
+			name: "first containing CIDR",
+			opts: AggregationOptions{IPv4PrefixLength: 24, CIDRs: []string{"10.0.0.0/8", "10.1.0.0/16"}, NodePodCIDRs: true},
+			ip:   "10.128.0.1",
+			cidr: "10.0.0.0/8",
+		},
+		{
+			name: "node pod CIDR",
+			opts: AggregationOptions{IPv4PrefixLength: 24, CIDRs: []string{"10.1.0.0/16"}, NodePodCIDRs: true},
+			ip:   "10.128.1.1",
+			cidr: "10.128.0.0/23",
+		},
+		{
+			name: "node IPv6 pod CIDR",
+			opts: AggregationOptions{NodePodCIDRs: true},
+			ip:   "fd01::1",
+			cidr: "fd01::/64",
+		},
+		{
+			name: "prefix length outside of node pod CIDRs",
+			opts: AggregationOptions{IPv4PrefixLength: 16, NodePodCIDRs: true},
+			ip:   "10.129.0.1",
+			cidr: "10.129.0.0/16",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			a, err := NewAggregation(test.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			cidr, ok := a.CIDR(net.ParseIP(test.ip), nodes)
+			if ok != (len(test.cidr) > 0) || cidr != test.cidr {
+				t.Fatalf("expected %q, got %q %t", test.cidr, cidr, ok)
+			}
+		})
+	}
+
+	var a *Aggregation
+	if _, ok := a.CIDR(net.ParseIP("10.1.0.1"), nodes); ok {
+		t.Fatal("expected a nil aggregation to group no addresses")
+	}
+}
+
+func TestNewAggregationInvalid(t *testing.T) {
+	for _, opts := range []AggregationOptions{
+		{IPv4PrefixLength: -1},
+		{IPv4PrefixLength: 33},
+		{IPv6PrefixLength: 129},
+		{SuppressThreshold: -1},
+		{CIDRs: []string{"10.0.0.0/33"}},
+	} {
+		if _, err := NewAggregation(opts); err == nil {
+			t.Errorf("expected an error for %#v", opts)
+		}
+	}
+}
+
+func TestAggregationSuppression(t *testing.T) {
+	a, err := NewAggregation(AggregationOptions{IPv4PrefixLength: 24, SuppressThreshold: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracker := New(Arguments{Aggregation: a})
+	for _, ip := range []string{"10.1.0.1", "10.1.0.2", "10.1.0.3", "10.2.0.1", "10.2.0.2", "fd00::1"} {
+		tracker.down[string(net.ParseIP(ip))] = DestinationState{}
+	}
+	// destinations that are up are not counted
+	tracker.down[string(net.ParseIP("10.2.0.3"))] = DestinationState{Up: true}
+
+	cidrs := collect(t, tracker, descTargetCIDRs)
+	if len(cidrs) != 2 || cidrs["10.1.0.0/24"] != 3 || cidrs["10.2.0.0/24"] != 2 {
+		t.Fatalf("unexpected CIDRs %v", cidrs)
+	}
+	// the addresses of CIDRs at the threshold are reported only as the CIDR
+	targets := collect(t, tracker, descTargets)
+	if len(targets) != 3 || targets["10.2.0.1"] != 1 || targets["10.2.0.2"] != 1 || targets["fd00::1"] != 1 {
+		t.Fatalf("unexpected targets %v", targets)
+	}
+
+	tracker.Reconfigure(Arguments{})
+	if targets := collect(t, tracker, descTargets); len(targets) != 6 {
+		t.Fatalf("expected every address to be reported without aggregation: %v", targets)
+	}
+	if cidrs := collect(t, tracker, descTargetCIDRs); len(cidrs) != 0 {
+		t.Fatalf("unexpected CIDRs %v", cidrs)
+	}
+}
@@ -0,0 +1,80 @@
+package conntrack
+
+import (
+	"net"
+	"sync"
+)
+
+// brokenReason returns why a connection that completed its handshake was destroyed in the
+// given TCP state, or an empty string if it was closed cleanly or the state is unknown.
+// Connections are destroyed in CLOSE after a reset, and in ESTABLISHED or one of the
+// half-closed states when they time out without further packets. Older kernels do not
+// report the state of destroyed connections, so none are counted.
+func brokenReason(state uint8) string {
+	switch state {
+	case tcpStateClose:
+		return ReasonReset
+	case tcpStateEstablished, tcpStateFinWait, tcpStateCloseWait, tcpStateLastAck:
+		return ReasonTimeout
+	default:
+		return ""
+	}
+}
+
+// reasonKey identifies the connections to a destination that failed for a reason.
+type reasonKey struct {
+	destination string
+	reason      string
+}
+
+// reasonCounter counts connections that failed per destination and reason, such as
+// established connections that were reset or timed out. The counts are exported as
+// counters, so they are never forgotten: a series that disappeared and came back would
+// restart from one and read as a reset. Instead at most maxDestinations destinations and
+// reasons are counted, and failures of any others are counted as dropped under name.
+type reasonCounter struct {
+	name string
+
+	lock   sync.Mutex
+	counts map[reasonKey]uint64
+}
+
+func newReasonCounter(name string) *reasonCounter {
+	return &reasonCounter{name: name, counts: make(map[reasonKey]uint64)}
+}
+
+// add counts a connection to dst that failed for reason.
+func (c *reasonCounter) add(dst net.IP, reason string, maxDestinations int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	key := reasonKey{destination: string(dst.To16()), reason: reason}
+	if _, ok := c.counts[key]; !ok && len(c.counts) >= maxDestinations {
+		gaugeReasonCountsDropped.WithLabelValues(c.name).Inc()
+		return
+	}
+	c.counts[key]++
+}
+
+// ReasonCount is the number of connections to a destination that failed for a reason.
+type ReasonCount struct {
+	IP     net.IP
+	Reason string
+	Count  uint64
+}
+
+// snapshot returns the counts of every destination and reason.
+func (c *reasonCounter) snapshot() []ReasonCount {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	counts := make([]ReasonCount, 0, len(c.counts))
+	for key, count := range c.counts {
+		counts = append(counts, ReasonCount{IP: net.IP(key.destination), Reason: key.reason, Count: count})
+	}
+	return counts
+}
+
+// BrokenConnections returns the counts of established connections that were reset or timed
+// out, per destination and reason.
+func (t *ConnectionTracker) BrokenConnections() []ReasonCount {
+	return t.broken.snapshot()
+}
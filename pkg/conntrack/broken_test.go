@@ -0,0 +1,47 @@
+package conntrack
+
+import (
+	"net"
+	"testing"
+)
+
+func TestBrokenReason(t *testing.T) {
+	for state, reason := range map[uint8]string{
+		tcpStateClose:       ReasonReset,
+		tcpStateEstablished: ReasonTimeout,
+		tcpStateFinWait:     ReasonTimeout,
+		tcpStateCloseWait:   ReasonTimeout,
+		tcpStateLastAck:     ReasonTimeout,
+		tcpStateTimeWait:    "",
+		tcpStateNone:        "",
+	} {
+		if got := brokenReason(state); got != reason {
+			t.Errorf("state %d: expected %q, got %q", state, reason, got)
+		}
+	}
+}
+
+func TestReasonCounter(t *testing.T) {
+	c := newReasonCounter("test")
+	a, b := net.ParseIP("10.0.0.1"), net.ParseIP("10.0.0.2")
+	c.add(a, ReasonReset, 2)
+	c.add(a.To4(), ReasonReset, 2)
+	c.add(a, ReasonTimeout, 2)
+	// beyond the maximum, only destinations and reasons already counted grow
+	c.add(b, ReasonReset, 2)
+	c.add(a, ReasonTimeout, 2)
+
+	counts := make(map[string]uint64)
+	for _, count := range c.snapshot() {
+		counts[count.IP.String()+" "+count.Reason] = count.Count
+	}
+	expected := map[string]uint64{"10.0.0.1 reset": 2, "10.0.0.1 timeout": 2}
+	if len(counts) != len(expected) {
+		t.Fatalf("unexpected counts %v", counts)
+	}
+	for key, count := range expected {
+		if counts[key] != count {
+			t.Errorf("%s: expected %d, got %d", key, count, counts[key])
+		}
+	}
+}
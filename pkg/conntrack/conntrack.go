@@ -12,22 +12,38 @@
 //   us the node as well. This is best colocated with the kube-proxy or SDN agent.
 // * Make sure we can have multiple netlink connections from within a single process
 //   if we include it.
-// * Consider treating localhost special (exclude?) or maybe that's still useful
 //
 package conntrack
 
 import (
 	"errors"
-	"log"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/smarterclayton/node-conntrack/pkg/logging"
+)
+
+var (
+	// trackerLog logs the outcome of connections and the state of the tracker.
+	trackerLog = logging.Named("tracker")
+	// listenerLog logs the health of the netlink subscription.
+	listenerLog = logging.Named("listener")
+	// sinkLog logs problems exporting events.
+	sinkLog = logging.Named("sink")
 )
 
 // ErrBufferFull is returned if the receive buffer fills up without being
 // drained, meaning we lost some events.
 var ErrBufferFull = errors.New("receive buffer is full, some events lost")
 
+// ErrListenerStalled is returned if no events were received for the stall timeout although
+// the conntrack table shows connections that should have generated events.
+var ErrListenerStalled = errors.New("no conntrack events received although connections are changing")
+
 // Arguments describes the configuration of a connection tracker.
 type Arguments struct {
 	Interval    time.Duration
@@ -36,7 +52,51 @@ type Arguments struct {
 	MaxAddresses              int
 	MaxDestinationsPerAddress int
 
-	Log bool
+	// A destination is flapping if it starts or stops being reported as down more than
+	// FlapThreshold times within FlapWindow.
+	FlapWindow    time.Duration
+	FlapThreshold int
+
+	// Nodes, if set, maps failed destinations to the node that owns them so that
+	// failures between nodes can be reported.
+	Nodes *NodeMap
+	// NodeName is the name of the node the tracker runs on, used as the source of
+	// failures whose source address is not a known node.
+	NodeName string
+
+	// Filter, if set, limits which flows are tracked.
+	Filter *Filter
+
+	// Policies, if set, are evaluated for failed connections between pods so that
+	// failures caused by a NetworkPolicy are reported as denied.
+	Policies *PolicyMap
+
+	// Aggregation, if set, also reports the number of down destinations per CIDR.
+	Aggregation *Aggregation
+
+	// StallTimeout, if set, is how long Listen may go without receiving events before
+	// the conntrack table is checked for activity. If connections are changing without
+	// generating events Listen returns ErrListenerStalled.
+	StallTimeout time.Duration
+
+	// ReadBufferSize is the initial size in bytes of the netlink receive buffer, and
+	// MaxReadBufferSize is the largest size it may grow to when events arrive faster
+	// than they are processed.
+	ReadBufferSize    int
+	MaxReadBufferSize int
+
+	// Scan, if set, detects sources that fail to connect to many distinct destinations
+	// and optionally stops recording their failures.
+	Scan *ScanDetection
+
+	// SynRetries estimates how often the SYN of connections is retransmitted before a
+	// reply, which requires Listen to also receive events for new connections. Changes
+	// take effect the next time Listen subscribes.
+	SynRetries bool
+
+	// Dependencies, if set, records the completed and failed connections between
+	// workloads as a dependency graph.
+	Dependencies *DependencyOptions
 }
 
 // WithDefaults sets default values for connection tracking.
@@ -53,6 +113,26 @@ func (args Arguments) WithDefaults() Arguments {
 	if args.MaxDestinationsPerAddress == 0 {
 		args.MaxDestinationsPerAddress = 16
 	}
+	if args.FlapWindow == 0 {
+		args.FlapWindow = 10 * time.Minute
+	}
+	if args.FlapThreshold == 0 {
+		args.FlapThreshold = 3
+	}
+	if args.ReadBufferSize == 0 {
+		args.ReadBufferSize = 1024 * 1024
+	}
+	if args.MaxReadBufferSize < args.ReadBufferSize {
+		args.MaxReadBufferSize = 16 * args.ReadBufferSize
+	}
+	if args.Scan != nil {
+		scan := args.Scan.WithDefaults()
+		args.Scan = &scan
+	}
+	if args.Dependencies != nil {
+		deps := args.Dependencies.WithDefaults()
+		args.Dependencies = &deps
+	}
 	return args
 }
 
@@ -60,40 +140,191 @@ func (args Arguments) WithDefaults() Arguments {
 // them after the requested intervals. The tracker limits how many destinations are tracked
 // if necessary.
 type ConnectionTracker struct {
-	args Arguments
+	// lastEvent and started are the times in nanoseconds that Listen last received an
+	// event and last subscribed, and are first to guarantee 64-bit alignment
+	lastEvent int64
+	started   int64
+	// readBuffer is the current size of the receive buffer in bytes, or zero if the
+	// configured size is in use
+	readBuffer int64
+	// listening is 1 while Listen is subscribed to events
+	listening int32
+	// replied is 1 if Listen must pass on connections that completed, which are otherwise
+	// only of interest if they are inbound
+	replied int32
+
+	args      Arguments
+	observers []Observer
+
+	// intervalChanged is signalled when Reconfigure changes the flush interval
+	intervalChanged chan struct{}
 
 	current map[string]DestinationState
 
 	lock sync.RWMutex
 	down map[string]DestinationState
+
+	partitions  map[NodePair]UIntCounter
+	partitioned map[NodePair]UIntCounter
+
+	// transitions are the times each destination started or stopped being reported as
+	// down within the flap window
+	transitions map[string][]time.Time
+
+	scans *scanDetector
+
+	// local is the set of local interface addresses, a map[string]struct{} keyed by the
+	// 16 byte form of each address
+	local atomic.Value
+	// inbound counts incomplete connections to local ports
+	inbound map[DestinationKey]uint64
+
+	graph   *dependencyGraph
+	retries *retryDetector
+	broken  *reasonCounter
+
+	// unreachable are the ICMP errors received for connections that have not been
+	// destroyed, and unreachableCounts counts the failures they explained
+	unreachable       *unreachableErrors
+	unreachableCounts *reasonCounter
+
+	// policyDenials counts failures by the policies that denied them
+	policyDenials *reasonCounter
+}
+
+// NodePair identifies the source and destination node of a connection.
+type NodePair struct {
+	Source      string
+	Destination string
 }
 
 // New initializes a new connection tracker.
 func New(args Arguments) *ConnectionTracker {
-	return &ConnectionTracker{
+	t := &ConnectionTracker{
 		args:    args.WithDefaults(),
 		current: make(map[string]DestinationState),
 		down:    make(map[string]DestinationState),
+
+		partitions:  make(map[NodePair]UIntCounter),
+		partitioned: make(map[NodePair]UIntCounter),
+		transitions: make(map[string][]time.Time),
+
+		scans:   newScanDetector(),
+		inbound: make(map[DestinationKey]uint64),
+		graph:   newDependencyGraph(),
+		retries: newRetryDetector(),
+		broken:  newReasonCounter("broken"),
+
+		unreachable:       newUnreachableErrors(),
+		unreachableCounts: newReasonCounter("unreachable"),
+		policyDenials:     newReasonCounter("policy"),
+
+		intervalChanged: make(chan struct{}, 1),
 	}
+	t.configureDependencies(t.args.Dependencies)
+	return t
 }
 
-func (t *ConnectionTracker) flush() {
+// Reconfigure changes the arguments of a running tracker without discarding the state it
+// has accumulated. New limits apply the next time they are checked, so a tracker that is
+// over a lowered limit will shrink as destinations expire.
+func (t *ConnectionTracker) Reconfigure(args Arguments) {
+	args = args.WithDefaults()
+
 	t.lock.Lock()
-	defer t.lock.Unlock()
+	changed := args.Interval != t.args.Interval
+	t.args.Interval = args.Interval
+	t.args.ExpireAfter = args.ExpireAfter
+	t.args.MaxAddresses = args.MaxAddresses
+	t.args.MaxDestinationsPerAddress = args.MaxDestinationsPerAddress
+	t.args.FlapWindow = args.FlapWindow
+	t.args.FlapThreshold = args.FlapThreshold
+	t.args.Nodes = args.Nodes
+	t.args.NodeName = args.NodeName
+	// keep the current filter if its rules are unchanged so that its hits keep counting
+	if !args.Filter.Equal(t.args.Filter) {
+		t.args.Filter = args.Filter
+	}
+	t.args.Policies = args.Policies
+	t.args.Aggregation = args.Aggregation
+	t.args.StallTimeout = args.StallTimeout
+	t.args.ReadBufferSize = args.ReadBufferSize
+	t.args.MaxReadBufferSize = args.MaxReadBufferSize
+	t.args.Scan = args.Scan
+	t.args.SynRetries = args.SynRetries
+	t.args.Dependencies = args.Dependencies
+	t.lock.Unlock()
+	t.configureDependencies(args.Dependencies)
 
-	if t.args.Log {
-		for dst, state := range t.down {
-			for target, stats := range state.Connections {
-				log.Printf("| %s up=%t port=%d success=%d failure=%d unknown=%d", net.IP(dst), state.Up, target.Port, stats.Success, stats.Failure, stats.Unknown)
-			}
+	if changed {
+		select {
+		case t.intervalChanged <- struct{}{}:
+		default:
 		}
-		for dst, state := range t.current {
-			for target, stats := range state.Connections {
-				log.Printf("< %s up=%t port=%d success=%d failure=%d unknown=%d", net.IP(dst), state.Up, target.Port, stats.Success, stats.Failure, stats.Unknown)
-			}
+	}
+}
+
+// configureDependencies enables the dependency graph with opts, or disables and clears it
+// if opts is nil.
+func (t *ConnectionTracker) configureDependencies(opts *DependencyOptions) {
+	if opts == nil {
+		atomic.StoreInt32(&t.replied, 0)
+		t.graph.reset()
+		return
+	}
+	t.graph.configure(*opts)
+	atomic.StoreInt32(&t.replied, 1)
+}
+
+// interval returns the current flush interval.
+func (t *ConnectionTracker) interval() time.Duration {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	return t.args.Interval
+}
+
+// ReadBufferSize returns the size in bytes of the netlink receive buffer used by Listen,
+// which starts at the configured size and adapts to the rate of events.
+func (t *ConnectionTracker) ReadBufferSize() int {
+	if size := atomic.LoadInt64(&t.readBuffer); size > 0 {
+		return int(size)
+	}
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	return t.args.ReadBufferSize
+}
+
+// stallTimeout returns the current stall timeout.
+func (t *ConnectionTracker) stallTimeout() time.Duration {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	return t.args.StallTimeout
+}
+
+// flushEvery flushes the tracker on the configured interval until stop is closed.
+func (t *ConnectionTracker) flushEvery(stop <-chan struct{}) {
+	t.refreshLocalAddresses()
+	ticker := time.NewTicker(t.interval())
+	defer func() { ticker.Stop() }()
+	for {
+		select {
+		case <-ticker.C:
+			t.refreshLocalAddresses()
+			t.flush()
+		case <-t.intervalChanged:
+			ticker.Stop()
+			ticker = time.NewTicker(t.interval())
+		case <-stop:
+			return
 		}
 	}
+}
 
+func (t *ConnectionTracker) flush() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	before := t.reportedDown()
 	for dst, state := range t.current {
 		downState, exists := t.down[dst]
 
@@ -144,6 +375,26 @@ func (t *ConnectionTracker) flush() {
 		}
 	}
 
+	t.recordTransitions(before, time.Now())
+
+	if t.args.Scan != nil {
+		t.scans.expire(*t.args.Scan, time.Now())
+	} else {
+		t.scans.reset()
+	}
+	if t.args.Dependencies != nil {
+		t.graph.expire(time.Now())
+	}
+	t.unreachable.expire(time.Now())
+	if t.args.SynRetries {
+		t.retries.expire(time.Now())
+	} else {
+		t.retries.reset()
+	}
+
+	t.partitioned = t.partitions
+	t.partitions = make(map[NodePair]UIntCounter, len(t.partitioned))
+
 	expired := 0
 	for dst, state := range t.down {
 		if state.Up && len(state.Connections) == 0 {
@@ -168,17 +419,18 @@ func (t *ConnectionTracker) flush() {
 			continue
 		}
 	}
-	if t.args.Log {
-		log.Printf("expired=%d down=%d current=%d", expired, len(t.down), len(t.current))
-		for dst, state := range t.down {
-			for target, stats := range state.Connections {
-				log.Printf("| %s up=%t port=%d success=%d failure=%d unknown=%d", net.IP(dst), state.Up, target.Port, stats.Success, stats.Failure, stats.Unknown)
-			}
-		}
-		for dst, state := range t.current {
-			for target, stats := range state.Connections {
-				log.Printf("< %s up=%t port=%d success=%d failure=%d unknown=%d", net.IP(dst), state.Up, target.Port, stats.Success, stats.Failure, stats.Unknown)
-			}
+	if trackerLog.Enabled(logging.LevelDebug) {
+		trackerLog.Debug("Flushed", "expired", expired, "down", len(t.down), "current", len(t.current))
+		logDestinations("down", t.down)
+		logDestinations("current", t.current)
+	}
+}
+
+// logDestinations logs every tracked connection of the table at the debug level.
+func logDestinations(table string, m map[string]DestinationState) {
+	for dst, state := range m {
+		for target, stats := range state.Connections {
+			trackerLog.Debug("Tracked destination", "table", table, "ip", net.IP(dst), "proto", ProtocolName(target.Protocol), "port", target.Port, "up", state.Up, "success", stats.Success, "failure", stats.Failure, "unknown", stats.Unknown)
 		}
 	}
 }
@@ -188,10 +440,12 @@ func (t *ConnectionTracker) isTrackingIP(ip net.IP) bool {
 	return ok && !state.Empty()
 }
 
-func (t *ConnectionTracker) failure(ip net.IP, protocol uint8, port uint16) (UIntCounter, UIntCounter) {
+func (t *ConnectionTracker) failure(src, ip net.IP, protocol uint8, port uint16) (UIntCounter, UIntCounter) {
 	t.lock.Lock()
 	defer t.lock.Unlock()
 
+	t.nodeFailure(src, ip)
+
 	state := t.current[string(ip)]
 
 	var changed bool
@@ -212,6 +466,26 @@ func (t *ConnectionTracker) failure(ip net.IP, protocol uint8, port uint16) (UIn
 	return state.Connections.Failure(protocol, port)
 }
 
+// nodeFailure records a failed connection between two nodes if the destination belongs to a
+// node other than the source.
+func (t *ConnectionTracker) nodeFailure(src, ip net.IP) {
+	dstNode, ok := t.args.Nodes.Node(ip)
+	if !ok {
+		return
+	}
+	srcNode, ok := t.args.Nodes.Node(src)
+	if !ok {
+		srcNode = t.args.NodeName
+	}
+	if len(srcNode) == 0 || srcNode == dstNode {
+		return
+	}
+	pair := NodePair{Source: srcNode, Destination: dstNode}
+	if count := t.partitions[pair] + 1; count > 0 {
+		t.partitions[pair] = count
+	}
+}
+
 func (t *ConnectionTracker) success(ip net.IP, protocol uint8, port uint16) (UIntCounter, UIntCounter, bool) {
 	t.lock.Lock()
 	defer t.lock.Unlock()
@@ -231,3 +505,153 @@ func (t *ConnectionTracker) success(ip net.IP, protocol uint8, port uint16) (UIn
 	failures, successes, ok := state.Connections.Success(protocol, port)
 	return failures, successes, ok || changed
 }
+
+// established records a destroyed connection that completed its handshake if it was reset
+// or timed out. It returns false if the connection was closed cleanly.
+func (t *ConnectionTracker) established(e *FlowEvent, maxAddresses int) bool {
+	reason := brokenReason(e.TCPState)
+	if len(reason) == 0 {
+		gaugeFilteredEvents.WithLabelValues().Inc()
+		return false
+	}
+	t.broken.add(e.Destination, reason, maxAddresses)
+	gaugeEvents.WithLabelValues().Inc()
+	if len(t.observers) > 0 {
+		event := newEvent(EventBroken, e)
+		event.Reason = reason
+		t.observe(event)
+	}
+	if trackerLog.Enabled(logging.LevelDebug) {
+		trackerLog.Debug("Established connection broken", "src", e.Source, "ip", e.Destination, "proto", ProtocolName(e.Protocol), "port", e.DestinationPort, "reason", reason)
+	}
+	return true
+}
+
+// handle records the outcome of a single TCP connection or SCTP association event.
+// Destroyed connections that never saw a reply, or associations that never reached
+// ESTABLISHED, are failures, while updates are successes for destinations that are
+// being tracked. Connections to local addresses that are destroyed before completing their
+// handshake are counted per local port, established connections that are reset or time out
+// are counted per destination, and every destroyed connection is added to the
+// dependency graph if it is enabled. New connections and their first reply estimate SYN
+// retries if enabled. Failures between pods are checked against the NetworkPolicies if
+// they are set. It returns false if the event was filtered out.
+func (t *ConnectionTracker) handle(e *FlowEvent) bool {
+	if e.Protocol != unix.IPPROTO_TCP && e.Protocol != unix.IPPROTO_SCTP {
+		gaugeFilteredEvents.WithLabelValues().Inc()
+		return false
+	}
+
+	t.lock.RLock()
+	filter, scan, maxAddresses, deps, synRetries, policies := t.args.Filter, t.args.Scan, t.args.MaxAddresses, t.args.Dependencies, t.args.SynRetries, t.args.Policies
+	t.lock.RUnlock()
+	if !filter.Allow(e) {
+		gaugeFilteredEvents.WithLabelValues().Inc()
+		return false
+	}
+	now := e.Time
+	if now.IsZero() {
+		now = time.Now()
+	}
+	// destinations are tracked by the 4 byte form of IPv4 addresses, as received from the
+	// kernel and restored from a snapshot
+	e.Source, e.Destination = normalizeIP(e.Source), normalizeIP(e.Destination)
+
+	switch e.Type {
+	case FlowNew:
+		// the retransmission timeouts of SCTP differ from TCP, so only TCP retries are
+		// estimated
+		if !synRetries || e.Protocol != unix.IPPROTO_TCP {
+			gaugeFilteredEvents.WithLabelValues().Inc()
+			return false
+		}
+		t.retries.opened(e)
+
+	case FlowDestroy:
+		if synRetries {
+			t.retries.closed(e)
+		}
+		if deps != nil {
+			t.graph.record(e, now, e.Assured())
+		}
+		inbound := t.isLocal(e.Destination)
+		if e.Replied() {
+			if e.Assured() {
+				return t.established(e, maxAddresses)
+			}
+			if !inbound {
+				gaugeFilteredEvents.WithLabelValues().Inc()
+				return false
+			}
+			t.inboundIncomplete(e.Protocol, e.DestinationPort)
+			gaugeEvents.WithLabelValues().Inc()
+			if trackerLog.Enabled(logging.LevelDebug) {
+				trackerLog.Debug("Inbound connection incomplete", "src", e.Source, "ip", e.Destination, "proto", ProtocolName(e.Protocol), "port", e.DestinationPort)
+			}
+			return true
+		}
+		if inbound {
+			t.inboundIncomplete(e.Protocol, e.DestinationPort)
+		}
+		if scan != nil {
+			if t.scans.failure(*scan, maxAddresses, now, e.Source, e.Destination, e.DestinationPort) && scan.Exclude {
+				gaugeScanExcludedEvents.WithLabelValues().Inc()
+				return false
+			}
+		}
+		reason := ReasonUnreplied
+		if unreachable, ok := t.unreachable.take(e); ok {
+			reason = unreachable
+			t.unreachableCounts.add(e.Destination, reason, maxAddresses)
+		}
+		var denied []string
+		if policies != nil {
+			dst, port := policyDestination(e)
+			denied = policies.Denied(e.Source, dst, e.Protocol, port)
+			for _, name := range denied {
+				t.policyDenials.add(e.Destination, name, maxAddresses)
+			}
+		}
+		failures, successes := t.failure(e.Source, e.Destination, e.Protocol, e.DestinationPort)
+		gaugeEvents.WithLabelValues().Inc()
+		if len(t.observers) > 0 {
+			event := newEvent(EventFailure, e)
+			event.Reason = reason
+			event.PolicyDenied = len(denied) > 0
+			event.Policies = denied
+			t.observe(event)
+		}
+		if trackerLog.Enabled(logging.LevelDebug) {
+			trackerLog.Debug("Connection failed", "src", e.Source, "ip", e.Destination, "proto", ProtocolName(e.Protocol), "port", e.DestinationPort, "state", "down", "reason", reason, "policies", denied, "failures", failures, "successes", successes)
+		}
+
+	case FlowUpdate:
+		// an association recovers once established, not when its INIT is answered
+		if !e.Replied() && e.Protocol == unix.IPPROTO_SCTP {
+			gaugeFilteredEvents.WithLabelValues().Inc()
+			return false
+		}
+		if synRetries && e.SeenReply() {
+			if retries := t.retries.replied(e, maxAddresses); retries > 0 && trackerLog.Enabled(logging.LevelDebug) {
+				trackerLog.Debug("Connection retried", "src", e.Source, "ip", e.Destination, "proto", ProtocolName(e.Protocol), "port", e.DestinationPort, "retries", retries)
+			}
+		}
+		failures, successes, ok := t.success(e.Destination, e.Protocol, e.DestinationPort)
+		if !ok {
+			gaugeFilteredEvents.WithLabelValues().Inc()
+			return false
+		}
+		gaugeEvents.WithLabelValues().Inc()
+		if len(t.observers) > 0 {
+			t.observe(newEvent(EventRecovery, e))
+		}
+		if trackerLog.Enabled(logging.LevelDebug) {
+			trackerLog.Debug("Connection recovered", "src", e.Source, "ip", e.Destination, "proto", ProtocolName(e.Protocol), "port", e.DestinationPort, "state", "up", "failures", failures, "successes", successes)
+		}
+
+	default:
+		gaugeFilteredEvents.WithLabelValues().Inc()
+		return false
+	}
+	return true
+}
@@ -0,0 +1,89 @@
+package conntrack
+
+import (
+	"net"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestHandleSCTP(t *testing.T) {
+	dst := net.ParseIP("10.1.0.1").To4()
+	association := func(eventType FlowEventType, status uint32) *FlowEvent {
+		return &FlowEvent{
+			Type:            eventType,
+			Protocol:        unix.IPPROTO_SCTP,
+			Source:          net.ParseIP("10.0.0.1").To4(),
+			Destination:     dst,
+			SourcePort:      40000,
+			DestinationPort: 3868,
+			Status:          status,
+		}
+	}
+
+	tests := []struct {
+		name    string
+		events  []*FlowEvent
+		handled []bool
+		down    bool
+	}{
+		{
+			name:    "new associations are not tracked",
+			events:  []*FlowEvent{association(FlowNew, 0)},
+			handled: []bool{false},
+		},
+		{
+			name:    "unanswered INIT",
+			events:  []*FlowEvent{association(FlowDestroy, 0)},
+			handled: []bool{true},
+			down:    true,
+		},
+		{
+			name:    "INIT answered and aborted",
+			events:  []*FlowEvent{association(FlowDestroy, statusSeenReply)},
+			handled: []bool{true},
+			down:    true,
+		},
+		{
+			// established associations have no TCP state to tell a reset or timeout from
+			name:    "established and closed",
+			events:  []*FlowEvent{association(FlowDestroy, statusSeenReply|statusAssured)},
+			handled: []bool{false},
+		},
+		{
+			name:    "answered INIT does not recover",
+			events:  []*FlowEvent{association(FlowDestroy, 0), association(FlowUpdate, statusSeenReply)},
+			handled: []bool{true, false},
+			down:    true,
+		},
+		{
+			name:    "established association recovers",
+			events:  []*FlowEvent{association(FlowDestroy, 0), association(FlowUpdate, statusSeenReply|statusAssured)},
+			handled: []bool{true, true},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tracker := New(Arguments{})
+			var events eventRecorder
+			tracker.AddObserver(&events)
+			for i, e := range test.events {
+				if handled := tracker.handle(e); handled != test.handled[i] {
+					t.Fatalf("event %d: expected handled %t, got %t", i, test.handled[i], handled)
+				}
+			}
+			tracker.flush()
+			if _, down := tracker.down[string(dst)]; down != test.down {
+				t.Fatalf("expected down %t: %v", test.down, tracker.down)
+			}
+			if broken := tracker.broken.snapshot(); len(broken) != 0 {
+				t.Fatalf("expected no broken associations: %v", broken)
+			}
+			for _, e := range events {
+				if e.Type == EventBroken {
+					t.Fatalf("unexpected broken event %#v", e)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,15 @@
+package conntrack
+
+import (
+	"net"
+)
+
+// UnrepliedDestination summarizes the connections to a single destination that are
+// currently in the conntrack table and have not seen a reply.
+type UnrepliedDestination struct {
+	IP          net.IP `json:"ip"`
+	Protocol    string `json:"proto"`
+	Port        uint16 `json:"port"`
+	Connections int    `json:"connections"`
+	Sources     int    `json:"sources"`
+}
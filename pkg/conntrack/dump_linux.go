@@ -0,0 +1,83 @@
+package conntrack
+
+import (
+	"bytes"
+	"net"
+	"sort"
+
+	"github.com/mdlayher/netlink"
+	"github.com/ti-mo/conntrack"
+)
+
+// DumpUnreplied reads the current conntrack table and returns the destinations of the
+// connections that have not seen a reply. See UnrepliedDestinations.
+func DumpUnreplied(protocol uint8) ([]UnrepliedDestination, error) {
+	conn, err := conntrack.Dial(&netlink.Config{DisableNSLockThread: true})
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	// an empty mark and mask matches every flow
+	flows, err := conn.DumpFilter(conntrack.Filter{})
+	if err != nil {
+		return nil, err
+	}
+	return UnrepliedDestinations(flows, protocol), nil
+}
+
+// UnrepliedDestinations groups the flows that have not seen a reply by destination, ordered
+// by the number of connections. If protocol is non-zero only flows of that protocol are
+// included. TCP flows must also still be in SYN_SENT if the kernel reports the TCP state.
+func UnrepliedDestinations(flows []conntrack.Flow, protocol uint8) []UnrepliedDestination {
+	type key struct {
+		ip       string
+		protocol uint8
+		port     uint16
+	}
+	sources := make(map[key]map[string]struct{})
+	counts := make(map[key]int)
+	for _, flow := range flows {
+		if flow.Status.SeenReply() {
+			continue
+		}
+		orig := flow.TupleOrig
+		if protocol != 0 && orig.Proto.Protocol != protocol {
+			continue
+		}
+		if tcp := flow.ProtoInfo.TCP; tcp != nil && tcp.State != tcpStateSynSent {
+			continue
+		}
+		k := key{ip: string(normalizeIP(orig.IP.DestinationAddress)), protocol: orig.Proto.Protocol, port: orig.Proto.DestinationPort}
+		counts[k]++
+		if sources[k] == nil {
+			sources[k] = make(map[string]struct{})
+		}
+		sources[k][string(normalizeIP(orig.IP.SourceAddress))] = struct{}{}
+	}
+
+	destinations := make([]UnrepliedDestination, 0, len(counts))
+	for k, count := range counts {
+		destinations = append(destinations, UnrepliedDestination{
+			IP:          net.IP(k.ip),
+			Protocol:    ProtocolName(k.protocol),
+			Port:        k.port,
+			Connections: count,
+			Sources:     len(sources[k]),
+		})
+	}
+	sort.Slice(destinations, func(i, j int) bool {
+		a, b := destinations[i], destinations[j]
+		if a.Connections != b.Connections {
+			return a.Connections > b.Connections
+		}
+		if c := bytes.Compare(a.IP, b.IP); c != 0 {
+			return c < 0
+		}
+		if a.Protocol != b.Protocol {
+			return a.Protocol < b.Protocol
+		}
+		return a.Port < b.Port
+	})
+	return destinations
+}
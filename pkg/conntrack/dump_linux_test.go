@@ -0,0 +1,78 @@
+package conntrack
+
+import (
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/ti-mo/conntrack"
+	"golang.org/x/sys/unix"
+)
+
+// unrepliedFlow returns a flow from src to dst:port. A TCP state of zero is not reported.
+func unrepliedFlow(protocol uint8, src, dst string, port uint16, status conntrack.StatusFlag, tcpState uint8) conntrack.Flow {
+	var flow conntrack.Flow
+	flow.TupleOrig.IP.SourceAddress = net.ParseIP(src)
+	flow.TupleOrig.IP.DestinationAddress = net.ParseIP(dst)
+	flow.TupleOrig.Proto.Protocol = protocol
+	flow.TupleOrig.Proto.SourcePort = 40000
+	flow.TupleOrig.Proto.DestinationPort = port
+	flow.Status.Value = status
+	if tcpState != 0 {
+		flow.ProtoInfo.TCP = &conntrack.ProtoInfoTCP{State: tcpState}
+	}
+	return flow
+}
+
+func TestUnrepliedDestinations(t *testing.T) {
+	flows := []conntrack.Flow{
+		unrepliedFlow(unix.IPPROTO_TCP, "10.0.0.1", "10.1.0.1", 80, 0, tcpStateSynSent),
+		unrepliedFlow(unix.IPPROTO_TCP, "10.0.0.2", "10.1.0.1", 80, 0, tcpStateSynSent),
+		// the same source is counted once, and addresses in either form are the same destination
+		unrepliedFlow(unix.IPPROTO_TCP, "10.0.0.2", "::ffff:10.1.0.1", 80, 0, 0),
+		unrepliedFlow(unix.IPPROTO_SCTP, "10.0.0.1", "10.1.0.2", 3868, 0, 0),
+		unrepliedFlow(unix.IPPROTO_TCP, "fd00::1", "fd00::10", 443, 0, tcpStateSynSent),
+		unrepliedFlow(unix.IPPROTO_TCP, "10.0.0.1", "10.1.0.2", 443, 0, tcpStateSynSent),
+		// replied flows, and unreplied TCP flows that are no longer opening, are skipped
+		unrepliedFlow(unix.IPPROTO_TCP, "10.0.0.1", "10.1.0.3", 80, conntrack.StatusSeenReply, tcpStateEstablished),
+		unrepliedFlow(unix.IPPROTO_SCTP, "10.0.0.1", "10.1.0.3", 3868, conntrack.StatusSeenReply, 0),
+		unrepliedFlow(unix.IPPROTO_TCP, "10.0.0.1", "10.1.0.3", 443, 0, tcpStateClose),
+	}
+	tests := []struct {
+		name         string
+		protocol     uint8
+		destinations []string
+	}{
+		{
+			name: "all protocols",
+			destinations: []string{
+				"10.1.0.1 tcp 80 3 2",
+				// ties are ordered by address, protocol, and port
+				"10.1.0.2 sctp 3868 1 1",
+				"10.1.0.2 tcp 443 1 1",
+				"fd00::10 tcp 443 1 1",
+			},
+		},
+		{
+			name:         "SCTP",
+			protocol:     unix.IPPROTO_SCTP,
+			destinations: []string{"10.1.0.2 sctp 3868 1 1"},
+		},
+		{
+			name:         "UDP",
+			protocol:     unix.IPPROTO_UDP,
+			destinations: []string{},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			destinations := []string{}
+			for _, d := range UnrepliedDestinations(flows, test.protocol) {
+				destinations = append(destinations, fmt.Sprintf("%s %s %d %d %d", d.IP, d.Protocol, d.Port, d.Connections, d.Sources))
+			}
+			if fmt.Sprint(destinations) != fmt.Sprint(test.destinations) {
+				t.Fatalf("expected %v, got %v", test.destinations, destinations)
+			}
+		})
+	}
+}
@@ -0,0 +1,184 @@
+package conntrack
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// EventType describes the outcome of a connection recorded by the tracker.
+type EventType string
+
+const (
+	// EventFailure is recorded when a connection was destroyed without seeing a reply.
+	EventFailure EventType = "failure"
+	// EventRecovery is recorded when a connection succeeds to a destination that is
+	// currently tracked as down.
+	EventRecovery EventType = "recovery"
+	// EventBroken is recorded when a connection that completed its handshake was reset or
+	// timed out instead of being closed.
+	EventBroken EventType = "broken"
+)
+
+const (
+	// ReasonUnreplied is the reason recorded for connections that were destroyed without
+	// the destination ever replying.
+	ReasonUnreplied = "unreplied"
+	// ReasonReset is the reason recorded for established connections that were reset.
+	ReasonReset = "reset"
+	// ReasonTimeout is the reason recorded for established connections that were destroyed
+	// after going without packets for the conntrack timeout of their state.
+	ReasonTimeout = "timeout"
+)
+
+// Event is a single connection outcome recorded by the tracker.
+type Event struct {
+	Time       time.Time `json:"time"`
+	Type       EventType `json:"type"`
+	Source     net.IP    `json:"src"`
+	SourcePort uint16    `json:"srcPort,omitempty"`
+	IP         net.IP    `json:"ip"`
+	Protocol   uint8     `json:"proto"`
+	Port       uint16    `json:"port"`
+	Zone       uint16    `json:"zone,omitempty"`
+	// Reason describes why a connection failed.
+	Reason string `json:"reason,omitempty"`
+	// PolicyDenied is true if the NetworkPolicies deny the connection, and Policies are the
+	// names of the denying policies.
+	PolicyDenied bool     `json:"policyDenied,omitempty"`
+	Policies     []string `json:"policies,omitempty"`
+	// NAT is the address translation applied to the connection, if any.
+	NAT *NAT `json:"nat,omitempty"`
+}
+
+// NAT describes the address translation applied to a connection, as seen in the reply
+// direction of the flow.
+type NAT struct {
+	// Destination and DestinationPort are where the connection was actually sent if the
+	// destination was translated, such as from a service to one of its endpoints.
+	Destination     net.IP `json:"dst,omitempty"`
+	DestinationPort uint16 `json:"dstPort,omitempty"`
+	// Source and SourcePort are where the connection appeared to come from if the source
+	// was translated, such as by masquerading.
+	Source     net.IP `json:"src,omitempty"`
+	SourcePort uint16 `json:"srcPort,omitempty"`
+}
+
+// newEvent describes the outcome of a flow.
+func newEvent(eventType EventType, e *FlowEvent) Event {
+	return Event{
+		Time:       e.Time,
+		Type:       eventType,
+		Source:     e.Source,
+		SourcePort: e.SourcePort,
+		IP:         e.Destination,
+		Protocol:   e.Protocol,
+		Port:       e.DestinationPort,
+		Zone:       e.Zone,
+		NAT:        e.NAT(),
+	}
+}
+
+// Observer receives the events recorded by a tracker. Observe is invoked from the netlink
+// event loop and must not block.
+type Observer interface {
+	Observe(Event)
+}
+
+// AddObserver registers an observer to receive every event recorded by the tracker. It
+// must be invoked before Listen.
+func (t *ConnectionTracker) AddObserver(o Observer) {
+	t.observers = append(t.observers, o)
+}
+
+func (t *ConnectionTracker) observe(e Event) {
+	for _, o := range t.observers {
+		o.Observe(e)
+	}
+}
+
+// Broadcaster is an Observer that fans events out to a changing set of watchers. Events
+// are dropped for watchers that are not keeping up.
+type Broadcaster struct {
+	lock     sync.Mutex
+	closed   bool
+	watchers map[chan Event]struct{}
+}
+
+// NewBroadcaster creates a broadcaster with no watchers.
+func NewBroadcaster() *Broadcaster {
+	return &Broadcaster{watchers: make(map[chan Event]struct{})}
+}
+
+// Observe sends the event to every watcher that has room in its buffer.
+func (b *Broadcaster) Observe(e Event) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	for ch := range b.watchers {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+}
+
+// Watch returns a channel of events that is closed when ctx is done or the broadcaster
+// is closed.
+func (b *Broadcaster) Watch(ctx context.Context) <-chan Event {
+	ch := make(chan Event, 256)
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.closed {
+		close(ch)
+		return ch
+	}
+	b.watchers[ch] = struct{}{}
+
+	go func() {
+		<-ctx.Done()
+		b.lock.Lock()
+		defer b.lock.Unlock()
+		if _, ok := b.watchers[ch]; ok {
+			delete(b.watchers, ch)
+			close(ch)
+		}
+	}()
+	return ch
+}
+
+// Close ends every watch and rejects new ones.
+func (b *Broadcaster) Close() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.closed = true
+	for ch := range b.watchers {
+		delete(b.watchers, ch)
+		close(ch)
+	}
+}
+
+// EventsHandler streams events from the broadcaster to the client as JSON lines until the
+// client disconnects.
+func EventsHandler(b *Broadcaster) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		flusher.Flush()
+
+		enc := json.NewEncoder(w)
+		for e := range b.Watch(req.Context()) {
+			if err := enc.Encode(e); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	})
+}
@@ -0,0 +1,244 @@
+package conntrack
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// FilterAction determines what happens to a flow that matches a filter rule.
+type FilterAction string
+
+const (
+	// FilterInclude tracks flows that match the rule.
+	FilterInclude FilterAction = "include"
+	// FilterExclude ignores flows that match the rule.
+	FilterExclude FilterAction = "exclude"
+)
+
+// FilterRule matches flows by source and destination CIDR, destination port, protocol, and
+// conntrack zone. A flow matches the rule if it matches at least one value of every field
+// that is set. Ports are single ports or inclusive ranges such as "8000-8080".
+type FilterRule struct {
+	Name         string       `json:"name"`
+	Action       FilterAction `json:"action"`
+	Sources      []string     `json:"sources"`
+	Destinations []string     `json:"destinations"`
+	Ports        []string     `json:"ports"`
+	Protocols    []string     `json:"protocols"`
+	Zones        []uint16     `json:"zones"`
+}
+
+// Filter decides which flows are tracked. A flow that matches any exclude rule is ignored,
+// and if there are include rules a flow must match at least one of them to be tracked.
+type Filter struct {
+	rules    []*filterRule
+	includes bool
+	// spec are the rules the filter was created from
+	spec []FilterRule
+}
+
+type portRange struct {
+	from, to uint16
+}
+
+type filterRule struct {
+	// hits is updated atomically and is first to guarantee 64-bit alignment
+	hits uint64
+
+	name         string
+	action       FilterAction
+	sources      []*net.IPNet
+	destinations []*net.IPNet
+	ports        []portRange
+	protocols    []uint8
+	zones        []uint16
+}
+
+// NewFilter validates the rules and returns a filter. Rules without a name are named after
+// their action and position, and every name must be unique since it labels the hits of the
+// rule.
+func NewFilter(rules []FilterRule) (*Filter, error) {
+	f := &Filter{spec: append([]FilterRule(nil), rules...)}
+	names := make(map[string]struct{}, len(rules))
+	for i, rule := range rules {
+		r := &filterRule{name: rule.Name, action: rule.Action, zones: rule.Zones}
+		if len(r.name) == 0 {
+			r.name = fmt.Sprintf("%s-%d", rule.Action, i)
+		}
+		if _, ok := names[r.name]; ok {
+			return nil, fmt.Errorf("filter %s: name is used by another filter", r.name)
+		}
+		names[r.name] = struct{}{}
+		switch r.action {
+		case FilterInclude:
+			f.includes = true
+		case FilterExclude:
+		default:
+			return nil, fmt.Errorf("filter %s: action must be %q or %q", r.name, FilterInclude, FilterExclude)
+		}
+		var err error
+		if r.sources, err = parseCIDRs(rule.Sources); err != nil {
+			return nil, fmt.Errorf("filter %s: %v", r.name, err)
+		}
+		if r.destinations, err = parseCIDRs(rule.Destinations); err != nil {
+			return nil, fmt.Errorf("filter %s: %v", r.name, err)
+		}
+		for _, s := range rule.Ports {
+			p, err := parsePortRange(s)
+			if err != nil {
+				return nil, fmt.Errorf("filter %s: %v", r.name, err)
+			}
+			r.ports = append(r.ports, p)
+		}
+		for _, s := range rule.Protocols {
+			protocol, err := ParseProtocol(s)
+			if err != nil {
+				return nil, fmt.Errorf("filter %s: %v", r.name, err)
+			}
+			r.protocols = append(r.protocols, protocol)
+		}
+		f.rules = append(f.rules, r)
+	}
+	return f, nil
+}
+
+func parseCIDRs(values []string) ([]*net.IPNet, error) {
+	var cidrs []*net.IPNet
+	for _, s := range values {
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address %q", s)
+			}
+			bits := 8 * len(normalizeIP(ip))
+			cidrs = append(cidrs, &net.IPNet{IP: normalizeIP(ip), Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, cidr, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		cidrs = append(cidrs, cidr)
+	}
+	return cidrs, nil
+}
+
+func parsePortRange(s string) (portRange, error) {
+	parts := strings.SplitN(s, "-", 2)
+	from, err := strconv.ParseUint(parts[0], 10, 16)
+	if err != nil {
+		return portRange{}, fmt.Errorf("invalid port %q", s)
+	}
+	to := from
+	if len(parts) == 2 {
+		if to, err = strconv.ParseUint(parts[1], 10, 16); err != nil || to < from {
+			return portRange{}, fmt.Errorf("invalid port range %q", s)
+		}
+	}
+	return portRange{from: uint16(from), to: uint16(to)}, nil
+}
+
+// Allow returns true if the flow should be tracked. A nil filter allows every flow.
+func (f *Filter) Allow(e *FlowEvent) bool {
+	if f == nil {
+		return true
+	}
+	included := !f.includes
+	for _, r := range f.rules {
+		if (included && r.action == FilterInclude) || !r.matches(e) {
+			continue
+		}
+		atomic.AddUint64(&r.hits, 1)
+		if r.action == FilterExclude {
+			return false
+		}
+		included = true
+	}
+	return included
+}
+
+func (r *filterRule) matches(e *FlowEvent) bool {
+	if len(r.protocols) > 0 && !containsProtocol(r.protocols, e.Protocol) {
+		return false
+	}
+	if len(r.ports) > 0 && !containsPort(r.ports, e.DestinationPort) {
+		return false
+	}
+	if len(r.zones) > 0 && !containsZone(r.zones, e.Zone) {
+		return false
+	}
+	if len(r.sources) > 0 && !containsIP(r.sources, e.Source) {
+		return false
+	}
+	if len(r.destinations) > 0 && !containsIP(r.destinations, e.Destination) {
+		return false
+	}
+	return true
+}
+
+func containsProtocol(protocols []uint8, protocol uint8) bool {
+	for _, p := range protocols {
+		if p == protocol {
+			return true
+		}
+	}
+	return false
+}
+
+func containsPort(ports []portRange, port uint16) bool {
+	for _, p := range ports {
+		if port >= p.from && port <= p.to {
+			return true
+		}
+	}
+	return false
+}
+
+func containsZone(zones []uint16, zone uint16) bool {
+	for _, z := range zones {
+		if z == zone {
+			return true
+		}
+	}
+	return false
+}
+
+func containsIP(cidrs []*net.IPNet, ip net.IP) bool {
+	for _, cidr := range cidrs {
+		if cidr.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// FilterRuleHits is the number of flows that matched a filter rule.
+type FilterRuleHits struct {
+	Name   string
+	Action FilterAction
+	Hits   uint64
+}
+
+// Hits returns the number of flows each rule has matched, in rule order.
+func (f *Filter) Hits() []FilterRuleHits {
+	if f == nil {
+		return nil
+	}
+	hits := make([]FilterRuleHits, 0, len(f.rules))
+	for _, r := range f.rules {
+		hits = append(hits, FilterRuleHits{Name: r.name, Action: r.action, Hits: atomic.LoadUint64(&r.hits)})
+	}
+	return hits
+}
+
+// Equal returns true if both filters were created from the same rules.
+func (f *Filter) Equal(other *Filter) bool {
+	if f == nil || other == nil {
+		return f == other
+	}
+	return reflect.DeepEqual(f.spec, other.spec)
+}
@@ -0,0 +1,218 @@
+package conntrack
+
+import (
+	"net"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestFilterAllow(t *testing.T) {
+	flow := func(src, dst string, protocol uint8, port, zone uint16) *FlowEvent {
+		return &FlowEvent{Source: net.ParseIP(src), Destination: net.ParseIP(dst), Protocol: protocol, DestinationPort: port, Zone: zone}
+	}
+	tcp, sctp := uint8(unix.IPPROTO_TCP), uint8(unix.IPPROTO_SCTP)
+
+	tests := []struct {
+		name    string
+		rules   []FilterRule
+		flow    *FlowEvent
+		allowed bool
+	}{
+		{
+			name:    "no rules",
+			flow:    flow("10.0.0.1", "10.1.0.1", tcp, 80, 0),
+			allowed: true,
+		},
+		{
+			name:  "exclude by destination address",
+			rules: []FilterRule{{Action: FilterExclude, Destinations: []string{"10.1.0.1"}}},
+			flow:  flow("10.0.0.1", "10.1.0.1", tcp, 80, 0),
+		},
+		{
+			name:    "exclude by destination address does not match other addresses",
+			rules:   []FilterRule{{Action: FilterExclude, Destinations: []string{"10.1.0.1"}}},
+			flow:    flow("10.0.0.1", "10.1.0.2", tcp, 80, 0),
+			allowed: true,
+		},
+		{
+			name:  "exclude by source CIDR",
+			rules: []FilterRule{{Action: FilterExclude, Sources: []string{"10.0.0.0/24"}}},
+			flow:  flow("10.0.0.200", "10.1.0.1", tcp, 80, 0),
+		},
+		{
+			name:  "exclude by IPv6 CIDR",
+			rules: []FilterRule{{Action: FilterExclude, Destinations: []string{"fd00::/8"}}},
+			flow:  flow("fd00::1", "fd00::2", tcp, 80, 0),
+		},
+		{
+			name:    "IPv4 CIDR does not match IPv6 addresses",
+			rules:   []FilterRule{{Action: FilterExclude, Destinations: []string{"0.0.0.0/0"}}},
+			flow:    flow("fd00::1", "fd00::2", tcp, 80, 0),
+			allowed: true,
+		},
+		{
+			name:  "exclude by port range",
+			rules: []FilterRule{{Action: FilterExclude, Ports: []string{"22", "8000-8080"}}},
+			flow:  flow("10.0.0.1", "10.1.0.1", tcp, 8080, 0),
+		},
+		{
+			name:    "port range is inclusive only",
+			rules:   []FilterRule{{Action: FilterExclude, Ports: []string{"22", "8000-8080"}}},
+			flow:    flow("10.0.0.1", "10.1.0.1", tcp, 8081, 0),
+			allowed: true,
+		},
+		{
+			name:  "exclude by protocol",
+			rules: []FilterRule{{Action: FilterExclude, Protocols: []string{"sctp"}}},
+			flow:  flow("10.0.0.1", "10.1.0.1", sctp, 80, 0),
+		},
+		{
+			name:  "exclude by zone",
+			rules: []FilterRule{{Action: FilterExclude, Zones: []uint16{1, 2}}},
+			flow:  flow("10.0.0.1", "10.1.0.1", tcp, 80, 2),
+		},
+		{
+			name:    "every field of a rule must match",
+			rules:   []FilterRule{{Action: FilterExclude, Destinations: []string{"10.1.0.0/16"}, Ports: []string{"443"}}},
+			flow:    flow("10.0.0.1", "10.1.0.1", tcp, 80, 0),
+			allowed: true,
+		},
+		{
+			name:    "include rules allow matching flows",
+			rules:   []FilterRule{{Action: FilterInclude, Destinations: []string{"10.1.0.0/16"}}},
+			flow:    flow("10.0.0.1", "10.1.0.1", tcp, 80, 0),
+			allowed: true,
+		},
+		{
+			name:  "include rules ignore other flows",
+			rules: []FilterRule{{Action: FilterInclude, Destinations: []string{"10.1.0.0/16"}}},
+			flow:  flow("10.0.0.1", "10.2.0.1", tcp, 80, 0),
+		},
+		{
+			name:    "any include rule may match",
+			rules:   []FilterRule{{Action: FilterInclude, Ports: []string{"443"}}, {Action: FilterInclude, Ports: []string{"80"}}},
+			flow:    flow("10.0.0.1", "10.2.0.1", tcp, 80, 0),
+			allowed: true,
+		},
+		{
+			name: "exclude rules win over include rules in any order",
+			rules: []FilterRule{
+				{Action: FilterInclude, Destinations: []string{"10.1.0.0/16"}},
+				{Action: FilterExclude, Ports: []string{"22"}},
+			},
+			flow: flow("10.0.0.1", "10.1.0.1", tcp, 22, 0),
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			f, err := NewFilter(test.rules)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if allowed := f.Allow(test.flow); allowed != test.allowed {
+				t.Fatalf("expected allowed %t, got %t", test.allowed, allowed)
+			}
+		})
+	}
+
+	var f *Filter
+	if !f.Allow(flow("10.0.0.1", "10.1.0.1", tcp, 80, 0)) {
+		t.Fatal("expected a nil filter to allow every flow")
+	}
+}
+
+func TestFilterHits(t *testing.T) {
+	f, err := NewFilter([]FilterRule{
+		{Name: "web", Action: FilterInclude, Ports: []string{"80", "443"}},
+		{Action: FilterInclude, Ports: []string{"443"}},
+		{Action: FilterExclude, Destinations: []string{"10.1.0.1"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range []*FlowEvent{
+		{Destination: net.ParseIP("10.1.0.2"), DestinationPort: 80},
+		// once included, later include rules are not evaluated
+		{Destination: net.ParseIP("10.1.0.2"), DestinationPort: 443},
+		{Destination: net.ParseIP("10.1.0.1"), DestinationPort: 443},
+		{Destination: net.ParseIP("10.1.0.2"), DestinationPort: 22},
+	} {
+		f.Allow(e)
+	}
+	expected := []FilterRuleHits{
+		{Name: "web", Action: FilterInclude, Hits: 3},
+		{Name: "include-1", Action: FilterInclude, Hits: 0},
+		{Name: "exclude-2", Action: FilterExclude, Hits: 1},
+	}
+	hits := f.Hits()
+	if len(hits) != len(expected) {
+		t.Fatalf("unexpected hits %v", hits)
+	}
+	for i := range expected {
+		if hits[i] != expected[i] {
+			t.Errorf("expected %v, got %v", expected[i], hits[i])
+		}
+	}
+}
+
+func TestNewFilterInvalid(t *testing.T) {
+	tests := []struct {
+		name  string
+		rules []FilterRule
+	}{
+		{name: "unknown action", rules: []FilterRule{{Action: "drop"}}},
+		{name: "invalid source", rules: []FilterRule{{Action: FilterExclude, Sources: []string{"10.0.0.300"}}}},
+		{name: "invalid destination", rules: []FilterRule{{Action: FilterExclude, Destinations: []string{"10.0.0.0/33"}}}},
+		{name: "named port", rules: []FilterRule{{Action: FilterExclude, Ports: []string{"http"}}}},
+		{name: "reversed port range", rules: []FilterRule{{Action: FilterExclude, Ports: []string{"8080-8000"}}}},
+		{name: "port out of range", rules: []FilterRule{{Action: FilterExclude, Ports: []string{"65536"}}}},
+		{name: "unknown protocol", rules: []FilterRule{{Action: FilterExclude, Protocols: []string{"quic"}}}},
+		{
+			name:  "duplicate names",
+			rules: []FilterRule{{Name: "web", Action: FilterInclude}, {Name: "web", Action: FilterExclude}},
+		},
+		{
+			name:  "name of a later rule collides with a generated name",
+			rules: []FilterRule{{Action: FilterInclude}, {Name: "include-0", Action: FilterInclude}},
+		},
+		{
+			name:  "generated name collides with the name of an earlier rule",
+			rules: []FilterRule{{Name: "exclude-1", Action: FilterInclude}, {Action: FilterExclude}},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := NewFilter(test.rules); err == nil {
+				t.Fatalf("expected an error for %#v", test.rules)
+			}
+		})
+	}
+}
+
+func TestReconfigureFilter(t *testing.T) {
+	rules := []FilterRule{{Name: "web", Action: FilterInclude, Ports: []string{"80"}}}
+	newFilter := func(rules []FilterRule) *Filter {
+		f, err := NewFilter(rules)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return f
+	}
+	tracker := New(Arguments{Filter: newFilter(rules)})
+	tracker.args.Filter.Allow(&FlowEvent{DestinationPort: 80})
+
+	// reloading the same rules keeps counting the hits of the current filter
+	tracker.Reconfigure(Arguments{Filter: newFilter(rules)})
+	if hits := tracker.args.Filter.Hits(); len(hits) != 1 || hits[0].Hits != 1 {
+		t.Fatalf("expected the hits to be kept: %v", hits)
+	}
+	tracker.Reconfigure(Arguments{Filter: newFilter([]FilterRule{{Name: "web", Action: FilterInclude, Ports: []string{"443"}}})})
+	if hits := tracker.args.Filter.Hits(); len(hits) != 1 || hits[0].Hits != 0 {
+		t.Fatalf("expected changed rules to start counting again: %v", hits)
+	}
+	tracker.Reconfigure(Arguments{})
+	if tracker.args.Filter != nil {
+		t.Fatal("expected the filter to be removed")
+	}
+}
@@ -0,0 +1,62 @@
+package conntrack
+
+import (
+	"net"
+	"time"
+)
+
+// reportedDown returns the destinations currently reported as down. It must be invoked with
+// the lock held.
+func (t *ConnectionTracker) reportedDown() map[string]struct{} {
+	down := make(map[string]struct{}, len(t.down))
+	for dst, state := range t.down {
+		if !state.Up {
+			down[dst] = struct{}{}
+		}
+	}
+	return down
+}
+
+// recordTransitions remembers when destinations started or stopped being reported as down,
+// given the destinations reported before a flush, and forgets transitions older than the
+// flap window. It must be invoked with the lock held.
+func (t *ConnectionTracker) recordTransitions(before map[string]struct{}, now time.Time) {
+	after := t.reportedDown()
+	for dst := range before {
+		if _, ok := after[dst]; !ok {
+			t.transition(dst, now)
+		}
+	}
+	for dst := range after {
+		if _, ok := before[dst]; !ok {
+			t.transition(dst, now)
+		}
+	}
+
+	for dst, times := range t.transitions {
+		i := 0
+		for i < len(times) && now.Sub(times[i]) > t.args.FlapWindow {
+			i++
+		}
+		if i == len(times) {
+			delete(t.transitions, dst)
+			continue
+		}
+		if i > 0 {
+			t.transitions[dst] = append(times[:0], times[i:]...)
+		}
+	}
+}
+
+// transition records a change of the reported state of dst.
+func (t *ConnectionTracker) transition(dst string, now time.Time) {
+	times, ok := t.transitions[dst]
+	if !ok && len(t.transitions) >= t.args.MaxAddresses {
+		return
+	}
+	times = append(times, now)
+	t.transitions[dst] = times
+	if len(times) == t.args.FlapThreshold+1 {
+		trackerLog.Info("Destination is flapping", "ip", net.IP(dst), "transitions", len(times), "window", t.args.FlapWindow)
+	}
+}
@@ -0,0 +1,81 @@
+package conntrack
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// collect returns the values of the metrics the tracker reports for desc by their first
+// label value.
+func collect(t *testing.T, tracker *ConnectionTracker, desc *prometheus.Desc) map[string]float64 {
+	ch := make(chan prometheus.Metric)
+	go func() {
+		tracker.Collect(ch)
+		close(ch)
+	}()
+	values := make(map[string]float64)
+	for metric := range ch {
+		if metric.Desc() != desc {
+			continue
+		}
+		var m dto.Metric
+		if err := metric.Write(&m); err != nil {
+			t.Fatal(err)
+		}
+		values[m.GetLabel()[0].GetValue()] = m.GetGauge().GetValue()
+	}
+	return values
+}
+
+func TestFlapping(t *testing.T) {
+	tracker := New(Arguments{FlapWindow: time.Minute, FlapThreshold: 2, MaxAddresses: 2})
+	a, b, c := string(net.ParseIP("10.1.0.1")), string(net.ParseIP("10.1.0.2")), string(net.ParseIP("10.1.0.3"))
+	start := time.Unix(1600000000, 0)
+	flush := func(after time.Duration, down ...string) {
+		before := tracker.reportedDown()
+		for dst := range tracker.down {
+			delete(tracker.down, dst)
+		}
+		for _, dst := range down {
+			tracker.down[dst] = DestinationState{}
+		}
+		tracker.recordTransitions(before, start.Add(after))
+	}
+
+	flush(0, a, b)
+	flush(10*time.Second, a)
+	flush(20*time.Second, a, b)
+	// destinations beyond the maximum are not tracked
+	flush(30*time.Second, a, b, c)
+	if len(tracker.transitions[a]) != 1 || len(tracker.transitions[b]) != 3 || len(tracker.transitions[c]) != 0 {
+		t.Fatalf("unexpected transitions %v", tracker.transitions)
+	}
+	// destinations that are tracked but up are not reported as down
+	flush(40*time.Second, a, b)
+	tracker.down[c] = DestinationState{Up: true}
+	if down := tracker.reportedDown(); len(down) != 2 {
+		t.Fatalf("unexpected down destinations %v", down)
+	}
+
+	// only destinations with more transitions than the threshold are flapping
+	if flapping := collect(t, tracker, descTargetFlapping); len(flapping) != 1 || flapping["10.1.0.2"] != 3 {
+		t.Fatalf("unexpected flapping destinations %v", flapping)
+	}
+
+	// transitions older than the window are forgotten
+	flush(65*time.Second, a, b)
+	if len(tracker.transitions[a]) != 0 || len(tracker.transitions[b]) != 2 {
+		t.Fatalf("unexpected transitions %v", tracker.transitions)
+	}
+	if flapping := collect(t, tracker, descTargetFlapping); len(flapping) != 0 {
+		t.Fatalf("unexpected flapping destinations %v", flapping)
+	}
+	flush(2*time.Minute, a, b)
+	if len(tracker.transitions) != 0 {
+		t.Fatalf("expected every transition to expire: %v", tracker.transitions)
+	}
+}
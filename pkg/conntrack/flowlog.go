@@ -0,0 +1,310 @@
+package conntrack
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// FlowLogOptions configure a FlowLog.
+type FlowLogOptions struct {
+	// Path is the file failures are appended to, or "-" for standard output.
+	Path string `json:"path"`
+	// MaxSizeBytes rotates the file once it would grow beyond this size. Zero disables
+	// rotation.
+	MaxSizeBytes int64 `json:"maxSizeBytes"`
+	// MaxBackups is the number of rotated files to keep, named PATH.1 through PATH.N.
+	MaxBackups int `json:"maxBackups"`
+	// RateLimit is the average number of records written per second, with bursts of up to
+	// Burst records. Zero disables rate limiting.
+	RateLimit float64 `json:"rateLimit"`
+	Burst     int     `json:"burst"`
+	// SampleEvery writes only one of every SampleEvery failures. Zero or one writes all.
+	SampleEvery int `json:"sampleEvery"`
+}
+
+// FlowLog is an Observer that writes every failure as a JSON line to a file or standard
+// output. Records are written from a separate goroutine and dropped if the writer falls
+// behind, so Observe never blocks the listener.
+type FlowLog struct {
+	// seen is updated atomically and is first to guarantee 64-bit alignment
+	seen uint64
+
+	opts    FlowLogOptions
+	records chan Event
+	stop    chan struct{}
+	done    chan struct{}
+	limiter *tokenBucket
+
+	lock sync.Mutex
+	file *os.File
+	w    *bufio.Writer
+	size int64
+	// rotateAfter delays the next rotation after one failed
+	rotateAfter time.Time
+}
+
+// rotateRetryInterval is how long records are appended to the current file after a
+// rotation fails before it is attempted again.
+const rotateRetryInterval = time.Minute
+
+// NewFlowLog opens the destination of the log and begins writing records. Close must be
+// invoked to flush the log.
+func NewFlowLog(opts FlowLogOptions) (*FlowLog, error) {
+	if len(opts.Path) == 0 {
+		return nil, fmt.Errorf("a flow log path is required, use - for standard output")
+	}
+	if opts.MaxSizeBytes < 0 || opts.MaxBackups < 0 || opts.RateLimit < 0 || opts.Burst < 0 || opts.SampleEvery < 0 {
+		return nil, fmt.Errorf("flow log limits may not be negative")
+	}
+	l := &FlowLog{
+		opts:    opts,
+		records: make(chan Event, 1024),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	if opts.RateLimit > 0 {
+		burst := opts.Burst
+		if burst == 0 {
+			burst = int(opts.RateLimit) + 1
+		}
+		l.limiter = newTokenBucket(opts.RateLimit, burst)
+	}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	go l.run()
+	return l, nil
+}
+
+// Observe queues failures to be written, applying sampling and rate limiting.
+func (l *FlowLog) Observe(e Event) {
+	if e.Type != EventFailure {
+		return
+	}
+	if n := atomic.AddUint64(&l.seen, 1); l.opts.SampleEvery > 1 && n%uint64(l.opts.SampleEvery) != 0 {
+		gaugeFlowLogDropped.WithLabelValues("sampled").Inc()
+		return
+	}
+	if l.limiter != nil && !l.limiter.take(e.Time) {
+		gaugeFlowLogDropped.WithLabelValues("rate_limited").Inc()
+		return
+	}
+	select {
+	case l.records <- e:
+	default:
+		gaugeFlowLogDropped.WithLabelValues("queue_full").Inc()
+	}
+}
+
+// Close writes any queued records and closes the log. Records observed after Close are
+// dropped.
+func (l *FlowLog) Close() error {
+	close(l.stop)
+	<-l.done
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.close()
+}
+
+func (l *FlowLog) run() {
+	defer close(l.done)
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	var buf []byte
+	for {
+		select {
+		case e := <-l.records:
+			buf = l.record(buf, e)
+		case <-l.stop:
+			for {
+				select {
+				case e := <-l.records:
+					buf = l.record(buf, e)
+				default:
+					return
+				}
+			}
+		case <-ticker.C:
+			l.lock.Lock()
+			if err := l.flush(); err != nil {
+				sinkLog.Warn("Unable to write flow log", "path", l.opts.Path, "err", err)
+			}
+			l.lock.Unlock()
+		}
+	}
+}
+
+// record writes the event as a JSON line using buf, and returns buf for reuse.
+func (l *FlowLog) record(buf []byte, e Event) []byte {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return buf
+	}
+	buf = append(buf[:0], data...)
+	buf = append(buf, '\n')
+	if err := l.write(buf); err != nil {
+		sinkLog.Warn("Unable to write flow log", "path", l.opts.Path, "err", err)
+		gaugeFlowLogDropped.WithLabelValues("write_error").Inc()
+		return buf
+	}
+	gaugeFlowLogRecords.WithLabelValues().Inc()
+	return buf
+}
+
+func (l *FlowLog) write(record []byte) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.w == nil {
+		// a previous write or rotation failed and the file could not be reopened
+		if err := l.open(); err != nil {
+			return err
+		}
+	}
+	if l.file != nil && l.opts.MaxSizeBytes > 0 && l.size > 0 && l.size+int64(len(record)) > l.opts.MaxSizeBytes && time.Now().After(l.rotateAfter) {
+		if err := l.rotate(); err != nil {
+			if l.w == nil {
+				return err
+			}
+			// keep appending to the current file and retry later
+			sinkLog.Warn("Unable to rotate flow log", "path", l.opts.Path, "err", err, "retry", rotateRetryInterval)
+			l.rotateAfter = time.Now().Add(rotateRetryInterval)
+		}
+	}
+	n, err := l.w.Write(record)
+	l.size += int64(n)
+	if err != nil {
+		l.reset()
+	}
+	return err
+}
+
+// flush writes buffered records, and discards the writer if it fails so that the file is
+// reopened on the next write.
+func (l *FlowLog) flush() error {
+	if l.w == nil {
+		return nil
+	}
+	err := l.w.Flush()
+	if err != nil {
+		l.reset()
+	}
+	return err
+}
+
+// reset closes the file after a failed write, because the buffered writer keeps returning
+// the error. Records still in the buffer are lost.
+func (l *FlowLog) reset() {
+	if l.file != nil {
+		l.file.Close()
+		l.file = nil
+		l.w = nil
+	}
+}
+
+func (l *FlowLog) open() error {
+	if l.opts.Path == "-" {
+		l.w = bufio.NewWriter(os.Stdout)
+		return nil
+	}
+	f, err := os.OpenFile(l.opts.Path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0640)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	l.file, l.w, l.size = f, bufio.NewWriter(f), info.Size()
+	return nil
+}
+
+func (l *FlowLog) close() error {
+	if l.w == nil {
+		return nil
+	}
+	err := l.w.Flush()
+	if l.file == nil {
+		return err
+	}
+	if closeErr := l.file.Close(); err == nil {
+		err = closeErr
+	}
+	l.file, l.w = nil, nil
+	return err
+}
+
+// rotate shifts PATH.N-1 to PATH.N down to PATH to PATH.1 and reopens PATH, or truncates
+// PATH if no backups are kept. PATH is reopened even if the backups could not be shifted,
+// so that records are appended to it until a later rotation succeeds. The writer is nil
+// only if PATH could not be reopened.
+func (l *FlowLog) rotate() error {
+	err := l.close()
+	if err == nil {
+		err = l.shift()
+	}
+	if openErr := l.open(); openErr != nil {
+		return openErr
+	}
+	return err
+}
+
+// shift moves the closed file to its first backup, or truncates it.
+func (l *FlowLog) shift() error {
+	path := l.opts.Path
+	if l.opts.MaxBackups == 0 {
+		if err := os.Truncate(path, 0); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	for i := l.opts.MaxBackups - 1; i > 0; i-- {
+		if err := os.Rename(fmt.Sprintf("%s.%d", path, i), fmt.Sprintf("%s.%d", path, i+1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if err := os.Rename(path, path+".1"); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// tokenBucket allows events at an average rate with bursts up to its capacity.
+type tokenBucket struct {
+	lock     sync.Mutex
+	rate     float64
+	capacity float64
+	tokens   float64
+	last     time.Time
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	return &tokenBucket{rate: rate, capacity: float64(burst), tokens: float64(burst)}
+}
+
+// take returns true if a token was available at now.
+func (b *tokenBucket) take(now time.Time) bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if !b.last.IsZero() {
+		if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+			b.tokens += elapsed * b.rate
+			if b.tokens > b.capacity {
+				b.tokens = b.capacity
+			}
+		}
+	}
+	if now.After(b.last) {
+		b.last = now
+	}
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
@@ -0,0 +1,239 @@
+package conntrack
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// flowLogStart is the time of the first failure written by the flow log tests.
+var flowLogStart = time.Date(2020, 9, 13, 12, 26, 40, 0, time.UTC)
+
+// failureEvent returns a failure to port at the start of the flow log tests plus offset.
+func failureEvent(port uint16, offset time.Duration) Event {
+	return Event{
+		Time:     flowLogStart.Add(offset),
+		Type:     EventFailure,
+		Source:   net.ParseIP("10.0.0.1").To4(),
+		IP:       net.ParseIP("10.1.0.1").To4(),
+		Protocol: 6,
+		Port:     port,
+	}
+}
+
+// readFlowLog returns the ports of the records in path, or nil if it does not exist.
+func readFlowLog(t *testing.T, path string) []uint16 {
+	t.Helper()
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	ports := []uint16{}
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		if len(line) == 0 {
+			continue
+		}
+		var e Event
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			t.Fatalf("invalid record %q: %v", line, err)
+		}
+		ports = append(ports, e.Port)
+	}
+	return ports
+}
+
+func TestFlowLogRotation(t *testing.T) {
+	data, err := json.Marshal(failureEvent(1000, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// every record has the same length, so that each file holds two of them
+	size := int64(len(data)+1) * 2
+
+	tests := []struct {
+		name    string
+		backups int
+		files   map[string][]uint16
+	}{
+		{
+			name:    "backups",
+			backups: 2,
+			files: map[string][]uint16{
+				"flows.log":   {1006},
+				"flows.log.1": {1004, 1005},
+				"flows.log.2": {1002, 1003},
+				"flows.log.3": nil,
+			},
+		},
+		{
+			name: "truncated",
+			files: map[string][]uint16{
+				"flows.log":   {1006},
+				"flows.log.1": nil,
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "flowlog")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			path := filepath.Join(dir, "flows.log")
+
+			l, err := NewFlowLog(FlowLogOptions{Path: path, MaxSizeBytes: size, MaxBackups: test.backups})
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < 7; i++ {
+				// records are written in order, so ports 1000 and 1001 are rotated out
+				l.Observe(failureEvent(uint16(1000+i), time.Duration(i)*time.Second))
+			}
+			if err := l.Close(); err != nil {
+				t.Fatal(err)
+			}
+			for name, ports := range test.files {
+				if got := readFlowLog(t, filepath.Join(dir, name)); fmt.Sprint(got) != fmt.Sprint(ports) {
+					t.Errorf("%s: expected %v, got %v", name, ports, got)
+				}
+			}
+		})
+	}
+}
+
+func TestFlowLogReopen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "flowlog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "flows.log")
+
+	// records are appended to an existing log, whose size counts towards rotation
+	for i := 0; i < 2; i++ {
+		l, err := NewFlowLog(FlowLogOptions{Path: path, MaxSizeBytes: 1 << 20, MaxBackups: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		l.Observe(failureEvent(uint16(1000+i), 0))
+		// only failures are written
+		l.Observe(Event{Type: EventRecovery, Port: 2000})
+		if err := l.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if ports := readFlowLog(t, path); fmt.Sprint(ports) != "[1000 1001]" {
+		t.Fatalf("unexpected records %v", ports)
+	}
+}
+
+func TestFlowLogLimits(t *testing.T) {
+	tests := []struct {
+		name    string
+		opts    FlowLogOptions
+		offsets []time.Duration
+		ports   []uint16
+	}{
+		{
+			name:    "sampled",
+			opts:    FlowLogOptions{SampleEvery: 3},
+			offsets: []time.Duration{0, 0, 0, 0, 0, 0, 0},
+			ports:   []uint16{1002, 1005},
+		},
+		{
+			name:    "rate limited",
+			opts:    FlowLogOptions{RateLimit: 1, Burst: 2},
+			offsets: []time.Duration{0, 0, 0, 500 * time.Millisecond, time.Second, 5 * time.Second, 5 * time.Second, 5 * time.Second},
+			ports:   []uint16{1000, 1001, 1004, 1005, 1006},
+		},
+		{
+			name:    "default burst",
+			opts:    FlowLogOptions{RateLimit: 2},
+			offsets: []time.Duration{0, 0, 0, 0},
+			ports:   []uint16{1000, 1001, 1002},
+		},
+		{
+			name:    "sampled before rate limited",
+			opts:    FlowLogOptions{SampleEvery: 2, RateLimit: 1, Burst: 1},
+			offsets: []time.Duration{0, 0, 0, time.Second, time.Second, time.Second},
+			ports:   []uint16{1001, 1003},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "flowlog")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			test.opts.Path = filepath.Join(dir, "flows.log")
+
+			l, err := NewFlowLog(test.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i, offset := range test.offsets {
+				l.Observe(failureEvent(uint16(1000+i), offset))
+			}
+			if err := l.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if ports := readFlowLog(t, test.opts.Path); fmt.Sprint(ports) != fmt.Sprint(test.ports) {
+				t.Fatalf("expected %v, got %v", test.ports, ports)
+			}
+		})
+	}
+}
+
+func TestTokenBucket(t *testing.T) {
+	b := newTokenBucket(2, 3)
+	tests := []struct {
+		offset time.Duration
+		ok     bool
+	}{
+		// the bucket starts full
+		{0, true},
+		{0, true},
+		{0, true},
+		{0, false},
+		// tokens are added at the rate
+		{250 * time.Millisecond, false},
+		{500 * time.Millisecond, true},
+		{500 * time.Millisecond, false},
+		// an event from the past does not add tokens
+		{0, false},
+		// and the bucket holds at most its capacity
+		{time.Hour, true},
+		{time.Hour, true},
+		{time.Hour, true},
+		{time.Hour, false},
+	}
+	for i, test := range tests {
+		if ok := b.take(flowLogStart.Add(test.offset)); ok != test.ok {
+			t.Errorf("%d: expected %t at %s", i, test.ok, test.offset)
+		}
+	}
+}
+
+func TestNewFlowLogInvalid(t *testing.T) {
+	for _, opts := range []FlowLogOptions{
+		{},
+		{Path: "flows.log", MaxSizeBytes: -1},
+		{Path: "flows.log", SampleEvery: -1},
+		{Path: filepath.Join("missing", "directory", "flows.log")},
+	} {
+		if _, err := NewFlowLog(opts); err == nil {
+			t.Errorf("expected an error for %#v", opts)
+		}
+	}
+}
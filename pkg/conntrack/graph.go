@@ -0,0 +1,280 @@
+package conntrack
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Workload names the addresses of a workload, such as the pod CIDR of a namespace or the
+// addresses of a service, given as CIDRs or single addresses.
+type Workload struct {
+	Name      string   `json:"name"`
+	Addresses []string `json:"addresses"`
+}
+
+// DependencyOptions configure the dependency graph.
+type DependencyOptions struct {
+	// Workloads name the sources and destinations of connections. The first workload
+	// containing an address names it, and addresses outside every workload are named by
+	// the address itself.
+	Workloads []Workload
+	// MaxEdges caps the number of edges in the graph. Connections that would add an edge
+	// beyond the cap are not recorded.
+	MaxEdges int
+	// Retention is how long an edge is kept after its last connection.
+	Retention time.Duration
+}
+
+// WithDefaults sets default values for the dependency graph.
+func (o DependencyOptions) WithDefaults() DependencyOptions {
+	if o.MaxEdges == 0 {
+		o.MaxEdges = 4096
+	}
+	if o.Retention == 0 {
+		o.Retention = 24 * time.Hour
+	}
+	return o
+}
+
+// workloadCIDR is a parsed workload address.
+type workloadCIDR struct {
+	name string
+	cidr *net.IPNet
+}
+
+// edgeKey identifies an edge of the dependency graph.
+type edgeKey struct {
+	source      string
+	destination string
+	protocol    uint8
+	port        uint16
+}
+
+// edgeStats are the connections counted on an edge.
+type edgeStats struct {
+	success   uint64
+	failure   uint64
+	firstSeen time.Time
+	lastSeen  time.Time
+}
+
+// dependencyGraph counts the completed and failed connections between workloads.
+type dependencyGraph struct {
+	lock      sync.Mutex
+	workloads []workloadCIDR
+	maxEdges  int
+	retention time.Duration
+	edges     map[edgeKey]*edgeStats
+}
+
+func newDependencyGraph() *dependencyGraph {
+	return &dependencyGraph{edges: make(map[edgeKey]*edgeStats)}
+}
+
+// configure applies opts, which must have been validated by ValidateDependencyOptions.
+// Existing edges are kept.
+func (g *dependencyGraph) configure(opts DependencyOptions) {
+	workloads, _ := parseWorkloads(opts.Workloads)
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	g.workloads = workloads
+	g.maxEdges = opts.MaxEdges
+	g.retention = opts.Retention
+}
+
+// ValidateDependencyOptions returns an error if the workloads of opts are invalid.
+func ValidateDependencyOptions(opts DependencyOptions) error {
+	if opts.MaxEdges < 0 || opts.Retention < 0 {
+		return fmt.Errorf("dependency graph limits may not be negative")
+	}
+	_, err := parseWorkloads(opts.Workloads)
+	return err
+}
+
+func parseWorkloads(workloads []Workload) ([]workloadCIDR, error) {
+	var cidrs []workloadCIDR
+	for i, w := range workloads {
+		if len(w.Name) == 0 {
+			return nil, fmt.Errorf("workload %d: a name is required", i)
+		}
+		parsed, err := parseCIDRs(w.Addresses)
+		if err != nil {
+			return nil, fmt.Errorf("workload %s: %v", w.Name, err)
+		}
+		for _, cidr := range parsed {
+			cidrs = append(cidrs, workloadCIDR{name: w.Name, cidr: cidr})
+		}
+	}
+	return cidrs, nil
+}
+
+// workload returns the name of the workload of ip. It must be invoked with the lock held.
+func (g *dependencyGraph) workload(ip net.IP) string {
+	for _, w := range g.workloads {
+		if w.cidr.Contains(ip) {
+			return w.name
+		}
+	}
+	return ip.String()
+}
+
+// record counts a connection destroyed at now that completed its handshake if success is
+// true, or failed otherwise.
+func (g *dependencyGraph) record(e *FlowEvent, now time.Time, success bool) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	key := edgeKey{
+		source:      g.workload(e.Source),
+		destination: g.workload(e.Destination),
+		protocol:    e.Protocol,
+		port:        e.DestinationPort,
+	}
+	stats, ok := g.edges[key]
+	if !ok {
+		if len(g.edges) >= g.maxEdges {
+			gaugeDependencyEdgesDropped.WithLabelValues().Inc()
+			return
+		}
+		stats = &edgeStats{firstSeen: now}
+		g.edges[key] = stats
+	}
+	if success {
+		stats.success++
+	} else {
+		stats.failure++
+	}
+	stats.lastSeen = now
+}
+
+// expire removes edges without connections within the retention period.
+func (g *dependencyGraph) expire(now time.Time) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	for key, stats := range g.edges {
+		if now.Sub(stats.lastSeen) > g.retention {
+			delete(g.edges, key)
+		}
+	}
+}
+
+// reset removes every edge, such as when the graph is disabled.
+func (g *dependencyGraph) reset() {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	if len(g.edges) > 0 {
+		g.edges = make(map[edgeKey]*edgeStats)
+	}
+}
+
+// Dependency is an edge of the dependency graph, counting the connections from one workload
+// to a port of another.
+type Dependency struct {
+	Source      string    `json:"src"`
+	Destination string    `json:"dst"`
+	Protocol    string    `json:"proto"`
+	Port        uint16    `json:"port"`
+	Success     uint64    `json:"success"`
+	Failure     uint64    `json:"failure"`
+	FirstSeen   time.Time `json:"firstSeen"`
+	LastSeen    time.Time `json:"lastSeen"`
+}
+
+// Dependencies returns the edges of the dependency graph sorted by source, destination,
+// protocol, and port, or nil if the graph is disabled.
+func (t *ConnectionTracker) Dependencies() []Dependency {
+	if t.dependencyOptions() == nil {
+		return nil
+	}
+	t.graph.lock.Lock()
+	deps := make([]Dependency, 0, len(t.graph.edges))
+	for key, stats := range t.graph.edges {
+		deps = append(deps, Dependency{
+			Source:      key.source,
+			Destination: key.destination,
+			Protocol:    ProtocolName(key.protocol),
+			Port:        key.port,
+			Success:     stats.success,
+			Failure:     stats.failure,
+			FirstSeen:   stats.firstSeen,
+			LastSeen:    stats.lastSeen,
+		})
+	}
+	t.graph.lock.Unlock()
+
+	sort.Slice(deps, func(i, j int) bool {
+		a, b := deps[i], deps[j]
+		if a.Source != b.Source {
+			return a.Source < b.Source
+		}
+		if a.Destination != b.Destination {
+			return a.Destination < b.Destination
+		}
+		if a.Protocol != b.Protocol {
+			return a.Protocol < b.Protocol
+		}
+		return a.Port < b.Port
+	})
+	return deps
+}
+
+// dependencyOptions returns the options of the dependency graph, or nil if it is disabled.
+func (t *ConnectionTracker) dependencyOptions() *DependencyOptions {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	return t.args.Dependencies
+}
+
+// DependenciesHandler serves the dependency graph of the tracker as JSON, or in the DOT
+// language of Graphviz if the format query parameter is "dot".
+func DependenciesHandler(t *ConnectionTracker, nodeName string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if t.dependencyOptions() == nil {
+			http.Error(w, "the dependency graph is not enabled", http.StatusNotFound)
+			return
+		}
+		deps := t.Dependencies()
+		switch format := req.URL.Query().Get("format"); format {
+		case "", "json":
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(struct {
+				Node  string       `json:"node,omitempty"`
+				Edges []Dependency `json:"edges"`
+			}{Node: nodeName, Edges: deps})
+		case "dot":
+			w.Header().Set("Content-Type", "text/vnd.graphviz")
+			writeDOT(w, nodeName, deps)
+		default:
+			http.Error(w, fmt.Sprintf("unknown format %q, use json or dot", format), http.StatusBadRequest)
+		}
+	})
+}
+
+// writeDOT writes the graph as a directed graph with an edge per destination port. Edges
+// with failures are drawn in red.
+func writeDOT(w io.Writer, nodeName string, deps []Dependency) {
+	bw := bufio.NewWriter(w)
+	defer bw.Flush()
+	name := "dependencies"
+	if len(nodeName) > 0 {
+		name = nodeName
+	}
+	fmt.Fprintf(bw, "digraph %s {\n", strconv.Quote(name))
+	for _, dep := range deps {
+		label := fmt.Sprintf("%s/%d success=%d failure=%d", dep.Protocol, dep.Port, dep.Success, dep.Failure)
+		attrs := []string{"label=" + strconv.Quote(label)}
+		if dep.Failure > 0 {
+			attrs = append(attrs, "color=red")
+		}
+		fmt.Fprintf(bw, "  %s -> %s [%s];\n", strconv.Quote(dep.Source), strconv.Quote(dep.Destination), strings.Join(attrs, ", "))
+	}
+	fmt.Fprintln(bw, "}")
+}
@@ -0,0 +1,127 @@
+package conntrack
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestDependencyGraph(t *testing.T) {
+	start := time.Unix(1600000000, 0).UTC()
+	tracker := New(Arguments{Dependencies: &DependencyOptions{
+		Workloads: []Workload{
+			{Name: "frontend", Addresses: []string{"10.0.0.0/24"}},
+			{Name: "db", Addresses: []string{"10.1.0.1", "10.1.0.2"}},
+			// addresses are named by the first workload that contains them
+			{Name: "shadowed", Addresses: []string{"10.1.0.0/16"}},
+		},
+		MaxEdges: 3,
+	}})
+	destroy := func(src, dst string, port uint16, status uint32, after time.Duration) {
+		tracker.handle(&FlowEvent{
+			Time:            start.Add(after),
+			Type:            FlowDestroy,
+			Protocol:        unix.IPPROTO_TCP,
+			Source:          net.ParseIP(src),
+			Destination:     net.ParseIP(dst),
+			SourcePort:      40000,
+			DestinationPort: port,
+			Status:          status,
+		})
+	}
+	const completed = statusSeenReply | statusAssured
+
+	destroy("10.0.0.1", "10.1.0.1", 5432, completed, 0)
+	destroy("10.0.0.2", "10.1.0.2", 5432, completed, time.Second)
+	destroy("10.0.0.3", "10.1.0.1", 5432, 0, 2*time.Second)
+	destroy("10.0.0.1", "10.1.1.1", 5432, completed, 3*time.Second)
+	destroy("10.0.0.1", "192.168.0.1", 443, 0, 4*time.Second)
+	// a fourth edge is beyond the maximum and is not recorded
+	destroy("10.0.0.1", "192.168.0.2", 443, 0, 5*time.Second)
+	destroy("10.0.0.1", "10.1.0.1", 5433, completed, 6*time.Second)
+
+	expected := []Dependency{
+		{Source: "frontend", Destination: "192.168.0.1", Protocol: "tcp", Port: 443, Failure: 1, FirstSeen: start.Add(4 * time.Second), LastSeen: start.Add(4 * time.Second)},
+		{Source: "frontend", Destination: "db", Protocol: "tcp", Port: 5432, Success: 2, Failure: 1, FirstSeen: start, LastSeen: start.Add(2 * time.Second)},
+		{Source: "frontend", Destination: "shadowed", Protocol: "tcp", Port: 5432, Success: 1, FirstSeen: start.Add(3 * time.Second), LastSeen: start.Add(3 * time.Second)},
+	}
+	if deps := tracker.Dependencies(); !reflect.DeepEqual(deps, expected) {
+		t.Fatalf("unexpected dependencies:\n%#v\n%#v", deps, expected)
+	}
+
+	// edges without connections within the retention are expired
+	tracker.graph.configure(DependencyOptions{Retention: time.Minute, MaxEdges: 3})
+	tracker.graph.expire(start.Add(time.Minute + 5*time.Second))
+	if deps := tracker.Dependencies(); len(deps) != 0 {
+		t.Fatalf("expected every edge to expire: %#v", deps)
+	}
+	destroy("10.0.0.1", "10.1.0.1", 5432, completed, 90*time.Second)
+	tracker.graph.expire(start.Add(2 * time.Minute))
+	if deps := tracker.Dependencies(); len(deps) != 1 || deps[0].Destination != "10.1.0.1" || deps[0].Success != 1 {
+		t.Fatalf("expected only the recent edge to remain: %#v", deps)
+	}
+
+	tracker.Reconfigure(Arguments{})
+	if deps := tracker.Dependencies(); deps != nil {
+		t.Fatalf("expected a disabled graph to have no dependencies: %#v", deps)
+	}
+	if len(tracker.graph.edges) != 0 {
+		t.Fatal("expected disabling the graph to clear it")
+	}
+}
+
+func TestDependenciesHandler(t *testing.T) {
+	tracker := New(Arguments{Dependencies: &DependencyOptions{
+		Workloads: []Workload{{Name: "frontend", Addresses: []string{"10.0.0.0/24"}}},
+	}})
+	for _, status := range []uint32{statusSeenReply | statusAssured, 0} {
+		tracker.handle(&FlowEvent{
+			Time:            time.Unix(1600000000, 0),
+			Type:            FlowDestroy,
+			Protocol:        unix.IPPROTO_TCP,
+			Source:          net.ParseIP("10.0.0.1"),
+			Destination:     net.ParseIP("10.1.0.1"),
+			DestinationPort: 5432,
+			Status:          status,
+		})
+	}
+	handler := DependenciesHandler(tracker, "node-1")
+	get := func(query string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v1/dependencies"+query, nil))
+		return w
+	}
+
+	w := get("")
+	var graph struct {
+		Node  string       `json:"node"`
+		Edges []Dependency `json:"edges"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &graph); err != nil {
+		t.Fatal(err)
+	}
+	if w.Header().Get("Content-Type") != "application/json" || graph.Node != "node-1" || len(graph.Edges) != 1 || graph.Edges[0].Success != 1 || graph.Edges[0].Failure != 1 {
+		t.Fatalf("unexpected graph: %s", w.Body)
+	}
+
+	w = get("?format=dot")
+	expected := "digraph \"node-1\" {\n  \"frontend\" -> \"10.1.0.1\" [label=\"tcp/5432 success=1 failure=1\", color=red];\n}\n"
+	if w.Body.String() != expected {
+		t.Fatalf("unexpected DOT output:\n%s", w.Body)
+	}
+
+	if w = get("?format=xml"); w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "unknown format") {
+		t.Fatalf("expected an unknown format to be rejected: %d %s", w.Code, w.Body)
+	}
+	tracker.Reconfigure(Arguments{})
+	if w = get(""); w.Code != http.StatusNotFound {
+		t.Fatalf("expected a disabled graph to be not found: %d", w.Code)
+	}
+}
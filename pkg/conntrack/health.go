@@ -0,0 +1,45 @@
+package conntrack
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// LastEvent returns the time the most recent conntrack event was received by Listen, or
+// the zero time if no event has been received.
+func (t *ConnectionTracker) LastEvent() time.Time {
+	nanos := atomic.LoadInt64(&t.lastEvent)
+	if nanos == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, nanos)
+}
+
+// Ready returns an error unless the tracker is subscribed to conntrack events.
+func (t *ConnectionTracker) Ready() error {
+	if atomic.LoadInt32(&t.listening) == 0 {
+		return fmt.Errorf("not listening for conntrack events")
+	}
+	return nil
+}
+
+// Healthy returns an error if the tracker is not subscribed to conntrack events or, when
+// maxIdle is positive, no event has been received within maxIdle of the tracker starting
+// to listen or of the previous event.
+func (t *ConnectionTracker) Healthy(maxIdle time.Duration) error {
+	if err := t.Ready(); err != nil {
+		return err
+	}
+	if maxIdle <= 0 {
+		return nil
+	}
+	last := t.LastEvent()
+	if started := time.Unix(0, atomic.LoadInt64(&t.started)); last.Before(started) {
+		last = started
+	}
+	if idle := time.Since(last); idle > maxIdle {
+		return fmt.Errorf("no conntrack events received in %s", idle.Truncate(time.Second))
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+package conntrack
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHealthy(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name      string
+		listening bool
+		started   time.Time
+		lastEvent time.Time
+		maxIdle   time.Duration
+		ready     bool
+		healthy   bool
+	}{
+		{name: "not listening", started: now, lastEvent: now, maxIdle: time.Minute},
+		{name: "listening without an idle limit", listening: true, started: now.Add(-time.Hour), ready: true, healthy: true},
+		{name: "recent event", listening: true, started: now.Add(-time.Hour), lastEvent: now.Add(-time.Second), maxIdle: time.Minute, ready: true, healthy: true},
+		{name: "idle", listening: true, started: now.Add(-time.Hour), lastEvent: now.Add(-2 * time.Minute), maxIdle: time.Minute, ready: true},
+		{name: "no events yet", listening: true, started: now.Add(-2 * time.Minute), maxIdle: time.Minute, ready: true},
+		{name: "recently started", listening: true, started: now.Add(-time.Second), maxIdle: time.Minute, ready: true, healthy: true},
+		// an event from before the tracker listened again does not make it unhealthy
+		{name: "restarted", listening: true, started: now.Add(-time.Second), lastEvent: now.Add(-time.Hour), maxIdle: time.Minute, ready: true, healthy: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tracker := New(Arguments{})
+			if test.listening {
+				atomic.StoreInt32(&tracker.listening, 1)
+			}
+			atomic.StoreInt64(&tracker.started, test.started.UnixNano())
+			if !test.lastEvent.IsZero() {
+				atomic.StoreInt64(&tracker.lastEvent, test.lastEvent.UnixNano())
+			}
+			if err := tracker.Ready(); (err == nil) != test.ready {
+				t.Errorf("expected ready %t, got %v", test.ready, err)
+			}
+			if err := tracker.Healthy(test.maxIdle); (err == nil) != test.healthy {
+				t.Errorf("expected healthy %t, got %v", test.healthy, err)
+			}
+		})
+	}
+}
+
+func TestLastEvent(t *testing.T) {
+	tracker := New(Arguments{})
+	if !tracker.LastEvent().IsZero() {
+		t.Fatalf("expected no event, got %s", tracker.LastEvent())
+	}
+	now := time.Now()
+	atomic.StoreInt64(&tracker.lastEvent, now.UnixNano())
+	if !tracker.LastEvent().Equal(now) {
+		t.Fatalf("expected %s, got %s", now, tracker.LastEvent())
+	}
+}
@@ -0,0 +1,259 @@
+package conntrack
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+	"golang.org/x/sys/unix"
+)
+
+// Reasons recorded for connections that failed after the destination or a router on the
+// path returned an ICMP destination unreachable error.
+const (
+	ReasonNetUnreachable   = "net-unreachable"
+	ReasonHostUnreachable  = "host-unreachable"
+	ReasonPortUnreachable  = "port-unreachable"
+	ReasonAdminProhibited  = "admin-prohibited"
+	ReasonOtherUnreachable = "unreachable"
+)
+
+const (
+	// maxUnreachable bounds the number of ICMP errors waiting for their connection to be
+	// destroyed.
+	maxUnreachable = 64 * 1024
+	// unreachableTimeout is how long an ICMP error is remembered, longer than conntrack
+	// keeps a connection that never saw a reply.
+	unreachableTimeout = 3 * time.Minute
+)
+
+// unreachableErrors remembers the ICMP errors received for connections until the
+// connection is destroyed.
+type unreachableErrors struct {
+	lock   sync.Mutex
+	errors map[flowKey]unreachableError
+}
+
+type unreachableError struct {
+	reason   string
+	received time.Time
+}
+
+func newUnreachableErrors() *unreachableErrors {
+	return &unreachableErrors{errors: make(map[flowKey]unreachableError)}
+}
+
+func (u *unreachableErrors) add(key flowKey, reason string, now time.Time) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	if _, ok := u.errors[key]; !ok && len(u.errors) >= maxUnreachable {
+		return
+	}
+	u.errors[key] = unreachableError{reason: reason, received: now}
+}
+
+// take returns and forgets the reason of an ICMP error received for the connection. The
+// datagram quoted by an error is the one that left the host, after any address translation,
+// so a translated connection is also looked up by the reverse of its reply tuple.
+func (u *unreachableErrors) take(e *FlowEvent) (string, bool) {
+	keys := []flowKey{newFlowKey(e)}
+	keys[0].zone = 0
+	if e.ReplySource != nil {
+		keys = append(keys, flowKey{
+			source:          string(e.ReplyDestination.To16()),
+			destination:     string(e.ReplySource.To16()),
+			sourcePort:      e.ReplyDestinationPort,
+			destinationPort: e.ReplySourcePort,
+		})
+	}
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	for _, key := range keys {
+		if err, ok := u.errors[key]; ok {
+			delete(u.errors, key)
+			return err.reason, true
+		}
+	}
+	return "", false
+}
+
+func (u *unreachableErrors) expire(now time.Time) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	for key, err := range u.errors {
+		if now.Sub(err.received) > unreachableTimeout {
+			delete(u.errors, key)
+		}
+	}
+}
+
+// ICMPListener receives the ICMP and ICMPv6 destination unreachable errors delivered to
+// this host, so that the tracker can report why a connection failed instead of only that
+// it was never replied to. Conntrack matches these errors to their connection but does not
+// report them as events, so they are read from raw sockets. Only errors delivered to the
+// network namespace of the process are seen. Errors for connections opened by pods are
+// forwarded to the pod's namespace instead, so those failures keep the unreplied reason
+// even when the host network namespace is used.
+type ICMPListener struct {
+	tracker *ConnectionTracker
+	conns   []*icmp.PacketConn
+}
+
+// NewICMPListener opens raw ICMP sockets, which requires CAP_NET_RAW. The sockets remain
+// usable if the capability is dropped afterwards.
+func NewICMPListener(t *ConnectionTracker) (*ICMPListener, error) {
+	l := &ICMPListener{tracker: t}
+	for _, network := range []string{"ip4:icmp", "ip6:ipv6-icmp"} {
+		conn, err := icmp.ListenPacket(network, "")
+		if err != nil {
+			l.close()
+			return nil, fmt.Errorf("unable to receive ICMP errors on %s: %v", network, err)
+		}
+		l.conns = append(l.conns, conn)
+	}
+	return l, nil
+}
+
+func (l *ICMPListener) close() {
+	for _, conn := range l.conns {
+		conn.Close()
+	}
+}
+
+// Run records the errors received until ctx is done, and then closes the sockets.
+func (l *ICMPListener) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for i, conn := range l.conns {
+		proto := 1
+		if i > 0 {
+			proto = 58
+		}
+		wg.Add(1)
+		go func(conn *icmp.PacketConn, proto int) {
+			defer wg.Done()
+			l.read(conn, proto)
+		}(conn, proto)
+	}
+	<-ctx.Done()
+	l.close()
+	wg.Wait()
+}
+
+func (l *ICMPListener) read(conn *icmp.PacketConn, proto int) {
+	buf := make([]byte, 1500)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+			return
+		}
+		msg, err := icmp.ParseMessage(proto, buf[:n])
+		if err != nil {
+			continue
+		}
+		body, ok := msg.Body.(*icmp.DstUnreach)
+		if !ok {
+			continue
+		}
+		var reason string
+		switch msg.Type {
+		case ipv4.ICMPTypeDestinationUnreachable:
+			reason = ipv4UnreachableReason(msg.Code)
+		case ipv6.ICMPTypeDestinationUnreachable:
+			reason = ipv6UnreachableReason(msg.Code)
+		default:
+			continue
+		}
+		key, ok := originalFlow(body.Data)
+		if !ok {
+			continue
+		}
+		gaugeICMPErrors.WithLabelValues(reason).Inc()
+		l.tracker.unreachable.add(key, reason, time.Now())
+	}
+}
+
+// ipv4UnreachableReason maps the codes of ICMP destination unreachable messages.
+func ipv4UnreachableReason(code int) string {
+	switch code {
+	case 0, 6, 11:
+		return ReasonNetUnreachable
+	case 1, 7, 12:
+		return ReasonHostUnreachable
+	case 3:
+		return ReasonPortUnreachable
+	case 9, 10, 13:
+		return ReasonAdminProhibited
+	default:
+		return ReasonOtherUnreachable
+	}
+}
+
+// ipv6UnreachableReason maps the codes of ICMPv6 destination unreachable messages.
+func ipv6UnreachableReason(code int) string {
+	switch code {
+	case 0:
+		return ReasonNetUnreachable
+	case 3:
+		return ReasonHostUnreachable
+	case 4:
+		return ReasonPortUnreachable
+	case 1, 5, 6:
+		return ReasonAdminProhibited
+	default:
+		return ReasonOtherUnreachable
+	}
+}
+
+// originalFlow decodes the TCP connection or SCTP association of the datagram quoted by an
+// ICMP error, which holds the IP header and at least the first 8 bytes of the TCP or SCTP
+// header. Both headers start with the source and destination ports.
+func originalFlow(data []byte) (flowKey, bool) {
+	if len(data) < 1 {
+		return flowKey{}, false
+	}
+	var src, dst net.IP
+	var ports []byte
+	switch data[0] >> 4 {
+	case 4:
+		headerLen := int(data[0]&0x0f) * 4
+		if headerLen < ipv4.HeaderLen || len(data) < headerLen+4 || !trackedProtocol(data[9]) {
+			return flowKey{}, false
+		}
+		src, dst = net.IP(data[12:16]), net.IP(data[16:20])
+		ports = data[headerLen:]
+	case 6:
+		// extension headers are not followed
+		if len(data) < ipv6.HeaderLen+4 || !trackedProtocol(data[6]) {
+			return flowKey{}, false
+		}
+		src, dst = net.IP(data[8:24]), net.IP(data[24:40])
+		ports = data[ipv6.HeaderLen:]
+	default:
+		return flowKey{}, false
+	}
+	return flowKey{
+		source:          string(src.To16()),
+		destination:     string(dst.To16()),
+		sourcePort:      binary.BigEndian.Uint16(ports[0:2]),
+		destinationPort: binary.BigEndian.Uint16(ports[2:4]),
+	}, true
+}
+
+func trackedProtocol(protocol uint8) bool {
+	return protocol == unix.IPPROTO_TCP || protocol == unix.IPPROTO_SCTP
+}
+
+// Unreachable returns the counts of connections that failed after an ICMP destination
+// unreachable error, per destination and reason.
+func (t *ConnectionTracker) Unreachable() []ReasonCount {
+	return t.unreachableCounts.snapshot()
+}
@@ -0,0 +1,115 @@
+package conntrack
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// quotedIPv4 returns an IPv4 header with headerLen bytes followed by the first 8 bytes of a
+// TCP or SCTP header from 10.0.0.1:40000 to 10.1.0.1:80.
+func quotedIPv4(protocol uint8, headerLen int) []byte {
+	b := make([]byte, headerLen+8)
+	b[0] = 0x40 | byte(headerLen/4)
+	b[9] = protocol
+	copy(b[12:16], net.ParseIP("10.0.0.1").To4())
+	copy(b[16:20], net.ParseIP("10.1.0.1").To4())
+	copy(b[headerLen:], []byte{0x9c, 0x40, 0x00, 0x50})
+	return b
+}
+
+// quotedIPv6 returns an IPv6 header followed by the first 8 bytes of a TCP or SCTP header
+// from [fd00::1]:40000 to [fd00::10]:443.
+func quotedIPv6(nextHeader uint8) []byte {
+	b := make([]byte, 40+8)
+	b[0] = 0x60
+	b[6] = nextHeader
+	copy(b[8:24], net.ParseIP("fd00::1"))
+	copy(b[24:40], net.ParseIP("fd00::10"))
+	copy(b[40:], []byte{0x9c, 0x40, 0x01, 0xbb})
+	return b
+}
+
+func TestOriginalFlow(t *testing.T) {
+	v4 := flowKey{source: string(net.ParseIP("10.0.0.1")), destination: string(net.ParseIP("10.1.0.1")), sourcePort: 40000, destinationPort: 80}
+	v6 := flowKey{source: string(net.ParseIP("fd00::1")), destination: string(net.ParseIP("fd00::10")), sourcePort: 40000, destinationPort: 443}
+
+	tests := []struct {
+		name string
+		data []byte
+		key  flowKey
+		ok   bool
+	}{
+		{name: "empty"},
+		{name: "IPv4 TCP", data: quotedIPv4(unix.IPPROTO_TCP, 20), key: v4, ok: true},
+		{name: "IPv4 SCTP", data: quotedIPv4(unix.IPPROTO_SCTP, 20), key: v4, ok: true},
+		{name: "IPv4 with options", data: quotedIPv4(unix.IPPROTO_TCP, 28), key: v4, ok: true},
+		{name: "IPv4 with only the ports", data: quotedIPv4(unix.IPPROTO_TCP, 20)[:24], key: v4, ok: true},
+		{name: "IPv4 UDP", data: quotedIPv4(unix.IPPROTO_UDP, 20)},
+		{name: "IPv4 truncated ports", data: quotedIPv4(unix.IPPROTO_TCP, 20)[:23]},
+		{name: "IPv4 truncated options", data: quotedIPv4(unix.IPPROTO_TCP, 28)[:28]},
+		{name: "IPv4 truncated header", data: quotedIPv4(unix.IPPROTO_TCP, 20)[:10]},
+		{name: "IPv4 invalid header length", data: append([]byte{0x44}, quotedIPv4(unix.IPPROTO_TCP, 20)[1:]...)},
+		{name: "IPv6 TCP", data: quotedIPv6(unix.IPPROTO_TCP), key: v6, ok: true},
+		{name: "IPv6 SCTP", data: quotedIPv6(unix.IPPROTO_SCTP), key: v6, ok: true},
+		{name: "IPv6 extension header", data: quotedIPv6(unix.IPPROTO_FRAGMENT)},
+		{name: "IPv6 truncated ports", data: quotedIPv6(unix.IPPROTO_TCP)[:43]},
+		{name: "IPv6 truncated header", data: quotedIPv6(unix.IPPROTO_TCP)[:20]},
+		{name: "unknown version", data: append([]byte{0x50}, quotedIPv4(unix.IPPROTO_TCP, 20)[1:]...)},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			key, ok := originalFlow(test.data)
+			if ok != test.ok || key != test.key {
+				t.Fatalf("expected %#v %t, got %#v %t", test.key, test.ok, key, ok)
+			}
+		})
+	}
+}
+
+func TestUnreachableTake(t *testing.T) {
+	client, service := net.ParseIP("10.0.0.1").To4(), net.ParseIP("172.30.0.10").To4()
+	endpoint, node := net.ParseIP("10.1.0.1").To4(), net.ParseIP("192.168.0.2").To4()
+	// a connection to a service translated to one of its endpoints and masqueraded
+	translated := &FlowEvent{
+		Protocol: unix.IPPROTO_TCP, Source: client, Destination: service, SourcePort: 40000, DestinationPort: 80, Zone: 1,
+		ReplySource: endpoint, ReplyDestination: node, ReplySourcePort: 8080, ReplyDestinationPort: 50000,
+	}
+	untranslated := &FlowEvent{
+		Protocol: unix.IPPROTO_TCP, Source: client, Destination: endpoint, SourcePort: 40001, DestinationPort: 8080,
+		ReplySource: endpoint, ReplyDestination: client, ReplySourcePort: 8080, ReplyDestinationPort: 40001,
+	}
+	key := func(src, dst net.IP, srcPort, dstPort uint16) flowKey {
+		return flowKey{source: string(src.To16()), destination: string(dst.To16()), sourcePort: srcPort, destinationPort: dstPort}
+	}
+
+	tests := []struct {
+		name string
+		key  flowKey
+		e    *FlowEvent
+		ok   bool
+	}{
+		{name: "original tuple", key: key(client, service, 40000, 80), e: translated, ok: true},
+		{name: "translated tuple", key: key(node, endpoint, 50000, 8080), e: translated, ok: true},
+		{name: "untranslated", key: key(client, endpoint, 40001, 8080), e: untranslated, ok: true},
+		{name: "other connection", key: key(node, endpoint, 50001, 8080), e: translated},
+		{name: "reply tuple not reversed", key: key(endpoint, node, 8080, 50000), e: translated},
+		{name: "without reply tuple", key: key(node, endpoint, 50000, 8080), e: &FlowEvent{Protocol: unix.IPPROTO_TCP, Source: client, Destination: service, SourcePort: 40000, DestinationPort: 80}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			u := newUnreachableErrors()
+			u.add(test.key, ReasonHostUnreachable, time.Now())
+			reason, ok := u.take(test.e)
+			if ok != test.ok || (ok && reason != ReasonHostUnreachable) {
+				t.Fatalf("expected %t, got %q %t", test.ok, reason, ok)
+			}
+			// an error is only reported once
+			if _, ok := u.take(test.e); ok {
+				t.Fatal("expected the error to be forgotten")
+			}
+		})
+	}
+}
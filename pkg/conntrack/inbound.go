@@ -0,0 +1,67 @@
+package conntrack
+
+import (
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+// maxInboundPorts bounds the number of local ports counted separately. Incomplete
+// connections to further ports are counted together, so that a scan of the node cannot
+// create unbounded series.
+const maxInboundPorts = 1024
+
+// statusAssured is the IPS_ASSURED bit of the conntrack status, set once a TCP connection
+// completes its handshake or an SCTP association is established.
+const statusAssured = 1 << 2
+
+// Assured returns true if the connection completed its handshake.
+func (e *FlowEvent) Assured() bool {
+	return e.Status&statusAssured != 0
+}
+
+// Replied returns true if the destination answered the connection. A TCP connection is
+// answered by any reply, while an SCTP association must reach ESTABLISHED, which conntrack
+// marks as assured, because an INIT may be answered with an INIT ACK and then aborted.
+func (e *FlowEvent) Replied() bool {
+	if e.Protocol == unix.IPPROTO_SCTP {
+		return e.Assured()
+	}
+	return e.SeenReply()
+}
+
+// refreshLocalAddresses reads the addresses of the network interfaces, which are the
+// destinations of inbound connections.
+func (t *ConnectionTracker) refreshLocalAddresses() {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		trackerLog.Warn("Unable to read local addresses", "err", err)
+		return
+	}
+	local := make(map[string]struct{}, len(addrs))
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok {
+			local[string(ipnet.IP.To16())] = struct{}{}
+		}
+	}
+	t.local.Store(local)
+}
+
+// isLocal returns true if ip is the address of a local network interface.
+func (t *ConnectionTracker) isLocal(ip net.IP) bool {
+	local, _ := t.local.Load().(map[string]struct{})
+	_, ok := local[string(ip.To16())]
+	return ok
+}
+
+// inboundIncomplete counts a connection to a local port that was destroyed before
+// completing its handshake, such as a half-open connection left by a SYN flood.
+func (t *ConnectionTracker) inboundIncomplete(protocol uint8, port uint16) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	key := DestinationKey{Protocol: protocol, Port: port}
+	if _, ok := t.inbound[key]; !ok && len(t.inbound) >= maxInboundPorts {
+		key.Port = 0
+	}
+	t.inbound[key]++
+}
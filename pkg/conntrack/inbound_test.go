@@ -0,0 +1,88 @@
+package conntrack
+
+import (
+	"net"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestInboundIncomplete(t *testing.T) {
+	local := net.ParseIP("192.168.0.1").To4()
+	remote := net.ParseIP("10.1.0.1").To4()
+	connection := func(protocol uint8, dst net.IP, port uint16, status uint32) *FlowEvent {
+		return &FlowEvent{
+			Type:            FlowDestroy,
+			Protocol:        protocol,
+			Source:          net.ParseIP("10.0.0.1").To4(),
+			Destination:     dst,
+			SourcePort:      40000,
+			DestinationPort: port,
+			Status:          status,
+		}
+	}
+
+	tests := []struct {
+		name    string
+		event   *FlowEvent
+		handled bool
+		counted bool
+	}{
+		{name: "unanswered", event: connection(unix.IPPROTO_TCP, local, 22, 0), handled: true, counted: true},
+		{name: "answered and not completed", event: connection(unix.IPPROTO_TCP, local, 22, statusSeenReply), handled: true, counted: true},
+		{name: "completed", event: connection(unix.IPPROTO_TCP, local, 22, statusSeenReply|statusAssured)},
+		{name: "SCTP INIT answered and aborted", event: connection(unix.IPPROTO_SCTP, local, 3868, statusSeenReply), handled: true, counted: true},
+		{name: "outbound answered and not completed", event: connection(unix.IPPROTO_TCP, remote, 22, statusSeenReply)},
+		{name: "outbound unanswered", event: connection(unix.IPPROTO_TCP, remote, 22, 0), handled: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tracker := New(Arguments{})
+			tracker.local.Store(map[string]struct{}{string(local.To16()): {}})
+			if handled := tracker.handle(test.event); handled != test.handled {
+				t.Fatalf("expected handled %t, got %t", test.handled, handled)
+			}
+			key := DestinationKey{Protocol: test.event.Protocol, Port: test.event.DestinationPort}
+			if count := tracker.inbound[key]; (count == 1) != test.counted || len(tracker.inbound) > 1 {
+				t.Fatalf("expected counted %t: %v", test.counted, tracker.inbound)
+			}
+		})
+	}
+}
+
+func TestInboundIncompleteMaxPorts(t *testing.T) {
+	tracker := New(Arguments{})
+	for port := 1; port <= maxInboundPorts; port++ {
+		tracker.inboundIncomplete(unix.IPPROTO_TCP, uint16(port))
+	}
+	// further ports are counted together, while counted ports keep their own count
+	tracker.inboundIncomplete(unix.IPPROTO_TCP, 20000)
+	tracker.inboundIncomplete(unix.IPPROTO_SCTP, 3868)
+	tracker.inboundIncomplete(unix.IPPROTO_TCP, 22)
+
+	tests := []struct {
+		key   DestinationKey
+		count uint64
+	}{
+		{key: DestinationKey{Protocol: unix.IPPROTO_TCP, Port: 22}, count: 2},
+		{key: DestinationKey{Protocol: unix.IPPROTO_TCP, Port: maxInboundPorts}, count: 1},
+		{key: DestinationKey{Protocol: unix.IPPROTO_TCP}, count: 1},
+		{key: DestinationKey{Protocol: unix.IPPROTO_SCTP}, count: 1},
+		{key: DestinationKey{Protocol: unix.IPPROTO_TCP, Port: 20000}},
+		{key: DestinationKey{Protocol: unix.IPPROTO_SCTP, Port: 3868}},
+	}
+	for _, test := range tests {
+		if count := tracker.inbound[test.key]; count != test.count {
+			t.Errorf("%s %d: expected %d, got %d", ProtocolName(test.key.Protocol), test.key.Port, test.count, count)
+		}
+	}
+	if len(tracker.inbound) != maxInboundPorts+2 {
+		t.Fatalf("expected %d counted ports, got %d", maxInboundPorts+2, len(tracker.inbound))
+	}
+	// the ports counted together are reported as other
+	if ports := collect(t, tracker, descInboundIncomplete); len(ports) != maxInboundPorts+1 {
+		t.Fatalf("expected %d port labels, got %d", maxInboundPorts+1, len(ports))
+	} else if _, ok := ports["other"]; !ok {
+		t.Fatal("expected the other port to be reported")
+	}
+}
@@ -5,8 +5,8 @@ package conntrack
 import (
 	"context"
 	"fmt"
-	"log"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/mdlayher/netlink"
@@ -15,25 +15,45 @@ import (
 	"golang.org/x/sys/unix"
 )
 
-// Listen connects to the netlink socket and begins listening for Update and Destroy connection events. Failed
+// Attribute types that are not exported by the conntrack package.
+const (
+	ctaTupleReply conntrack.AttributeType = 2
+	ctaProtoInfo  conntrack.AttributeType = 4
+	ctaZone       conntrack.AttributeType = 18
+)
+
+// Listen connects to the netlink socket and begins listening for Update and Destroy connection events, and New
+// events if SYN retries are estimated. Failed
 // connections (due to rejections or timeouts) are recorded, while successful connections reset the record.
 // After each interval the current set of records are merged and visible when metrics are collected. The method
-// exits when the context is closed or all event workers encounter an error.
+// exits when the context is closed or all event workers encounter an error, and stops flushing on exit.
 func (t *ConnectionTracker) Listen(ctx context.Context) error {
 	conn, err := conntrack.Dial(&netlink.Config{DisableNSLockThread: true})
 	if err != nil {
 		return err
 	}
 	defer conn.Close()
-	if err := conn.SetReadBufferForce(1 * 1024 * 1024); err != nil {
+	size := t.ReadBufferSize()
+	if err := conn.SetReadBufferForce(size); err != nil {
 		return err
 	}
+	gaugeReadBufferBytes.WithLabelValues().Set(float64(size))
 
-	counter := gaugeEvents.WithLabelValues()
 	filterCounter := gaugeFilteredEvents.WithLabelValues()
 
+	t.lock.RLock()
+	synRetries := t.args.SynRetries
+	t.lock.RUnlock()
+	groups := []netfilter.NetlinkGroup{netfilter.GroupCTDestroy, netfilter.GroupCTUpdate}
+	if synRetries {
+		groups = append(groups, netfilter.GroupCTNew)
+	}
+
 	workers := uint8(1)
-	errCh, err := conn.ListenRaw(workers, []netfilter.NetlinkGroup{netfilter.GroupCTDestroy, netfilter.GroupCTUpdate}, func(recv []netlink.Message) error {
+	errCh, err := conn.ListenRaw(workers, groups, func(recv []netlink.Message) error {
+		now := time.Now()
+		atomic.StoreInt64(&t.lastEvent, now.UnixNano())
+
 		var flow conntrack.Flow
 		var eventType conntrack.EventType
 
@@ -49,6 +69,8 @@ func (t *ConnectionTracker) Listen(ctx context.Context) error {
 				switch eventType {
 				case conntrack.EventDestroy, conntrack.EventUpdate:
 					return true, nil
+				case conntrack.EventNew:
+					return synRetries, nil
 				default:
 					return false, nil
 				}
@@ -56,15 +78,48 @@ func (t *ConnectionTracker) Listen(ctx context.Context) error {
 			func(attr netfilter.Attribute) (bool, error) {
 				switch conntrack.AttributeType(attr.Type) {
 				case conntrack.CTAStatus:
+					// updates are only inspected for the first reply to estimate SYN retries,
+					// or to tell whether an SCTP association was established, and the
+					// original tuple precedes the status
+					sctp := flow.TupleOrig.Proto.Protocol == unix.IPPROTO_SCTP
+					if eventType == conntrack.EventNew || (eventType == conntrack.EventUpdate && !synRetries && !sctp) {
+						return true, nil
+					}
+					if err := flow.Unmarshal([]netfilter.Attribute{attr}); err != nil {
+						return false, err
+					}
+					if eventType != conntrack.EventDestroy {
+						return true, nil
+					}
+					// replied connections only matter to the dependency graph, if they are
+					// inbound and incomplete, or if they completed and may have been broken.
+					// SCTP associations that were not established are failures.
+					assured := flow.Status.Value&statusAssured != 0
+					if !sctp && flow.Status.SeenReply() && atomic.LoadInt32(&t.replied) == 0 && !assured && !t.isLocal(flow.TupleOrig.IP.DestinationAddress) {
+						return false, nil
+					}
+					if sctp && assured && atomic.LoadInt32(&t.replied) == 0 {
+						return false, nil
+					}
+				case ctaProtoInfo:
 					if eventType != conntrack.EventDestroy {
 						return true, nil
 					}
+					if err := attr.UnmarshalNested(); err != nil {
+						return false, err
+					}
 					if err := flow.Unmarshal([]netfilter.Attribute{attr}); err != nil {
 						return false, err
 					}
-					if flow.Status.SeenReply() {
+					// the state follows the status, so completed connections that were
+					// closed cleanly can be dropped
+					if tcp := flow.ProtoInfo.TCP; tcp != nil && flow.Status.Value&statusAssured != 0 && len(brokenReason(tcp.State)) == 0 && atomic.LoadInt32(&t.replied) == 0 {
 						return false, nil
 					}
+				case ctaZone:
+					if err := flow.Unmarshal([]netfilter.Attribute{attr}); err != nil {
+						return false, err
+					}
 				case conntrack.CTATupleOrig:
 					if err := attr.UnmarshalNested(); err != nil {
 						return false, err
@@ -72,9 +127,16 @@ func (t *ConnectionTracker) Listen(ctx context.Context) error {
 					if err := flow.Unmarshal([]netfilter.Attribute{attr}); err != nil {
 						return false, err
 					}
-					if flow.TupleOrig.Proto.Protocol != unix.IPPROTO_TCP {
+					if p := flow.TupleOrig.Proto.Protocol; p != unix.IPPROTO_TCP && p != unix.IPPROTO_SCTP {
 						return false, nil
 					}
+				case ctaTupleReply:
+					if err := attr.UnmarshalNested(); err != nil {
+						return false, err
+					}
+					if err := flow.Unmarshal([]netfilter.Attribute{attr}); err != nil {
+						return false, err
+					}
 				}
 				return true, nil
 			},
@@ -87,50 +149,26 @@ func (t *ConnectionTracker) Listen(ctx context.Context) error {
 			return nil
 		}
 
-		switch eventType {
-		case conntrack.EventDestroy:
-			if flow.Status.SeenReply() {
-				filterCounter.Inc()
-				return nil
-			}
-			dst := flow.TupleOrig
-			failures, successes := t.failure(dst.IP.DestinationAddress, dst.Proto.Protocol, dst.Proto.DestinationPort)
-			counter.Inc()
-			if t.args.Log {
-				log.Printf("down ip=%s proto=%d port=%d down=%d up=%d", dst.IP.DestinationAddress, dst.Proto.Protocol, dst.Proto.DestinationPort, failures, successes)
-			}
-
-		case conntrack.EventUpdate:
-			dst := flow.TupleOrig
-			failures, successes, ok := t.success(dst.IP.DestinationAddress, dst.Proto.Protocol, dst.Proto.DestinationPort)
-			if !ok {
-				filterCounter.Inc()
-				return nil
-			}
-			counter.Inc()
-			if t.args.Log {
-				log.Printf("up ip=%s proto=%d port=%d down=%d up=%d tracked=%t", dst.IP.DestinationAddress, dst.Proto.Protocol, dst.Proto.DestinationPort, failures, successes, ok)
-			}
-
-		default:
-			filterCounter.Inc()
-			return nil
-		}
-
+		e := newFlowEvent(eventType, &flow)
+		e.Time = now
+		t.handle(&e)
 		return nil
 	})
 	if err != nil {
 		return err
 	}
 
+	atomic.StoreInt64(&t.started, time.Now().UnixNano())
+	atomic.StoreInt32(&t.listening, 1)
+	defer atomic.StoreInt32(&t.listening, 0)
+
 	// flush stats from current to down without blocking the main event loop
-	ticker := time.NewTicker(t.args.Interval)
-	defer ticker.Stop()
-	go func() {
-		for range ticker.C {
-			t.flush()
-		}
-	}()
+	stop := make(chan struct{})
+	defer close(stop)
+	go t.flushEvery(stop)
+	stalled := make(chan struct{})
+	go t.watchdog(stop, stalled)
+	go t.tuneReadBuffer(stop, conn)
 
 	var errs []error
 	var errBufferFull bool
@@ -142,7 +180,7 @@ func (t *ConnectionTracker) Listen(ctx context.Context) error {
 			}
 			if err != nil {
 				switch {
-				case strings.Contains(err.Error(), "recvmsg: no buffer space available"):
+				case isBufferFull(err):
 					errBufferFull = true
 				default:
 					errs = append(errs, err)
@@ -151,14 +189,23 @@ func (t *ConnectionTracker) Listen(ctx context.Context) error {
 			workers--
 
 		case <-ctx.Done():
+			stopWorkers(conn, errCh, workers)
 			workers = 0
 			errs = append(errs, context.Canceled)
+
+		case <-stalled:
+			stopWorkers(conn, errCh, workers)
+			gaugeListenerStalls.WithLabelValues().Inc()
+			return ErrListenerStalled
 		}
 	}
 
 	if len(errs) == 0 {
 		if errBufferFull {
 			gaugeBufferFullErrors.WithLabelValues().Inc()
+			if t.growReadBuffer() {
+				listenerLog.Info("Receive buffer filled up, growing it", "bytes", t.ReadBufferSize())
+			}
 			return ErrBufferFull
 		}
 		return nil
@@ -172,3 +219,22 @@ func (t *ConnectionTracker) Listen(ctx context.Context) error {
 	}
 	return fmt.Errorf("unable to listen to events: %s", strings.Join(msgs, ", "))
 }
+
+// stopWorkers unblocks any workers waiting on the connection so that it can be closed, and
+// receives the errors the workers report as they exit.
+func stopWorkers(conn *conntrack.Conn, errCh <-chan error, workers uint8) {
+	if err := conn.SetReadDeadline(time.Now()); err != nil {
+		// closing the connection still stops the workers, but may wait for their receives
+		listenerLog.Warn("Unable to interrupt the workers receiving events", "err", err)
+	}
+	go func() {
+		for ; workers > 0; workers-- {
+			<-errCh
+		}
+	}()
+}
+
+// isBufferFull returns true if the error indicates the socket receive buffer overflowed.
+func isBufferFull(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "recvmsg: no buffer space available")
+}
@@ -11,3 +11,13 @@ import (
 func (t *ConnectionTracker) Listen(ctx context.Context) error {
 	return fmt.Errorf("conntrack is not supported on non-Linux platforms")
 }
+
+// DumpUnreplied is only supported on Linux platforms.
+func DumpUnreplied(protocol uint8) ([]UnrepliedDestination, error) {
+	return nil, fmt.Errorf("conntrack is not supported on non-Linux platforms")
+}
+
+// Record is only supported on Linux platforms.
+func Record(ctx context.Context, w *FlowWriter) error {
+	return fmt.Errorf("conntrack is not supported on non-Linux platforms")
+}
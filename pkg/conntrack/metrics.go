@@ -1,8 +1,8 @@
 package conntrack
 
 import (
+	"fmt"
 	"net"
-	_ "net/http/pprof"
 	"strconv"
 
 	"golang.org/x/sys/unix"
@@ -23,6 +23,52 @@ var (
 		Name: "down_target_buffer_full_errors",
 		Help: "The number of times the receive buffer has filled up and we have dropped some events.",
 	}, nil)
+	gaugeListenerStalls = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "conntrack_listener_stall_count",
+		Help: "The number of times the listener was restarted because connections changed without any events being received.",
+	}, nil)
+	gaugeFlowLogRecords = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "conntrack_flow_log_record_count",
+		Help: "The number of failures written to the flow log.",
+	}, nil)
+	gaugeFlowLogDropped = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "conntrack_flow_log_dropped_count",
+		Help: "The number of failures not written to the flow log, by reason.",
+	}, []string{"reason"})
+	gaugeReadBufferBytes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "conntrack_netlink_receive_buffer_bytes",
+		Help: "The requested size of the netlink receive buffer in bytes.",
+	}, nil)
+	gaugeReadBufferQueued = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "conntrack_netlink_receive_queue_bytes",
+		Help: "The bytes waiting in the netlink receive queue when last sampled.",
+	}, nil)
+	gaugeSocketDrops = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "conntrack_netlink_socket_drop_count",
+		Help: "The number of messages the kernel dropped because the netlink receive buffer was full.",
+	}, nil)
+	gaugeScanExcludedEvents = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "conntrack_scan_excluded_event_count",
+		Help: "The count of failed connections not recorded because their source is suspected of scanning.",
+	}, nil)
+	gaugeDependencyEdgesDropped = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "conntrack_dependency_edge_dropped_count",
+		Help: "The count of connections not added to the dependency graph because it has the maximum number of edges.",
+	}, nil)
+	gaugeReasonCountsDropped = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "conntrack_failure_count_dropped_count",
+		Help: "The count of failed connections not counted per destination because the maximum number of destinations is already counted, by counter.",
+	}, []string{"counter"})
+	gaugeICMPErrors = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "conntrack_icmp_unreachable_received_count",
+		Help: "The count of ICMP destination unreachable errors received for TCP connections and SCTP associations, by reason.",
+	}, []string{"reason"})
+	descListenerLastEvent = prometheus.NewDesc(
+		"conntrack_listener_last_event_timestamp_seconds",
+		"The time the listener last received a conntrack event in seconds since the epoch, or zero if no event has been received.",
+		nil,
+		nil,
+	)
 	descTargets = prometheus.NewDesc(
 		"down_target",
 		"Reports the value one if the remote target with the provided address could not be reached during a connection attempt in the last minute.",
@@ -35,14 +81,95 @@ var (
 		[]string{"ip", "proto", "port"},
 		nil,
 	)
+	descScanSuspects = prometheus.NewDesc(
+		"conntrack_scan_suspects",
+		"Reports the number of distinct destination addresses a source suspected of scanning failed to connect to in the window it was detected.",
+		[]string{"src"},
+		nil,
+	)
+	descInboundIncomplete = prometheus.NewDesc(
+		"conntrack_inbound_incomplete_total",
+		"The count of connections to a local address and port that were destroyed before completing their handshake. Ports beyond the first 1024 are counted as port other.",
+		[]string{"proto", "port"},
+		nil,
+	)
+	descTargetCIDRs = prometheus.NewDesc(
+		"down_target_cidr",
+		"Reports the number of remote targets within the CIDR that could not be reached during a connection attempt in the last minute.",
+		[]string{"cidr"},
+		nil,
+	)
+	descSynRetries = prometheus.NewDesc(
+		"conntrack_syn_retries_total",
+		"The estimated count of SYN retransmissions of connections to the remote target before it replied, from the delay before the first reply.",
+		[]string{"ip"},
+		nil,
+	)
+	descBrokenConnections = prometheus.NewDesc(
+		"conntrack_broken_established_total",
+		"The count of connections to the remote target that completed their handshake and were then reset or timed out instead of being closed.",
+		[]string{"ip", "reason"},
+		nil,
+	)
+	descUnreachable = prometheus.NewDesc(
+		"conntrack_icmp_unreachable_total",
+		"The count of failed connections to the remote target that received an ICMP destination unreachable error, by reason.",
+		[]string{"ip", "reason"},
+		nil,
+	)
+	descPolicyDenials = prometheus.NewDesc(
+		"conntrack_policy_denied_total",
+		"The count of failed connections to the remote target that the NetworkPolicy denies. A connection denied by several policies is counted for each of them.",
+		[]string{"ip", "policy"},
+		nil,
+	)
+	descTargetFlapping = prometheus.NewDesc(
+		"down_target_flapping",
+		"Reports the number of times the remote target with the provided address started or stopped being reported as down within the flap window, if it exceeds the flap threshold.",
+		[]string{"ip"},
+		nil,
+	)
+	descNodeConnectivity = prometheus.NewDesc(
+		"node_connectivity_failure",
+		"Reports the number of connections from the source node to the destination node or one of its pods that could not be completed in the last interval.",
+		[]string{"src_node", "dst_node"},
+		nil,
+	)
+	descFilterHits = prometheus.NewDesc(
+		"down_target_filter_rule_hit_count",
+		"The count of connection events matched by each filter rule since the rules were last loaded.",
+		[]string{"rule", "action"},
+		nil,
+	)
 )
 
 func (t *ConnectionTracker) Describe(ch chan<- *prometheus.Desc) {
 	gaugeEvents.Describe(ch)
 	gaugeFilteredEvents.Describe(ch)
 	gaugeBufferFullErrors.Describe(ch)
+	gaugeListenerStalls.Describe(ch)
+	gaugeFlowLogRecords.Describe(ch)
+	gaugeFlowLogDropped.Describe(ch)
+	gaugeReadBufferBytes.Describe(ch)
+	gaugeReadBufferQueued.Describe(ch)
+	gaugeSocketDrops.Describe(ch)
+	gaugeScanExcludedEvents.Describe(ch)
+	gaugeDependencyEdgesDropped.Describe(ch)
+	gaugeReasonCountsDropped.Describe(ch)
+	gaugeICMPErrors.Describe(ch)
+	ch <- descListenerLastEvent
 	ch <- descTargets
 	ch <- descTargetPorts
+	ch <- descScanSuspects
+	ch <- descTargetCIDRs
+	ch <- descSynRetries
+	ch <- descBrokenConnections
+	ch <- descUnreachable
+	ch <- descPolicyDenials
+	ch <- descTargetFlapping
+	ch <- descInboundIncomplete
+	ch <- descNodeConnectivity
+	ch <- descFilterHits
 }
 
 var protocols = map[uint8]string{
@@ -50,18 +177,83 @@ var protocols = map[uint8]string{
 	unix.IPPROTO_IGMP:   "igmp",
 	unix.IPPROTO_TCP:    "tcp",
 	unix.IPPROTO_UDP:    "udp",
+	unix.IPPROTO_SCTP:   "sctp",
 	unix.IPPROTO_ICMPV6: "ipv6-icmp",
 }
 
+// ProtocolName returns the name of an IP protocol number, or the number itself if
+// the protocol is not known.
+func ProtocolName(protocol uint8) string {
+	if name, ok := protocols[protocol]; ok {
+		return name
+	}
+	return strconv.Itoa(int(protocol))
+}
+
+// ParseProtocol returns the IP protocol number for a name returned by ProtocolName.
+func ParseProtocol(name string) (uint8, error) {
+	for protocol, s := range protocols {
+		if s == name {
+			return protocol, nil
+		}
+	}
+	protocol, err := strconv.ParseUint(name, 10, 8)
+	if err != nil {
+		return 0, fmt.Errorf("unknown protocol %q", name)
+	}
+	return uint8(protocol), nil
+}
+
 func (t *ConnectionTracker) Collect(ch chan<- prometheus.Metric) {
 	gaugeEvents.Collect(ch)
 	gaugeFilteredEvents.Collect(ch)
 	gaugeBufferFullErrors.Collect(ch)
+	gaugeListenerStalls.Collect(ch)
+	gaugeFlowLogRecords.Collect(ch)
+	gaugeFlowLogDropped.Collect(ch)
+	gaugeReadBufferBytes.Collect(ch)
+	gaugeReadBufferQueued.Collect(ch)
+	gaugeSocketDrops.Collect(ch)
+	gaugeScanExcludedEvents.Collect(ch)
+	gaugeDependencyEdgesDropped.Collect(ch)
+	gaugeReasonCountsDropped.Collect(ch)
+	gaugeICMPErrors.Collect(ch)
+
+	var lastEvent float64
+	if last := t.LastEvent(); !last.IsZero() {
+		lastEvent = float64(last.UnixNano()) / 1e9
+	}
+	ch <- prometheus.MustNewConstMetric(descListenerLastEvent, prometheus.GaugeValue, lastEvent)
+
+	for ip, count := range t.SynRetries() {
+		ch <- prometheus.MustNewConstMetric(descSynRetries, prometheus.CounterValue, float64(count), ip)
+	}
+	for _, broken := range t.BrokenConnections() {
+		ch <- prometheus.MustNewConstMetric(descBrokenConnections, prometheus.CounterValue, float64(broken.Count), broken.IP.String(), broken.Reason)
+	}
+	for _, unreachable := range t.Unreachable() {
+		ch <- prometheus.MustNewConstMetric(descUnreachable, prometheus.CounterValue, float64(unreachable.Count), unreachable.IP.String(), unreachable.Reason)
+	}
+	for _, denials := range t.PolicyDenials() {
+		ch <- prometheus.MustNewConstMetric(descPolicyDenials, prometheus.CounterValue, float64(denials.Count), denials.IP.String(), denials.Policy)
+	}
+	for _, suspect := range t.ScanSuspects() {
+		ch <- prometheus.MustNewConstMetric(descScanSuspects, prometheus.GaugeValue, float64(suspect.Addresses), suspect.Source.String())
+	}
 
 	t.lock.RLock()
 	defer t.lock.RUnlock()
 
+	counts, suppressed := t.downCIDRs()
+	for cidr, count := range counts {
+		ch <- prometheus.MustNewConstMetric(descTargetCIDRs, prometheus.GaugeValue, float64(count), cidr)
+	}
 	for dst, state := range t.down {
+		if len(suppressed) > 0 {
+			if cidr, ok := t.args.Aggregation.CIDR(net.IP(dst), t.args.Nodes); ok && suppressed[cidr] {
+				continue
+			}
+		}
 		if !state.Up {
 			ch <- prometheus.MustNewConstMetric(descTargets, prometheus.GaugeValue, 1, net.IP([]byte(dst)).String())
 		}
@@ -74,4 +266,22 @@ func (t *ConnectionTracker) Collect(ch chan<- prometheus.Metric) {
 			ch <- prometheus.MustNewConstMetric(descTargetPorts, prometheus.GaugeValue, failures, net.IP([]byte(dst)).String(), protocols[target.Protocol], strconv.Itoa(int(target.Port)))
 		}
 	}
+	for dst, times := range t.transitions {
+		if len(times) > t.args.FlapThreshold {
+			ch <- prometheus.MustNewConstMetric(descTargetFlapping, prometheus.GaugeValue, float64(len(times)), net.IP([]byte(dst)).String())
+		}
+	}
+	for key, count := range t.inbound {
+		port := "other"
+		if key.Port != 0 {
+			port = strconv.Itoa(int(key.Port))
+		}
+		ch <- prometheus.MustNewConstMetric(descInboundIncomplete, prometheus.CounterValue, float64(count), ProtocolName(key.Protocol), port)
+	}
+	for pair, failures := range t.partitioned {
+		ch <- prometheus.MustNewConstMetric(descNodeConnectivity, prometheus.GaugeValue, float64(failures), pair.Source, pair.Destination)
+	}
+	for _, rule := range t.args.Filter.Hits() {
+		ch <- prometheus.MustNewConstMetric(descFilterHits, prometheus.CounterValue, float64(rule.Hits), rule.Name, string(rule.Action))
+	}
 }
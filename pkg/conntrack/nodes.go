@@ -0,0 +1,192 @@
+package conntrack
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+)
+
+// NodeMap maps IP addresses to the names of the nodes in a cluster, either because the
+// address is assigned to the node or because it falls within the pod CIDR of the node.
+type NodeMap struct {
+	addresses map[string]string
+	// cidrs holds the pod CIDRs by prefix length and network address, and masks the prefix
+	// lengths in use from longest to shortest, so that an address is found with one lookup
+	// per prefix length instead of by testing every node
+	cidrs map[cidrKey]nodeCIDR
+	masks []net.IPMask
+}
+
+type nodeCIDR struct {
+	name string
+	cidr *net.IPNet
+}
+
+// cidrKey identifies a CIDR by its prefix length and network address, which is 4 bytes for
+// IPv4 and 16 bytes for IPv6.
+type cidrKey struct {
+	ones    int
+	network string
+}
+
+// nodeList is the subset of a Kubernetes NodeList needed to map addresses to nodes. The
+// vendored API types are not used because their apimachinery dependencies are not vendored.
+type nodeList struct {
+	Items []struct {
+		Metadata struct {
+			Name string `json:"name"`
+		} `json:"metadata"`
+		Spec struct {
+			PodCIDR  string   `json:"podCIDR"`
+			PodCIDRs []string `json:"podCIDRs"`
+		} `json:"spec"`
+		Status struct {
+			Addresses []struct {
+				Type    string `json:"type"`
+				Address string `json:"address"`
+			} `json:"addresses"`
+		} `json:"status"`
+	} `json:"items"`
+}
+
+// ReadNodeMap reads a JSON encoded Kubernetes NodeList (such as the output of
+// `kubectl get nodes -o json`) and returns a map of the node addresses and pod CIDRs.
+func ReadNodeMap(r io.Reader) (*NodeMap, error) {
+	var list nodeList
+	if err := json.NewDecoder(r).Decode(&list); err != nil {
+		return nil, fmt.Errorf("unable to decode node list: %v", err)
+	}
+	m := &NodeMap{addresses: make(map[string]string), cidrs: make(map[cidrKey]nodeCIDR)}
+	for _, node := range list.Items {
+		name := node.Metadata.Name
+		if len(name) == 0 {
+			continue
+		}
+		for _, address := range node.Status.Addresses {
+			ip := net.ParseIP(address.Address)
+			if ip == nil {
+				continue
+			}
+			m.addresses[string(normalizeIP(ip))] = name
+		}
+		cidrs := node.Spec.PodCIDRs
+		if len(cidrs) == 0 && len(node.Spec.PodCIDR) > 0 {
+			cidrs = []string{node.Spec.PodCIDR}
+		}
+		for _, s := range cidrs {
+			_, cidr, err := net.ParseCIDR(s)
+			if err != nil {
+				return nil, fmt.Errorf("node %s has an invalid pod CIDR %q: %v", name, s, err)
+			}
+			m.addCIDR(name, cidr)
+		}
+	}
+	// longer prefixes are more specific, and IPv4 and IPv6 masks of the same length are
+	// both kept
+	sort.Slice(m.masks, func(i, j int) bool {
+		a, _ := m.masks[i].Size()
+		b, _ := m.masks[j].Size()
+		if a != b {
+			return a > b
+		}
+		return len(m.masks[i]) < len(m.masks[j])
+	})
+	return m, nil
+}
+
+// addCIDR indexes the pod CIDR of a node. A CIDR listed by more than one node belongs to
+// the first.
+func (m *NodeMap) addCIDR(name string, cidr *net.IPNet) {
+	ones, _ := cidr.Mask.Size()
+	key := cidrKey{ones: ones, network: string(cidr.IP.Mask(cidr.Mask))}
+	if _, ok := m.cidrs[key]; ok {
+		return
+	}
+	m.cidrs[key] = nodeCIDR{name: name, cidr: cidr}
+	for _, mask := range m.masks {
+		if bytes.Equal(mask, cidr.Mask) {
+			return
+		}
+	}
+	m.masks = append(m.masks, cidr.Mask)
+}
+
+// cidr returns the most specific pod CIDR that contains ip.
+func (m *NodeMap) cidr(ip net.IP) (nodeCIDR, bool) {
+	for _, mask := range m.masks {
+		network := ip.Mask(mask)
+		if network == nil {
+			// the mask is of the other address family
+			continue
+		}
+		ones, _ := mask.Size()
+		if c, ok := m.cidrs[cidrKey{ones: ones, network: string(network)}]; ok {
+			return c, true
+		}
+	}
+	return nodeCIDR{}, false
+}
+
+// LoadNodeMap reads a node map from the JSON encoded NodeList at path.
+func LoadNodeMap(path string) (*NodeMap, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ReadNodeMap(f)
+}
+
+// Node returns the name of the node that owns ip, either as a node address or as a pod
+// running on that node.
+func (m *NodeMap) Node(ip net.IP) (string, bool) {
+	if m == nil {
+		return "", false
+	}
+	if name, ok := m.addresses[string(normalizeIP(ip))]; ok {
+		return name, true
+	}
+	if c, ok := m.cidr(ip); ok {
+		return c.name, true
+	}
+	return "", false
+}
+
+// PodCIDR returns the pod CIDR of the node that contains ip.
+func (m *NodeMap) PodCIDR(ip net.IP) (*net.IPNet, bool) {
+	if m == nil {
+		return nil, false
+	}
+	if c, ok := m.cidr(ip); ok {
+		return c.cidr, true
+	}
+	return nil, false
+}
+
+// Len returns the number of nodes with at least one known address or CIDR.
+func (m *NodeMap) Len() int {
+	if m == nil {
+		return 0
+	}
+	names := make(map[string]struct{})
+	for _, name := range m.addresses {
+		names[name] = struct{}{}
+	}
+	for _, c := range m.cidrs {
+		names[c.name] = struct{}{}
+	}
+	return len(names)
+}
+
+// normalizeIP returns the 4 byte form of IPv4 addresses so that addresses parsed from text
+// and addresses received from the kernel compare equal.
+func normalizeIP(ip net.IP) net.IP {
+	if v4 := ip.To4(); v4 != nil {
+		return v4
+	}
+	return ip
+}
@@ -0,0 +1,112 @@
+package conntrack
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+const testNodeList = `{"items":[
+	{"metadata":{"name":"node-1"},"spec":{"podCIDR":"10.128.0.0/23"},"status":{"addresses":[{"type":"InternalIP","address":"192.168.0.1"}]}},
+	{"metadata":{"name":"node-2"},"spec":{"podCIDRs":["10.128.2.0/23","fd01:0:0:2::/64"]},"status":{"addresses":[{"type":"InternalIP","address":"192.168.0.2"},{"type":"Hostname","address":"node-2"}]}},
+	{"metadata":{"name":"node-3"},"spec":{"podCIDRs":["10.128.2.128/25","10.128.0.0/23"]}},
+	{"metadata":{"name":"node-4"},"spec":{"podCIDR":"10.130.0.0/16"}}
+]}`
+
+func TestNodeMap(t *testing.T) {
+	nodes, err := ReadNodeMap(strings.NewReader(testNodeList))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nodes.Len() != 4 {
+		t.Fatalf("expected 4 nodes, got %d", nodes.Len())
+	}
+
+	tests := []struct {
+		ip   net.IP
+		node string
+		cidr string
+	}{
+		{ip: net.ParseIP("192.168.0.1").To4(), node: "node-1"},
+		{ip: net.ParseIP("192.168.0.2"), node: "node-2"},
+		{ip: net.ParseIP("10.128.1.255"), node: "node-1", cidr: "10.128.0.0/23"},
+		{ip: net.ParseIP("10.128.2.1").To4(), node: "node-2", cidr: "10.128.2.0/23"},
+		{ip: net.ParseIP("fd01::2:0:0:0:1"), node: "node-2", cidr: "fd01:0:0:2::/64"},
+		// the most specific CIDR wins, and a CIDR listed twice belongs to the first node
+		{ip: net.ParseIP("10.128.2.200"), node: "node-3", cidr: "10.128.2.128/25"},
+		{ip: net.ParseIP("10.130.200.1"), node: "node-4", cidr: "10.130.0.0/16"},
+		{ip: net.ParseIP("10.128.4.1")},
+		{ip: net.ParseIP("fd01::1:0:0:0:1")},
+		{ip: net.ParseIP("::ffff:10.131.0.1")},
+	}
+	for _, test := range tests {
+		node, ok := nodes.Node(test.ip)
+		if node != test.node || ok != (len(test.node) > 0) {
+			t.Errorf("%s: expected node %q, got %q", test.ip, test.node, node)
+		}
+		cidr, ok := nodes.PodCIDR(test.ip)
+		if ok != (len(test.cidr) > 0) || (ok && cidr.String() != test.cidr) {
+			t.Errorf("%s: expected CIDR %q, got %v", test.ip, test.cidr, cidr)
+		}
+	}
+
+	if _, err := ReadNodeMap(strings.NewReader(`{"items":[{"metadata":{"name":"node-1"},"spec":{"podCIDR":"10.128.0.0"}}]}`)); err == nil {
+		t.Fatal("expected an invalid pod CIDR to be rejected")
+	}
+	var empty *NodeMap
+	if _, ok := empty.Node(net.ParseIP("10.128.0.1")); ok || empty.Len() != 0 {
+		t.Fatal("expected an empty map to know no nodes")
+	}
+}
+
+func TestNodeConnectivity(t *testing.T) {
+	nodes, err := ReadNodeMap(strings.NewReader(testNodeList))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name     string
+		nodeName string
+		src, dst string
+		pair     *NodePair
+	}{
+		{name: "node to node", src: "192.168.0.1", dst: "192.168.0.2", pair: &NodePair{Source: "node-1", Destination: "node-2"}},
+		{name: "node to pod on another node", src: "192.168.0.1", dst: "10.128.2.10", pair: &NodePair{Source: "node-1", Destination: "node-2"}},
+		{name: "pod to pod on another node", src: "10.128.2.10", dst: "10.130.0.5", pair: &NodePair{Source: "node-2", Destination: "node-4"}},
+		{name: "unknown source on this node", nodeName: "node-4", src: "172.17.0.2", dst: "10.128.0.5", pair: &NodePair{Source: "node-4", Destination: "node-1"}},
+		{name: "node to pod on the same node", src: "192.168.0.1", dst: "10.128.0.5"},
+		{name: "pod to its own node", src: "10.128.2.10", dst: "192.168.0.2"},
+		{name: "unknown source on the same node", nodeName: "node-1", src: "172.17.0.2", dst: "10.128.0.5"},
+		{name: "unknown source without a node name", src: "172.17.0.2", dst: "10.128.0.5"},
+		{name: "destination outside the cluster", src: "192.168.0.1", dst: "8.8.8.8"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tracker := New(Arguments{Nodes: nodes, NodeName: test.nodeName})
+			tracker.handle(&FlowEvent{
+				Type:            FlowDestroy,
+				Protocol:        unix.IPPROTO_TCP,
+				Source:          net.ParseIP(test.src),
+				Destination:     net.ParseIP(test.dst),
+				SourcePort:      40000,
+				DestinationPort: 443,
+			})
+			tracker.flush()
+			if test.pair == nil {
+				if len(tracker.partitioned) != 0 {
+					t.Fatalf("expected no node failures, got %v", tracker.partitioned)
+				}
+				return
+			}
+			if len(tracker.partitioned) != 1 || tracker.partitioned[*test.pair] != 1 {
+				t.Fatalf("expected a failure from %s to %s, got %v", test.pair.Source, test.pair.Destination, tracker.partitioned)
+			}
+			// the labels of the metric are sorted, so it is keyed by dst_node
+			if failures := collect(t, tracker, descNodeConnectivity); failures[test.pair.Destination] != 1 {
+				t.Fatalf("unexpected metrics %v", failures)
+			}
+		})
+	}
+}
@@ -0,0 +1,545 @@
+package conntrack
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strings"
+)
+
+// PolicyMap evaluates whether the Kubernetes NetworkPolicies of a cluster deny a connection
+// between two pods, so that failures caused by a policy can be told apart from outages.
+type PolicyMap struct {
+	pods       map[string]*policyPod
+	namespaces map[string]map[string]string
+	policies   []*networkPolicy
+}
+
+type policyPod struct {
+	namespace string
+	labels    map[string]string
+	// ports are the named container ports of the pod
+	ports map[string]namedPort
+}
+
+type namedPort struct {
+	protocol uint8
+	port     uint16
+}
+
+type networkPolicy struct {
+	name     string
+	selector labelSelector
+	ingress  bool
+	egress   bool
+
+	ingressRules []policyRule
+	egressRules  []policyRule
+}
+
+type policyRule struct {
+	namespace string
+	peers     []policyPeer
+	ports     []policyPort
+}
+
+type policyPeer struct {
+	// a peer matches pods if pods is set, or addresses within cidr that are not excepted
+	// otherwise
+	pods       *labelSelector
+	namespaces *labelSelector
+	cidr       *net.IPNet
+	except     []*net.IPNet
+}
+
+type policyPort struct {
+	protocol uint8
+	port     uint16
+	endPort  uint16
+	// name is set instead of port for a named container port
+	name string
+}
+
+// policyList is the subset of a Kubernetes List of pods, namespaces, and NetworkPolicies
+// needed to evaluate policies, decoded without the vendored API types for the reason given
+// on nodeList.
+type policyList struct {
+	Items []struct {
+		Kind     string `json:"kind"`
+		Metadata struct {
+			Name      string            `json:"name"`
+			Namespace string            `json:"namespace"`
+			Labels    map[string]string `json:"labels"`
+		} `json:"metadata"`
+		Spec   json.RawMessage `json:"spec"`
+		Status struct {
+			Phase  string `json:"phase"`
+			PodIPs []struct {
+				IP string `json:"ip"`
+			} `json:"podIPs"`
+			PodIP string `json:"podIP"`
+		} `json:"status"`
+	} `json:"items"`
+}
+
+type podSpec struct {
+	HostNetwork bool `json:"hostNetwork"`
+	Containers  []struct {
+		Ports []struct {
+			Name          string `json:"name"`
+			ContainerPort int32  `json:"containerPort"`
+			Protocol      string `json:"protocol"`
+		} `json:"ports"`
+	} `json:"containers"`
+}
+
+type networkPolicySpec struct {
+	PodSelector labelSelectorSpec `json:"podSelector"`
+	PolicyTypes []string          `json:"policyTypes"`
+	Ingress     []struct {
+		From  []networkPolicyPeer `json:"from"`
+		Ports []networkPolicyPort `json:"ports"`
+	} `json:"ingress"`
+	Egress []struct {
+		To    []networkPolicyPeer `json:"to"`
+		Ports []networkPolicyPort `json:"ports"`
+	} `json:"egress"`
+}
+
+type networkPolicyPeer struct {
+	PodSelector       *labelSelectorSpec `json:"podSelector"`
+	NamespaceSelector *labelSelectorSpec `json:"namespaceSelector"`
+	IPBlock           *struct {
+		CIDR   string   `json:"cidr"`
+		Except []string `json:"except"`
+	} `json:"ipBlock"`
+}
+
+type networkPolicyPort struct {
+	Protocol string           `json:"protocol"`
+	Port     *json.RawMessage `json:"port"`
+	EndPort  int32            `json:"endPort"`
+}
+
+type labelSelectorSpec struct {
+	MatchLabels      map[string]string `json:"matchLabels"`
+	MatchExpressions []struct {
+		Key      string   `json:"key"`
+		Operator string   `json:"operator"`
+		Values   []string `json:"values"`
+	} `json:"matchExpressions"`
+}
+
+// ReadPolicyMap reads a JSON encoded Kubernetes List of pods, namespaces, and
+// NetworkPolicies (such as the output of
+// `kubectl get pods,namespaces,networkpolicies --all-namespaces -o json`). Items of other
+// kinds are ignored, as are pods that use the host network or have finished.
+func ReadPolicyMap(r io.Reader) (*PolicyMap, error) {
+	var list policyList
+	if err := json.NewDecoder(r).Decode(&list); err != nil {
+		return nil, fmt.Errorf("unable to decode policy list: %v", err)
+	}
+	m := &PolicyMap{
+		pods:       make(map[string]*policyPod),
+		namespaces: make(map[string]map[string]string),
+	}
+	for _, item := range list.Items {
+		meta := item.Metadata
+		switch item.Kind {
+		case "Namespace":
+			m.namespaces[meta.Name] = meta.Labels
+		case "Pod":
+			if item.Status.Phase == "Succeeded" || item.Status.Phase == "Failed" {
+				continue
+			}
+			var spec podSpec
+			if err := json.Unmarshal(item.Spec, &spec); err != nil {
+				return nil, fmt.Errorf("pod %s/%s: %v", meta.Namespace, meta.Name, err)
+			}
+			if spec.HostNetwork {
+				continue
+			}
+			pod := &policyPod{namespace: meta.Namespace, labels: meta.Labels, ports: make(map[string]namedPort)}
+			for _, c := range spec.Containers {
+				for _, p := range c.Ports {
+					if len(p.Name) == 0 {
+						continue
+					}
+					protocol, err := policyProtocol(p.Protocol)
+					if err != nil {
+						return nil, fmt.Errorf("pod %s/%s: %v", meta.Namespace, meta.Name, err)
+					}
+					pod.ports[p.Name] = namedPort{protocol: protocol, port: uint16(p.ContainerPort)}
+				}
+			}
+			ips := []string{item.Status.PodIP}
+			for _, ip := range item.Status.PodIPs {
+				ips = append(ips, ip.IP)
+			}
+			for _, s := range ips {
+				if ip := net.ParseIP(s); ip != nil {
+					m.pods[string(normalizeIP(ip))] = pod
+				}
+			}
+		case "NetworkPolicy":
+			var spec networkPolicySpec
+			if err := json.Unmarshal(item.Spec, &spec); err != nil {
+				return nil, fmt.Errorf("network policy %s/%s: %v", meta.Namespace, meta.Name, err)
+			}
+			policy, err := newNetworkPolicy(meta.Namespace, spec)
+			if err != nil {
+				return nil, fmt.Errorf("network policy %s/%s: %v", meta.Namespace, meta.Name, err)
+			}
+			policy.name = meta.Namespace + "/" + meta.Name
+			m.policies = append(m.policies, policy)
+		}
+	}
+	return m, nil
+}
+
+// LoadPolicyMap reads a policy map from the JSON encoded List at path.
+func LoadPolicyMap(path string) (*PolicyMap, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ReadPolicyMap(f)
+}
+
+func newNetworkPolicy(namespace string, spec networkPolicySpec) (*networkPolicy, error) {
+	selector, err := newLabelSelector(spec.PodSelector)
+	if err != nil {
+		return nil, err
+	}
+	selector.namespace = namespace
+	policy := &networkPolicy{selector: selector}
+	if len(spec.PolicyTypes) == 0 {
+		// policies without types always isolate ingress, and egress if they have egress rules
+		policy.ingress = true
+		policy.egress = len(spec.Egress) > 0
+	}
+	for _, t := range spec.PolicyTypes {
+		switch t {
+		case "Ingress":
+			policy.ingress = true
+		case "Egress":
+			policy.egress = true
+		default:
+			return nil, fmt.Errorf("unknown policy type %q", t)
+		}
+	}
+	for _, rule := range spec.Ingress {
+		r, err := newPolicyRule(namespace, rule.From, rule.Ports)
+		if err != nil {
+			return nil, err
+		}
+		policy.ingressRules = append(policy.ingressRules, r)
+	}
+	for _, rule := range spec.Egress {
+		r, err := newPolicyRule(namespace, rule.To, rule.Ports)
+		if err != nil {
+			return nil, err
+		}
+		policy.egressRules = append(policy.egressRules, r)
+	}
+	return policy, nil
+}
+
+func newPolicyRule(namespace string, peers []networkPolicyPeer, ports []networkPolicyPort) (policyRule, error) {
+	rule := policyRule{namespace: namespace}
+	for _, p := range peers {
+		var peer policyPeer
+		switch {
+		case p.IPBlock != nil:
+			_, cidr, err := net.ParseCIDR(p.IPBlock.CIDR)
+			if err != nil {
+				return rule, err
+			}
+			peer.cidr = cidr
+			if peer.except, err = parseCIDRs(p.IPBlock.Except); err != nil {
+				return rule, err
+			}
+		case p.PodSelector != nil || p.NamespaceSelector != nil:
+			pods := &labelSelector{}
+			if p.PodSelector != nil {
+				selector, err := newLabelSelector(*p.PodSelector)
+				if err != nil {
+					return rule, err
+				}
+				pods = &selector
+			}
+			peer.pods = pods
+			if p.NamespaceSelector != nil {
+				selector, err := newLabelSelector(*p.NamespaceSelector)
+				if err != nil {
+					return rule, err
+				}
+				peer.namespaces = &selector
+			}
+		default:
+			return rule, fmt.Errorf("a peer must have a pod selector, namespace selector, or IP block")
+		}
+		rule.peers = append(rule.peers, peer)
+	}
+	for _, p := range ports {
+		protocol, err := policyProtocol(p.Protocol)
+		if err != nil {
+			return rule, err
+		}
+		port := policyPort{protocol: protocol, endPort: uint16(p.EndPort)}
+		if p.Port != nil {
+			var number uint16
+			if err := json.Unmarshal(*p.Port, &number); err != nil {
+				if err := json.Unmarshal(*p.Port, &port.name); err != nil {
+					return rule, fmt.Errorf("invalid port %s", string(*p.Port))
+				}
+			}
+			port.port = number
+		}
+		rule.ports = append(rule.ports, port)
+	}
+	return rule, nil
+}
+
+// policyProtocol returns the protocol number of a Kubernetes protocol name, which defaults
+// to TCP.
+func policyProtocol(name string) (uint8, error) {
+	if len(name) == 0 {
+		name = "TCP"
+	}
+	switch name {
+	case "TCP", "UDP", "SCTP":
+		return ParseProtocol(strings.ToLower(name))
+	default:
+		return 0, fmt.Errorf("unknown protocol %q", name)
+	}
+}
+
+// labelSelector matches labels. The empty selector matches every set of labels.
+type labelSelector struct {
+	// namespace, if set, limits the selector to pods in the namespace
+	namespace    string
+	labels       map[string]string
+	requirements []labelRequirement
+}
+
+type labelRequirement struct {
+	key      string
+	operator string
+	values   map[string]struct{}
+}
+
+func newLabelSelector(spec labelSelectorSpec) (labelSelector, error) {
+	s := labelSelector{labels: spec.MatchLabels}
+	for _, expr := range spec.MatchExpressions {
+		switch expr.Operator {
+		case "In", "NotIn", "Exists", "DoesNotExist":
+		default:
+			return s, fmt.Errorf("unknown label selector operator %q", expr.Operator)
+		}
+		r := labelRequirement{key: expr.Key, operator: expr.Operator, values: make(map[string]struct{})}
+		for _, v := range expr.Values {
+			r.values[v] = struct{}{}
+		}
+		s.requirements = append(s.requirements, r)
+	}
+	return s, nil
+}
+
+func (s *labelSelector) matches(labels map[string]string) bool {
+	for k, v := range s.labels {
+		if value, ok := labels[k]; !ok || value != v {
+			return false
+		}
+	}
+	for _, r := range s.requirements {
+		value, ok := labels[r.key]
+		_, in := r.values[value]
+		switch r.operator {
+		case "In":
+			if !ok || !in {
+				return false
+			}
+		case "NotIn":
+			if ok && in {
+				return false
+			}
+		case "Exists":
+			if !ok {
+				return false
+			}
+		case "DoesNotExist":
+			if ok {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// selects returns true if the policy applies to pod.
+func (p *networkPolicy) selects(pod *policyPod) bool {
+	return pod.namespace == p.selector.namespace && p.selector.matches(pod.labels)
+}
+
+// matches returns true if the rule allows traffic to or from the peer at ip, which is pod
+// if the address belongs to a known pod, to a port of target.
+func (m *PolicyMap) matches(rule policyRule, ip net.IP, pod, target *policyPod, protocol uint8, port uint16) bool {
+	if len(rule.ports) > 0 {
+		var allowed bool
+		for _, p := range rule.ports {
+			if p.allows(target, protocol, port) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return false
+		}
+	}
+	if len(rule.peers) == 0 {
+		return true
+	}
+	for _, peer := range rule.peers {
+		if peer.cidr != nil {
+			if peer.cidr.Contains(ip) && !containsIP(peer.except, ip) {
+				return true
+			}
+			continue
+		}
+		if pod == nil || !peer.pods.matches(pod.labels) {
+			continue
+		}
+		if peer.namespaces == nil {
+			if pod.namespace == rule.namespace {
+				return true
+			}
+			continue
+		}
+		if labels, ok := m.namespaces[pod.namespace]; ok && peer.namespaces.matches(labels) {
+			return true
+		}
+	}
+	return false
+}
+
+// allows returns true if the port matches, resolving named ports against the container
+// ports of target.
+func (p policyPort) allows(target *policyPod, protocol uint8, port uint16) bool {
+	if p.protocol != protocol {
+		return false
+	}
+	if len(p.name) > 0 {
+		if target == nil {
+			return false
+		}
+		named, ok := target.ports[p.name]
+		return ok && named.protocol == protocol && named.port == port
+	}
+	if p.port == 0 {
+		return true
+	}
+	if p.endPort > 0 {
+		return port >= p.port && port <= p.endPort
+	}
+	return port == p.port
+}
+
+// Denied returns the names of the policies that deny a connection from src to a port of
+// dst, or nil if the connection is allowed. A connection is denied if the source pod is
+// isolated for egress and no policy selecting it allows the connection, or if the
+// destination pod is isolated for ingress and no policy selecting it allows the connection.
+// The names of every policy isolating the pod in the denying direction are returned.
+// Addresses that do not belong to a known pod are never isolated.
+func (m *PolicyMap) Denied(src, dst net.IP, protocol uint8, port uint16) []string {
+	if m == nil {
+		return nil
+	}
+	srcPod := m.pods[string(normalizeIP(src))]
+	dstPod := m.pods[string(normalizeIP(dst))]
+	if srcPod == nil && dstPod == nil {
+		return nil
+	}
+
+	var denied []string
+	if srcPod != nil {
+		var isolating []string
+		var allowed bool
+		for _, policy := range m.policies {
+			if !policy.egress || !policy.selects(srcPod) {
+				continue
+			}
+			isolating = append(isolating, policy.name)
+			for _, rule := range policy.egressRules {
+				if m.matches(rule, dst, dstPod, dstPod, protocol, port) {
+					allowed = true
+					break
+				}
+			}
+		}
+		if len(isolating) > 0 && !allowed {
+			denied = append(denied, isolating...)
+		}
+	}
+	if dstPod != nil {
+		var isolating []string
+		var allowed bool
+		for _, policy := range m.policies {
+			if !policy.ingress || !policy.selects(dstPod) {
+				continue
+			}
+			isolating = append(isolating, policy.name)
+			for _, rule := range policy.ingressRules {
+				if m.matches(rule, src, srcPod, dstPod, protocol, port) {
+					allowed = true
+					break
+				}
+			}
+		}
+		if len(isolating) > 0 && !allowed {
+			denied = append(denied, isolating...)
+		}
+	}
+	sort.Strings(denied)
+	return denied
+}
+
+// Len returns the number of pods and policies in the map.
+func (m *PolicyMap) Len() (pods, policies int) {
+	if m == nil {
+		return 0, 0
+	}
+	return len(m.pods), len(m.policies)
+}
+
+// policyDestination returns the address and port a connection was actually sent to, which
+// is the endpoint rather than the service if the destination was translated.
+func policyDestination(e *FlowEvent) (net.IP, uint16) {
+	if nat := e.NAT(); nat != nil && nat.Destination != nil {
+		return nat.Destination, nat.DestinationPort
+	}
+	return e.Destination, e.DestinationPort
+}
+
+// PolicyDenial is the number of failed connections to a destination that a policy denies.
+type PolicyDenial struct {
+	IP     net.IP
+	Policy string
+	Count  uint64
+}
+
+// PolicyDenials returns the counts of failed connections to each destination that were
+// denied by a policy. A connection denied by several policies is counted once for each.
+func (t *ConnectionTracker) PolicyDenials() []PolicyDenial {
+	counts := t.policyDenials.snapshot()
+	denials := make([]PolicyDenial, 0, len(counts))
+	for _, count := range counts {
+		// the policy denial counter is keyed by policy name instead of reason
+		denials = append(denials, PolicyDenial{IP: count.IP, Policy: count.Reason, Count: count.Count})
+	}
+	return denials
+}
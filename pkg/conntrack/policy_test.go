@@ -0,0 +1,282 @@
+package conntrack
+
+import (
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// policyFixture is a List of namespaces and pods shared by the policy tests:
+//
+//	a/web     10.0.0.1  app=web, named port http on TCP 8080
+//	a/client  10.0.0.2  app=client
+//	b/client  10.0.1.1  app=client
+//	b/other   10.0.1.2  app=other
+const policyFixture = `
+{"kind": "Namespace", "metadata": {"name": "a", "labels": {"team": "a"}}},
+{"kind": "Namespace", "metadata": {"name": "b", "labels": {"team": "b"}}},
+{"kind": "Pod", "metadata": {"name": "web", "namespace": "a", "labels": {"app": "web"}},
+ "spec": {"containers": [{"ports": [{"name": "http", "containerPort": 8080}]}]},
+ "status": {"phase": "Running", "podIP": "10.0.0.1"}},
+{"kind": "Pod", "metadata": {"name": "client", "namespace": "a", "labels": {"app": "client"}},
+ "spec": {}, "status": {"phase": "Running", "podIP": "10.0.0.2"}},
+{"kind": "Pod", "metadata": {"name": "client", "namespace": "b", "labels": {"app": "client"}},
+ "spec": {}, "status": {"phase": "Running", "podIP": "10.0.1.1"}},
+{"kind": "Pod", "metadata": {"name": "other", "namespace": "b", "labels": {"app": "other"}},
+ "spec": {}, "status": {"phase": "Running", "podIPs": [{"ip": "10.0.1.2"}]}}`
+
+func readPolicyFixture(t *testing.T, policies ...string) *PolicyMap {
+	t.Helper()
+	items := append([]string{policyFixture}, policies...)
+	m, err := ReadPolicyMap(strings.NewReader(`{"items": [` + strings.Join(items, ",") + `]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+// policyConn is a connection checked against the policies.
+type policyConn struct {
+	src, dst string
+	protocol uint8
+	port     uint16
+}
+
+func TestPolicyMapDenied(t *testing.T) {
+	const (
+		aWeb    = "10.0.0.1"
+		aClient = "10.0.0.2"
+		bClient = "10.0.1.1"
+		bOther  = "10.0.1.2"
+	)
+	tcp, udp := uint8(unix.IPPROTO_TCP), uint8(unix.IPPROTO_UDP)
+
+	tests := []struct {
+		name     string
+		policies []string
+		conn     policyConn
+		denied   []string
+	}{
+		{
+			name: "no policies",
+			conn: policyConn{aClient, aWeb, tcp, 8080},
+		},
+		{
+			name:     "addresses outside the cluster are not isolated",
+			policies: []string{`{"kind": "NetworkPolicy", "metadata": {"name": "deny", "namespace": "a"}, "spec": {"podSelector": {}, "policyTypes": ["Ingress", "Egress"]}}`},
+			conn:     policyConn{"192.168.0.1", "192.168.0.2", tcp, 80},
+		},
+		{
+			name:     "without policy types ingress is isolated",
+			policies: []string{`{"kind": "NetworkPolicy", "metadata": {"name": "web", "namespace": "a"}, "spec": {"podSelector": {"matchLabels": {"app": "web"}}}}`},
+			conn:     policyConn{aClient, aWeb, tcp, 8080},
+			denied:   []string{"a/web"},
+		},
+		{
+			name:     "without policy types or egress rules egress is not isolated",
+			policies: []string{`{"kind": "NetworkPolicy", "metadata": {"name": "web", "namespace": "a"}, "spec": {"podSelector": {"matchLabels": {"app": "web"}}}}`},
+			conn:     policyConn{aWeb, aClient, tcp, 80},
+		},
+		{
+			name:     "without policy types egress rules isolate egress",
+			policies: []string{`{"kind": "NetworkPolicy", "metadata": {"name": "client", "namespace": "a"}, "spec": {"podSelector": {"matchLabels": {"app": "client"}}, "egress": [{"to": [{"podSelector": {"matchLabels": {"app": "web"}}}]}]}}`},
+			conn:     policyConn{aClient, bOther, tcp, 80},
+			denied:   []string{"a/client"},
+		},
+		{
+			name:     "egress rule allows the selected pods",
+			policies: []string{`{"kind": "NetworkPolicy", "metadata": {"name": "client", "namespace": "a"}, "spec": {"podSelector": {"matchLabels": {"app": "client"}}, "egress": [{"to": [{"podSelector": {"matchLabels": {"app": "web"}}}]}]}}`},
+			conn:     policyConn{aClient, aWeb, tcp, 8080},
+		},
+		{
+			name:     "empty pod selector selects every pod of the namespace",
+			policies: []string{`{"kind": "NetworkPolicy", "metadata": {"name": "deny", "namespace": "a"}, "spec": {"podSelector": {}, "policyTypes": ["Ingress"]}}`},
+			conn:     policyConn{bClient, aClient, tcp, 80},
+			denied:   []string{"a/deny"},
+		},
+		{
+			name:     "empty pod selector does not select pods of other namespaces",
+			policies: []string{`{"kind": "NetworkPolicy", "metadata": {"name": "deny", "namespace": "a"}, "spec": {"podSelector": {}, "policyTypes": ["Ingress"]}}`},
+			conn:     policyConn{aClient, bOther, tcp, 80},
+		},
+		{
+			name:     "empty peer pod selector allows the same namespace",
+			policies: []string{`{"kind": "NetworkPolicy", "metadata": {"name": "local", "namespace": "a"}, "spec": {"podSelector": {}, "ingress": [{"from": [{"podSelector": {}}]}]}}`},
+			conn:     policyConn{aClient, aWeb, tcp, 8080},
+		},
+		{
+			name:     "empty peer pod selector denies other namespaces",
+			policies: []string{`{"kind": "NetworkPolicy", "metadata": {"name": "local", "namespace": "a"}, "spec": {"podSelector": {}, "ingress": [{"from": [{"podSelector": {}}]}]}}`},
+			conn:     policyConn{bClient, aWeb, tcp, 8080},
+			denied:   []string{"a/local"},
+		},
+		{
+			name:     "empty namespace selector allows every namespace",
+			policies: []string{`{"kind": "NetworkPolicy", "metadata": {"name": "cluster", "namespace": "a"}, "spec": {"podSelector": {}, "ingress": [{"from": [{"namespaceSelector": {}}]}]}}`},
+			conn:     policyConn{bOther, aWeb, tcp, 8080},
+		},
+		{
+			name:     "namespace and pod selector allow matching pods in matching namespaces",
+			policies: []string{`{"kind": "NetworkPolicy", "metadata": {"name": "clients", "namespace": "a"}, "spec": {"podSelector": {"matchLabels": {"app": "web"}}, "ingress": [{"from": [{"namespaceSelector": {"matchLabels": {"team": "b"}}, "podSelector": {"matchLabels": {"app": "client"}}}]}]}}`},
+			conn:     policyConn{bClient, aWeb, tcp, 8080},
+		},
+		{
+			name:     "namespace and pod selector deny other pods in matching namespaces",
+			policies: []string{`{"kind": "NetworkPolicy", "metadata": {"name": "clients", "namespace": "a"}, "spec": {"podSelector": {"matchLabels": {"app": "web"}}, "ingress": [{"from": [{"namespaceSelector": {"matchLabels": {"team": "b"}}, "podSelector": {"matchLabels": {"app": "client"}}}]}]}}`},
+			conn:     policyConn{bOther, aWeb, tcp, 8080},
+			denied:   []string{"a/clients"},
+		},
+		{
+			name:     "namespace and pod selector deny matching pods in other namespaces",
+			policies: []string{`{"kind": "NetworkPolicy", "metadata": {"name": "clients", "namespace": "a"}, "spec": {"podSelector": {"matchLabels": {"app": "web"}}, "ingress": [{"from": [{"namespaceSelector": {"matchLabels": {"team": "b"}}, "podSelector": {"matchLabels": {"app": "client"}}}]}]}}`},
+			conn:     policyConn{aClient, aWeb, tcp, 8080},
+			denied:   []string{"a/clients"},
+		},
+		{
+			name:     "match expressions",
+			policies: []string{`{"kind": "NetworkPolicy", "metadata": {"name": "expr", "namespace": "a"}, "spec": {"podSelector": {"matchExpressions": [{"key": "app", "operator": "In", "values": ["web"]}]}, "ingress": [{"from": [{"namespaceSelector": {"matchExpressions": [{"key": "team", "operator": "NotIn", "values": ["b"]}]}}]}]}}`},
+			conn:     policyConn{bClient, aWeb, tcp, 8080},
+			denied:   []string{"a/expr"},
+		},
+		{
+			name:     "ip block allows addresses in the block",
+			policies: []string{`{"kind": "NetworkPolicy", "metadata": {"name": "external", "namespace": "a"}, "spec": {"podSelector": {"matchLabels": {"app": "client"}}, "policyTypes": ["Egress"], "egress": [{"to": [{"ipBlock": {"cidr": "192.168.0.0/16", "except": ["192.168.1.0/24"]}}]}]}}`},
+			conn:     policyConn{aClient, "192.168.0.1", tcp, 443},
+		},
+		{
+			name:     "ip block denies excepted addresses",
+			policies: []string{`{"kind": "NetworkPolicy", "metadata": {"name": "external", "namespace": "a"}, "spec": {"podSelector": {"matchLabels": {"app": "client"}}, "policyTypes": ["Egress"], "egress": [{"to": [{"ipBlock": {"cidr": "192.168.0.0/16", "except": ["192.168.1.0/24"]}}]}]}}`},
+			conn:     policyConn{aClient, "192.168.1.1", tcp, 443},
+			denied:   []string{"a/external"},
+		},
+		{
+			name:     "ip block denies addresses outside the block",
+			policies: []string{`{"kind": "NetworkPolicy", "metadata": {"name": "external", "namespace": "a"}, "spec": {"podSelector": {"matchLabels": {"app": "client"}}, "policyTypes": ["Egress"], "egress": [{"to": [{"ipBlock": {"cidr": "192.168.0.0/16", "except": ["192.168.1.0/24"]}}]}]}}`},
+			conn:     policyConn{aClient, "172.16.0.1", tcp, 443},
+			denied:   []string{"a/external"},
+		},
+		{
+			name:     "named port allows the container port",
+			policies: []string{`{"kind": "NetworkPolicy", "metadata": {"name": "http", "namespace": "a"}, "spec": {"podSelector": {"matchLabels": {"app": "web"}}, "ingress": [{"ports": [{"port": "http"}]}]}}`},
+			conn:     policyConn{bOther, aWeb, tcp, 8080},
+		},
+		{
+			name:     "named port denies other ports",
+			policies: []string{`{"kind": "NetworkPolicy", "metadata": {"name": "http", "namespace": "a"}, "spec": {"podSelector": {"matchLabels": {"app": "web"}}, "ingress": [{"ports": [{"port": "http"}]}]}}`},
+			conn:     policyConn{bOther, aWeb, tcp, 80},
+			denied:   []string{"a/http"},
+		},
+		{
+			name:     "named port denies other protocols",
+			policies: []string{`{"kind": "NetworkPolicy", "metadata": {"name": "http", "namespace": "a"}, "spec": {"podSelector": {"matchLabels": {"app": "web"}}, "ingress": [{"ports": [{"port": "http"}]}]}}`},
+			conn:     policyConn{bOther, aWeb, udp, 8080},
+			denied:   []string{"a/http"},
+		},
+		{
+			name:     "named port missing on the destination denies",
+			policies: []string{`{"kind": "NetworkPolicy", "metadata": {"name": "http", "namespace": "a"}, "spec": {"podSelector": {}, "ingress": [{"ports": [{"port": "http"}]}]}}`},
+			conn:     policyConn{bOther, aClient, tcp, 8080},
+			denied:   []string{"a/http"},
+		},
+		{
+			name:     "end port allows the range",
+			policies: []string{`{"kind": "NetworkPolicy", "metadata": {"name": "range", "namespace": "a"}, "spec": {"podSelector": {"matchLabels": {"app": "web"}}, "ingress": [{"ports": [{"protocol": "TCP", "port": 8000, "endPort": 8100}]}]}}`},
+			conn:     policyConn{bOther, aWeb, tcp, 8100},
+		},
+		{
+			name:     "end port denies ports past the range",
+			policies: []string{`{"kind": "NetworkPolicy", "metadata": {"name": "range", "namespace": "a"}, "spec": {"podSelector": {"matchLabels": {"app": "web"}}, "ingress": [{"ports": [{"protocol": "TCP", "port": 8000, "endPort": 8100}]}]}}`},
+			conn:     policyConn{bOther, aWeb, tcp, 8101},
+			denied:   []string{"a/range"},
+		},
+		{
+			name: "every isolating policy is named",
+			policies: []string{
+				`{"kind": "NetworkPolicy", "metadata": {"name": "z", "namespace": "a"}, "spec": {"podSelector": {}, "policyTypes": ["Ingress"]}}`,
+				`{"kind": "NetworkPolicy", "metadata": {"name": "y", "namespace": "a"}, "spec": {"podSelector": {"matchLabels": {"app": "web"}}, "ingress": [{"ports": [{"port": 80}]}]}}`,
+				`{"kind": "NetworkPolicy", "metadata": {"name": "x", "namespace": "b"}, "spec": {"podSelector": {}, "policyTypes": ["Egress"]}}`,
+			},
+			conn:   policyConn{bOther, aWeb, tcp, 8080},
+			denied: []string{"a/y", "a/z", "b/x"},
+		},
+		{
+			name: "any isolating policy may allow",
+			policies: []string{
+				`{"kind": "NetworkPolicy", "metadata": {"name": "z", "namespace": "a"}, "spec": {"podSelector": {}, "policyTypes": ["Ingress"]}}`,
+				`{"kind": "NetworkPolicy", "metadata": {"name": "y", "namespace": "a"}, "spec": {"podSelector": {"matchLabels": {"app": "web"}}, "ingress": [{"ports": [{"port": 8080}]}]}}`,
+			},
+			conn: policyConn{bOther, aWeb, tcp, 8080},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m := readPolicyFixture(t, test.policies...)
+			denied := m.Denied(net.ParseIP(test.conn.src), net.ParseIP(test.conn.dst), test.conn.protocol, test.conn.port)
+			if !reflect.DeepEqual(denied, test.denied) {
+				t.Fatalf("expected %v to be denied, got %v", test.denied, denied)
+			}
+		})
+	}
+}
+
+func TestReadPolicyMap(t *testing.T) {
+	m := readPolicyFixture(t,
+		`{"kind": "Pod", "metadata": {"name": "done", "namespace": "a"}, "spec": {}, "status": {"phase": "Succeeded", "podIP": "10.0.0.3"}}`,
+		`{"kind": "Pod", "metadata": {"name": "host", "namespace": "a"}, "spec": {"hostNetwork": true}, "status": {"phase": "Running", "podIP": "192.168.0.1"}}`,
+		`{"kind": "Service", "metadata": {"name": "ignored", "namespace": "a"}, "spec": {}}`,
+	)
+	if pods, policies := m.Len(); pods != 4 || policies != 0 {
+		t.Fatalf("expected finished and host network pods to be ignored, got %d pods and %d policies", pods, policies)
+	}
+
+	for _, invalid := range []string{
+		`{"kind": "NetworkPolicy", "metadata": {"name": "p", "namespace": "a"}, "spec": {"podSelector": {}, "policyTypes": ["Sideways"]}}`,
+		`{"kind": "NetworkPolicy", "metadata": {"name": "p", "namespace": "a"}, "spec": {"podSelector": {"matchExpressions": [{"key": "app", "operator": "Like"}]}}}`,
+		`{"kind": "NetworkPolicy", "metadata": {"name": "p", "namespace": "a"}, "spec": {"podSelector": {}, "ingress": [{"ports": [{"port": true}]}]}}`,
+		`{"kind": "NetworkPolicy", "metadata": {"name": "p", "namespace": "a"}, "spec": {"podSelector": {}, "ingress": [{"ports": [{"protocol": "ICMP"}]}]}}`,
+		`{"kind": "NetworkPolicy", "metadata": {"name": "p", "namespace": "a"}, "spec": {"podSelector": {}, "ingress": [{"from": [{}]}]}}`,
+		`{"kind": "NetworkPolicy", "metadata": {"name": "p", "namespace": "a"}, "spec": {"podSelector": {}, "ingress": [{"from": [{"ipBlock": {"cidr": "10.0.0.0"}}]}]}}`,
+	} {
+		if _, err := ReadPolicyMap(strings.NewReader(`{"items": [` + invalid + `]}`)); err == nil {
+			t.Errorf("expected an error for %s", invalid)
+		}
+	}
+}
+
+func TestPolicyDenials(t *testing.T) {
+	m := readPolicyFixture(t,
+		`{"kind": "NetworkPolicy", "metadata": {"name": "deny-all", "namespace": "a"}, "spec": {"podSelector": {}, "policyTypes": ["Ingress"]}}`,
+		`{"kind": "NetworkPolicy", "metadata": {"name": "web", "namespace": "a"}, "spec": {"podSelector": {"matchLabels": {"app": "web"}}, "ingress": [{"from": [{"podSelector": {"matchLabels": {"app": "client"}}}]}]}}`,
+	)
+	tracker := New(Arguments{Policies: m})
+	var events eventRecorder
+	tracker.AddObserver(&events)
+	failure := func(src, dst string) {
+		tracker.handle(&FlowEvent{
+			Type:            FlowDestroy,
+			Protocol:        unix.IPPROTO_TCP,
+			Source:          net.ParseIP(src),
+			Destination:     net.ParseIP(dst),
+			SourcePort:      40000,
+			DestinationPort: 8080,
+		})
+	}
+	// a/client is allowed by the web policy, b/other is denied by both
+	failure("10.0.0.2", "10.0.0.1")
+	failure("10.0.1.2", "10.0.0.1")
+	failure("10.0.1.2", "10.0.0.1")
+
+	if len(events) != 3 || events[0].PolicyDenied || !events[1].PolicyDenied || !reflect.DeepEqual(events[1].Policies, []string{"a/deny-all", "a/web"}) {
+		t.Fatalf("unexpected events %#v", events)
+	}
+	denials := make(map[string]uint64)
+	for _, denial := range tracker.PolicyDenials() {
+		denials[denial.IP.String()+" "+denial.Policy] = denial.Count
+	}
+	if !reflect.DeepEqual(denials, map[string]uint64{"10.0.0.1 a/deny-all": 2, "10.0.0.1 a/web": 2}) {
+		t.Fatalf("unexpected denials %v", denials)
+	}
+}
@@ -0,0 +1,207 @@
+package conntrack
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/ti-mo/conntrack"
+	"golang.org/x/sys/unix"
+)
+
+// netlinkNetfilter is the NETLINK_NETFILTER protocol, the Eth column of /proc/net/netlink.
+const netlinkNetfilter = 12
+
+// readBufferQuietPeriod is how long the receive queue must stay mostly empty before the
+// buffer is shrunk.
+const readBufferQuietPeriod = 5 * time.Minute
+
+// readBufferLimits returns the configured initial and maximum receive buffer sizes.
+func (t *ConnectionTracker) readBufferLimits() (int, int) {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	return t.args.ReadBufferSize, t.args.MaxReadBufferSize
+}
+
+// growReadBuffer doubles the receive buffer size used for the next subscription up to the
+// maximum, returning false if it is already at the maximum.
+func (t *ConnectionTracker) growReadBuffer() bool {
+	size := t.ReadBufferSize()
+	_, max := t.readBufferLimits()
+	if size >= max {
+		return false
+	}
+	size *= 2
+	if size > max {
+		size = max
+	}
+	atomic.StoreInt64(&t.readBuffer, int64(size))
+	gaugeReadBufferBytes.WithLabelValues().Set(float64(size))
+	return true
+}
+
+// tuneReadBuffer samples the receive queue of the subscribed socket every second until stop
+// is closed. The buffer is grown before it overflows when the queue passes three quarters
+// of it, and halved when the queue stays under an eighth of it for the quiet period. The
+// buffer never shrinks below the configured size.
+func (t *ConnectionTracker) tuneReadBuffer(stop <-chan struct{}, conn *conntrack.Conn) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	inode, err := socketInode(conn)
+	if err != nil {
+		listenerLog.Warn("Unable to find the netlink socket, the receive buffer will not be resized", "err", err)
+		return
+	}
+
+	var last netlinkSocket
+	var peak uint64
+	var warned bool
+	quietSince := time.Now()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		size := t.ReadBufferSize()
+		initial, max := t.readBufferLimits()
+		target := size
+		switch {
+		case size < initial:
+			target = initial
+		case size > max:
+			target = max
+		}
+
+		socket, err := findNetlinkSocket(inode)
+		if err != nil {
+			// the queue is sampled every second, so only the first failure is worth a warning
+			if !warned {
+				listenerLog.Warn("Unable to read the netlink socket queue", "err", err)
+				warned = true
+			} else {
+				listenerLog.Debug("Unable to read the netlink socket queue", "err", err)
+			}
+		} else {
+			warned = false
+			if socket.inode == last.inode && socket.drops > last.drops {
+				gaugeSocketDrops.WithLabelValues().Add(float64(socket.drops - last.drops))
+			}
+			last = socket
+			gaugeReadBufferQueued.WithLabelValues().Set(float64(socket.rmem))
+			if socket.rmem > peak {
+				peak = socket.rmem
+			}
+
+			// the kernel doubles the requested size to account for bookkeeping overhead
+			capacity := 2 * uint64(size)
+			switch {
+			case socket.rmem > capacity/4*3 && size < max:
+				target = size * 2
+				if target > max {
+					target = max
+				}
+			case time.Since(quietSince) >= readBufferQuietPeriod:
+				if peak < capacity/8 && size > initial {
+					target = size / 2
+					if target < initial {
+						target = initial
+					}
+				}
+				peak, quietSince = 0, time.Now()
+			}
+		}
+
+		if target == size {
+			continue
+		}
+		if err := conn.SetReadBufferForce(target); err != nil {
+			listenerLog.Warn("Unable to resize the receive buffer", "bytes", target, "err", err)
+			continue
+		}
+		listenerLog.Info("Resized the receive buffer", "from", size, "bytes", target)
+		atomic.StoreInt64(&t.readBuffer, int64(target))
+		gaugeReadBufferBytes.WithLabelValues().Set(float64(target))
+		peak, quietSince = 0, time.Now()
+	}
+}
+
+// netlinkSocket is a row of /proc/net/netlink.
+type netlinkSocket struct {
+	inode uint64
+	rmem  uint64
+	drops uint64
+}
+
+// socketInode returns the inode of the socket of conn, which identifies it in
+// /proc/net/netlink. Unlike the descriptors in /proc/self/fd, the socket can be found this
+// way after the process has changed its user.
+func socketInode(conn *conntrack.Conn) (uint64, error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+	var st unix.Stat_t
+	var statErr error
+	if err := raw.Control(func(fd uintptr) {
+		statErr = unix.Fstat(int(fd), &st)
+	}); err != nil {
+		return 0, err
+	}
+	if statErr != nil {
+		return 0, statErr
+	}
+	return st.Ino, nil
+}
+
+// findNetlinkSocket returns the row of /proc/net/netlink for the netfilter socket with
+// inode.
+func findNetlinkSocket(inode uint64) (netlinkSocket, error) {
+	f, err := os.Open("/proc/net/netlink")
+	if err != nil {
+		return netlinkSocket{}, err
+	}
+	defer f.Close()
+	return parseNetlinkSocket(f, inode)
+}
+
+// parseNetlinkSocket finds the netfilter socket with inode in the contents of
+// /proc/net/netlink.
+func parseNetlinkSocket(r io.Reader, inode uint64) (netlinkSocket, error) {
+	scanner := bufio.NewScanner(r)
+	// skip the header
+	scanner.Scan()
+	for scanner.Scan() {
+		// sk Eth Pid Groups Rmem Wmem Dump Locks Drops Inode
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 10 {
+			continue
+		}
+		if eth, err := strconv.Atoi(fields[1]); err != nil || eth != netlinkNetfilter {
+			continue
+		}
+		if n, err := strconv.ParseUint(fields[9], 10, 64); err != nil || n != inode {
+			continue
+		}
+		var err error
+		socket := netlinkSocket{inode: inode}
+		if socket.rmem, err = strconv.ParseUint(fields[4], 10, 64); err != nil {
+			return socket, err
+		}
+		if socket.drops, err = strconv.ParseUint(fields[8], 10, 64); err != nil {
+			return socket, err
+		}
+		return socket, nil
+	}
+	if err := scanner.Err(); err != nil {
+		return netlinkSocket{}, err
+	}
+	return netlinkSocket{}, fmt.Errorf("netfilter socket %d not found", inode)
+}
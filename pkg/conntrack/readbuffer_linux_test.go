@@ -0,0 +1,55 @@
+package conntrack
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/mdlayher/netlink"
+	"github.com/ti-mo/conntrack"
+)
+
+func TestParseNetlinkSocket(t *testing.T) {
+	const table = `sk               Eth Pid        Groups   Rmem     Wmem     Dump  Locks    Drops    Inode
+0000000000000000 0   1          00000000 0        0        0     2        0        100
+0000000000000000 12  2          00000000 0        0        0     2        0        200
+0000000000000000 12  3          0000000e 4096     0        0     2        7        300
+0000000000000000 12  4          0000000e x        0        0     2        0        400
+`
+	tests := []struct {
+		inode  uint64
+		socket netlinkSocket
+		err    bool
+	}{
+		{inode: 300, socket: netlinkSocket{inode: 300, rmem: 4096, drops: 7}},
+		{inode: 200, socket: netlinkSocket{inode: 200}},
+		// only netfilter sockets are matched
+		{inode: 100, err: true},
+		{inode: 400, err: true},
+		{inode: 500, err: true},
+	}
+	for _, test := range tests {
+		socket, err := parseNetlinkSocket(strings.NewReader(table), test.inode)
+		if (err != nil) != test.err {
+			t.Errorf("%d: unexpected error %v", test.inode, err)
+			continue
+		}
+		if err == nil && socket != test.socket {
+			t.Errorf("%d: expected %#v, got %#v", test.inode, test.socket, socket)
+		}
+	}
+}
+
+func TestSocketInode(t *testing.T) {
+	conn, err := conntrack.Dial(&netlink.Config{DisableNSLockThread: true})
+	if err != nil {
+		t.Skipf("unable to open a netfilter socket: %v", err)
+	}
+	defer conn.Close()
+	inode, err := socketInode(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := findNetlinkSocket(inode); err != nil {
+		t.Fatal(err)
+	}
+}
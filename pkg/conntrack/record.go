@@ -0,0 +1,287 @@
+package conntrack
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+// FlowEventType is the kind of conntrack event that produced a FlowEvent.
+type FlowEventType uint8
+
+// The conntrack events that are recorded.
+const (
+	FlowNew FlowEventType = iota + 1
+	FlowUpdate
+	FlowDestroy
+)
+
+// statusSeenReply is the IPS_SEEN_REPLY bit of the conntrack status.
+const statusSeenReply = 1 << 1
+
+// FlowEvent is a decoded conntrack event. Listen decodes only the parts of each event the
+// tracker needs, while Record captures every field for later replay.
+type FlowEvent struct {
+	Time time.Time
+	Type FlowEventType
+
+	Protocol        uint8
+	Source          net.IP
+	Destination     net.IP
+	SourcePort      uint16
+	DestinationPort uint16
+
+	// Status is the conntrack status bitfield, only set on destroy events by Listen.
+	Status uint32
+	// TCPState is the TCP connection state if the kernel reported it.
+	TCPState uint8
+	Zone     uint16
+
+	// The reply tuple of the connection, which differs from the original direction if the
+	// connection was translated. ReplySource is unset if the kernel did not report it.
+	ReplySource          net.IP
+	ReplyDestination     net.IP
+	ReplySourcePort      uint16
+	ReplyDestinationPort uint16
+}
+
+// SeenReply returns true if the connection has seen traffic in the reply direction.
+func (e *FlowEvent) SeenReply() bool {
+	return e.Status&statusSeenReply != 0
+}
+
+// NAT returns the address translation applied to the connection, or nil if the reply tuple
+// is unknown or mirrors the original direction.
+func (e *FlowEvent) NAT() *NAT {
+	if e.ReplySource == nil {
+		return nil
+	}
+	var nat NAT
+	var translated bool
+	if !e.ReplySource.Equal(e.Destination) || e.ReplySourcePort != e.DestinationPort {
+		nat.Destination, nat.DestinationPort = e.ReplySource, e.ReplySourcePort
+		translated = true
+	}
+	if !e.ReplyDestination.Equal(e.Source) || e.ReplyDestinationPort != e.SourcePort {
+		nat.Source, nat.SourcePort = e.ReplyDestination, e.ReplyDestinationPort
+		translated = true
+	}
+	if !translated {
+		return nil
+	}
+	return &nat
+}
+
+// recordMagic identifies a file written by a FlowWriter. The last byte is the format version,
+// and version 1 recordings without the reply tuple can still be read.
+var recordMagic = []byte("NCTREC\x00\x02")
+
+const recordVersion1 = 1
+
+// FlowWriter writes flow events in a compact binary format readable by FlowReader.
+type FlowWriter struct {
+	w    *bufio.Writer
+	last time.Time
+	buf  []byte
+}
+
+// NewFlowWriter writes the file header to w and returns a writer for flow events.
+func NewFlowWriter(w io.Writer) (*FlowWriter, error) {
+	bw := bufio.NewWriter(w)
+	if _, err := bw.Write(recordMagic); err != nil {
+		return nil, err
+	}
+	return &FlowWriter{w: bw, buf: make([]byte, 0, 64)}, nil
+}
+
+// Write appends an event. Each event is stored as the time since the previous event
+// followed by its fields.
+func (w *FlowWriter) Write(e FlowEvent) error {
+	b := w.buf[:0]
+	var delta int64
+	if !w.last.IsZero() {
+		delta = int64(e.Time.Sub(w.last))
+	} else {
+		delta = e.Time.UnixNano()
+	}
+	w.last = e.Time
+
+	var scratch [binary.MaxVarintLen64]byte
+	b = append(b, scratch[:binary.PutVarint(scratch[:], delta)]...)
+	b = append(b, byte(e.Type), e.Protocol)
+	src, dst := normalizeIP(e.Source), normalizeIP(e.Destination)
+	if len(src) != len(dst) {
+		return fmt.Errorf("source %s and destination %s are not in the same address family", e.Source, e.Destination)
+	}
+	b = append(b, byte(len(src)))
+	b = append(b, src...)
+	b = append(b, dst...)
+	b = append(b, byte(e.SourcePort>>8), byte(e.SourcePort), byte(e.DestinationPort>>8), byte(e.DestinationPort))
+	b = append(b, scratch[:binary.PutUvarint(scratch[:], uint64(e.Status))]...)
+	b = append(b, e.TCPState, byte(e.Zone>>8), byte(e.Zone))
+	replySrc, replyDst := normalizeIP(e.ReplySource), normalizeIP(e.ReplyDestination)
+	if len(replySrc) != len(replyDst) {
+		return fmt.Errorf("reply source %s and destination %s are not in the same address family", e.ReplySource, e.ReplyDestination)
+	}
+	b = append(b, byte(len(replySrc)))
+	if len(replySrc) > 0 {
+		b = append(b, replySrc...)
+		b = append(b, replyDst...)
+		b = append(b, byte(e.ReplySourcePort>>8), byte(e.ReplySourcePort), byte(e.ReplyDestinationPort>>8), byte(e.ReplyDestinationPort))
+	}
+	w.buf = b
+	_, err := w.w.Write(b)
+	return err
+}
+
+// Flush writes any buffered events to the underlying writer.
+func (w *FlowWriter) Flush() error {
+	return w.w.Flush()
+}
+
+// FlowReader reads flow events written by a FlowWriter.
+type FlowReader struct {
+	r       *bufio.Reader
+	last    time.Time
+	version byte
+}
+
+// NewFlowReader verifies the file header of r and returns a reader for flow events.
+func NewFlowReader(r io.Reader) (*FlowReader, error) {
+	br := bufio.NewReader(r)
+	header := make([]byte, len(recordMagic))
+	if _, err := io.ReadFull(br, header); err != nil {
+		return nil, fmt.Errorf("unable to read recording header: %v", err)
+	}
+	last := len(recordMagic) - 1
+	if !bytes.Equal(header[:last], recordMagic[:last]) || header[last] < recordVersion1 || header[last] > recordMagic[last] {
+		return nil, fmt.Errorf("not a recording or unsupported recording version")
+	}
+	return &FlowReader{r: br, version: header[last]}, nil
+}
+
+// Read returns the next event, or io.EOF when no events remain.
+func (r *FlowReader) Read() (FlowEvent, error) {
+	var e FlowEvent
+	delta, err := binary.ReadVarint(r.r)
+	if err != nil {
+		return e, err
+	}
+	if r.last.IsZero() {
+		e.Time = time.Unix(0, delta)
+	} else {
+		e.Time = r.last.Add(time.Duration(delta))
+	}
+	r.last = e.Time
+
+	var fixed [3]byte
+	if _, err := io.ReadFull(r.r, fixed[:]); err != nil {
+		return e, unexpectedEOF(err)
+	}
+	e.Type, e.Protocol = FlowEventType(fixed[0]), fixed[1]
+	size := int(fixed[2])
+	if size != net.IPv4len && size != net.IPv6len {
+		return e, fmt.Errorf("recording is corrupt: invalid address length %d", size)
+	}
+	addrs := make([]byte, 2*size+4)
+	if _, err := io.ReadFull(r.r, addrs); err != nil {
+		return e, unexpectedEOF(err)
+	}
+	e.Source, e.Destination = net.IP(addrs[:size]), net.IP(addrs[size:2*size])
+	e.SourcePort = binary.BigEndian.Uint16(addrs[2*size:])
+	e.DestinationPort = binary.BigEndian.Uint16(addrs[2*size+2:])
+	status, err := binary.ReadUvarint(r.r)
+	if err != nil {
+		return e, unexpectedEOF(err)
+	}
+	e.Status = uint32(status)
+	if _, err := io.ReadFull(r.r, fixed[:]); err != nil {
+		return e, unexpectedEOF(err)
+	}
+	e.TCPState = fixed[0]
+	e.Zone = binary.BigEndian.Uint16(fixed[1:])
+	if r.version == recordVersion1 {
+		return e, nil
+	}
+
+	size, err = r.readAddressLength()
+	if err != nil || size == 0 {
+		return e, err
+	}
+	addrs = make([]byte, 2*size+4)
+	if _, err := io.ReadFull(r.r, addrs); err != nil {
+		return e, unexpectedEOF(err)
+	}
+	e.ReplySource, e.ReplyDestination = net.IP(addrs[:size]), net.IP(addrs[size:2*size])
+	e.ReplySourcePort = binary.BigEndian.Uint16(addrs[2*size:])
+	e.ReplyDestinationPort = binary.BigEndian.Uint16(addrs[2*size+2:])
+	return e, nil
+}
+
+// readAddressLength reads the length of the optional addresses that follow, which may be zero.
+func (r *FlowReader) readAddressLength() (int, error) {
+	b, err := r.r.ReadByte()
+	if err != nil {
+		return 0, unexpectedEOF(err)
+	}
+	size := int(b)
+	if size != 0 && size != net.IPv4len && size != net.IPv6len {
+		return 0, fmt.Errorf("recording is corrupt: invalid address length %d", size)
+	}
+	return size, nil
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// Replay feeds the events from r through the tracker as if they had been received by
+// Listen, flushing the tracker every Interval of recorded time. Speed scales the delay
+// between events relative to when they were recorded, and zero replays as fast as possible.
+// Incomplete inbound connections are not counted, since the recording does not include the
+// addresses of the node it was taken on. It returns the number of events replayed.
+func (t *ConnectionTracker) Replay(ctx context.Context, r *FlowReader, speed float64) (int, error) {
+	var count int
+	var last, nextFlush time.Time
+	for {
+		if err := ctx.Err(); err != nil {
+			return count, err
+		}
+		e, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return count, err
+		}
+		if nextFlush.IsZero() {
+			nextFlush = e.Time.Add(t.args.Interval)
+		}
+		for !e.Time.Before(nextFlush) {
+			t.flush()
+			nextFlush = nextFlush.Add(t.args.Interval)
+		}
+		if speed > 0 && !last.IsZero() {
+			if delay := time.Duration(float64(e.Time.Sub(last)) / speed); delay > 0 {
+				select {
+				case <-time.After(delay):
+				case <-ctx.Done():
+					return count, ctx.Err()
+				}
+			}
+		}
+		last = e.Time
+		t.handle(&e)
+		count++
+	}
+	t.flush()
+	return count, nil
+}
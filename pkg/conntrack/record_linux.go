@@ -0,0 +1,112 @@
+package conntrack
+
+import (
+	"context"
+	"time"
+
+	"github.com/mdlayher/netlink"
+	"github.com/ti-mo/conntrack"
+	"github.com/ti-mo/netfilter"
+)
+
+// newFlowEvent converts the decoded parts of a conntrack flow into a FlowEvent.
+func newFlowEvent(eventType conntrack.EventType, flow *conntrack.Flow) FlowEvent {
+	e := FlowEvent{
+		Protocol:        flow.TupleOrig.Proto.Protocol,
+		Source:          flow.TupleOrig.IP.SourceAddress,
+		Destination:     flow.TupleOrig.IP.DestinationAddress,
+		SourcePort:      flow.TupleOrig.Proto.SourcePort,
+		DestinationPort: flow.TupleOrig.Proto.DestinationPort,
+		Status:          uint32(flow.Status.Value),
+		Zone:            flow.Zone,
+	}
+	switch eventType {
+	case conntrack.EventNew:
+		e.Type = FlowNew
+	case conntrack.EventUpdate:
+		e.Type = FlowUpdate
+	case conntrack.EventDestroy:
+		e.Type = FlowDestroy
+	}
+	if e.Zone == 0 {
+		e.Zone = flow.TupleOrig.Zone
+	}
+	if flow.ProtoInfo.TCP != nil {
+		e.TCPState = flow.ProtoInfo.TCP.State
+	}
+	if reply := flow.TupleReply; reply.IP.SourceAddress != nil {
+		e.ReplySource = reply.IP.SourceAddress
+		e.ReplyDestination = reply.IP.DestinationAddress
+		e.ReplySourcePort = reply.Proto.SourcePort
+		e.ReplyDestinationPort = reply.Proto.DestinationPort
+	}
+	return e
+}
+
+// Record connects to the netlink socket and writes every new, update, and destroy event
+// to w until the context is closed or the listener encounters an error. Unlike Listen, each
+// event is fully decoded so that it can be replayed later.
+func Record(ctx context.Context, w *FlowWriter) error {
+	conn, err := conntrack.Dial(&netlink.Config{DisableNSLockThread: true})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if err := conn.SetReadBufferForce(1 * 1024 * 1024); err != nil {
+		return err
+	}
+
+	events := make(chan FlowEvent, 1024)
+	errCh, err := conn.ListenRaw(1, []netfilter.NetlinkGroup{netfilter.GroupCTNew, netfilter.GroupCTUpdate, netfilter.GroupCTDestroy}, func(recv []netlink.Message) error {
+		var ev conntrack.Event
+		if err := ev.Unmarshal(recv[0]); err != nil {
+			return err
+		}
+		if ev.Flow == nil {
+			return nil
+		}
+		e := newFlowEvent(ev.Type, ev.Flow)
+		e.Time = time.Now()
+		select {
+		case events <- e:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	// drain writes the events received before the listener stopped and flushes them
+	drain := func() error {
+		close(events)
+		for e := range events {
+			if err := w.Write(e); err != nil {
+				return err
+			}
+		}
+		return w.Flush()
+	}
+	for {
+		select {
+		case e := <-events:
+			if err := w.Write(e); err != nil {
+				return err
+			}
+		case err := <-errCh:
+			if err := drain(); err != nil {
+				return err
+			}
+			if isBufferFull(err) {
+				gaugeBufferFullErrors.WithLabelValues().Inc()
+				return ErrBufferFull
+			}
+			return err
+		case <-ctx.Done():
+			conn.SetReadDeadline(time.Now())
+			<-errCh
+			return drain()
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package conntrack
+
+import (
+	"context"
+	"net"
+	"os"
+	"testing"
+)
+
+type eventRecorder []Event
+
+func (r *eventRecorder) Observe(e Event) {
+	*r = append(*r, e)
+}
+
+// testdata/replay.rec holds failed connections to 10.1.0.1:80, 10.1.0.2:443 and
+// [fd00::10]:8080 within the first interval, a completed connection to 10.1.0.3:443, and in
+// the second interval a reply from 10.1.0.2:443 and further failures to the other two.
+func TestReplay(t *testing.T) {
+	f, err := os.Open("testdata/replay.rec")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	r, err := NewFlowReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tracker := New(Arguments{})
+	var events eventRecorder
+	tracker.AddObserver(&events)
+	count, err := tracker.Replay(context.Background(), r, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 10 {
+		t.Fatalf("expected 10 events, replayed %d", count)
+	}
+
+	down := collect(t, tracker, descTargets)
+	if len(down) != 2 || down["10.1.0.1"] != 1 || down["fd00::10"] != 1 {
+		t.Fatalf("unexpected down targets %v", down)
+	}
+	var recovered []string
+	for _, e := range events {
+		if e.Type == EventRecovery {
+			recovered = append(recovered, e.IP.String())
+		}
+	}
+	if len(recovered) != 1 || recovered[0] != "10.1.0.2" {
+		t.Fatalf("expected only 10.1.0.2 to recover: %v", recovered)
+	}
+	// 10.1.0.2 was reported as down after the first interval and up after the second, and
+	// recorded IPv4 addresses are kept in their 4 byte form
+	if transitions := tracker.transitions[string(net.ParseIP("10.1.0.2").To4())]; len(transitions) != 2 {
+		t.Fatalf("expected 10.1.0.2 to go down and up, got %d transitions", len(transitions))
+	}
+}
@@ -0,0 +1,138 @@
+package conntrack
+
+import (
+	"math"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// synRetransmitTimeout is the initial retransmission timeout of a SYN, which doubles
+	// after every retransmission (TCP_TIMEOUT_INIT).
+	synRetransmitTimeout = time.Second
+	// maxHandshakes bounds the number of connections waiting for a reply.
+	maxHandshakes = 64 * 1024
+	// handshakeTimeout is how long a connection may wait for a reply before it is
+	// forgotten, longer than the default SYN retries of Linux take.
+	handshakeTimeout = 3 * time.Minute
+)
+
+// flowKey identifies a connection by its original direction.
+type flowKey struct {
+	source          string
+	destination     string
+	sourcePort      uint16
+	destinationPort uint16
+	zone            uint16
+}
+
+func newFlowKey(e *FlowEvent) flowKey {
+	return flowKey{
+		source:          string(e.Source.To16()),
+		destination:     string(e.Destination.To16()),
+		sourcePort:      e.SourcePort,
+		destinationPort: e.DestinationPort,
+		zone:            e.Zone,
+	}
+}
+
+// retryDetector estimates how many times the SYN of each connection was retransmitted
+// from the delay between the connection being created and the first reply. Conntrack does
+// not report retransmissions, so a delay of at least the initial retransmission timeout is
+// assumed to be caused by retries, each doubling the timeout. Paths with a round trip time
+// over a second are counted as retries as well. The counts are exported as counters and
+// are kept for the same reason as those of reasonCounter.
+type retryDetector struct {
+	lock       sync.Mutex
+	handshakes map[flowKey]time.Time
+	counts     map[string]uint64
+}
+
+func newRetryDetector() *retryDetector {
+	return &retryDetector{
+		handshakes: make(map[flowKey]time.Time),
+		counts:     make(map[string]uint64),
+	}
+}
+
+// opened remembers when a connection was created.
+func (d *retryDetector) opened(e *FlowEvent) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if len(d.handshakes) >= maxHandshakes {
+		return
+	}
+	d.handshakes[newFlowKey(e)] = e.Time
+}
+
+// replied estimates the retries of a connection that received its first reply, and returns
+// the number of retries.
+func (d *retryDetector) replied(e *FlowEvent, maxDestinations int) int {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	key := newFlowKey(e)
+	opened, ok := d.handshakes[key]
+	if !ok {
+		return 0
+	}
+	delete(d.handshakes, key)
+
+	retries := estimateRetries(e.Time.Sub(opened))
+	if retries == 0 {
+		return 0
+	}
+	if _, ok := d.counts[key.destination]; !ok && len(d.counts) >= maxDestinations {
+		return retries
+	}
+	d.counts[key.destination] += uint64(retries)
+	return retries
+}
+
+// closed forgets a connection that was destroyed before it received a reply.
+func (d *retryDetector) closed(e *FlowEvent) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	delete(d.handshakes, newFlowKey(e))
+}
+
+// expire forgets connections that never received a reply nor were destroyed.
+func (d *retryDetector) expire(now time.Time) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	for key, opened := range d.handshakes {
+		if now.Sub(opened) > handshakeTimeout {
+			delete(d.handshakes, key)
+		}
+	}
+}
+
+// reset forgets all connections and counts, such as when detection is disabled.
+func (d *retryDetector) reset() {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if len(d.handshakes) > 0 || len(d.counts) > 0 {
+		d.handshakes = make(map[flowKey]time.Time)
+		d.counts = make(map[string]uint64)
+	}
+}
+
+// estimateRetries returns the number of SYN retransmissions that fit within delay.
+func estimateRetries(delay time.Duration) int {
+	if delay < synRetransmitTimeout {
+		return 0
+	}
+	return int(math.Log2(float64(delay)/float64(synRetransmitTimeout) + 1))
+}
+
+// SynRetries returns the estimated number of SYN retries of connections to each
+// destination.
+func (t *ConnectionTracker) SynRetries() map[string]uint64 {
+	t.retries.lock.Lock()
+	defer t.retries.lock.Unlock()
+	counts := make(map[string]uint64, len(t.retries.counts))
+	for dst, count := range t.retries.counts {
+		counts[net.IP(dst).String()] = count
+	}
+	return counts
+}
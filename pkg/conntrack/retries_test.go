@@ -0,0 +1,82 @@
+package conntrack
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestEstimateRetries(t *testing.T) {
+	tests := []struct {
+		delay   time.Duration
+		retries int
+	}{
+		{delay: 0},
+		{delay: 999 * time.Millisecond},
+		// the first retransmission is sent after one second, the second after three
+		{delay: time.Second, retries: 1},
+		{delay: 2999 * time.Millisecond, retries: 1},
+		{delay: 3 * time.Second, retries: 2},
+		{delay: 7 * time.Second, retries: 3},
+		{delay: 15 * time.Second, retries: 4},
+		{delay: 127 * time.Second, retries: 7},
+	}
+	for _, test := range tests {
+		if retries := estimateRetries(test.delay); retries != test.retries {
+			t.Errorf("%s: expected %d retries, got %d", test.delay, test.retries, retries)
+		}
+	}
+}
+
+func TestRetryDetector(t *testing.T) {
+	start := time.Unix(1600000000, 0)
+	flow := func(dst string, sport uint16, after time.Duration) *FlowEvent {
+		return &FlowEvent{
+			Time:            start.Add(after),
+			Source:          net.ParseIP("10.0.0.1"),
+			Destination:     net.ParseIP(dst),
+			SourcePort:      sport,
+			DestinationPort: 443,
+		}
+	}
+
+	d := newRetryDetector()
+	d.opened(flow("10.1.0.1", 40000, 0))
+	d.opened(flow("10.1.0.1", 40001, 0))
+	d.opened(flow("10.1.0.1", 40002, 0))
+	d.opened(flow("10.1.0.2", 40003, 0))
+	d.opened(flow("10.1.0.3", 40004, 0))
+
+	if retries := d.replied(flow("10.1.0.1", 40000, 100*time.Millisecond), 2); retries != 0 {
+		t.Fatalf("expected a prompt reply to have no retries, got %d", retries)
+	}
+	if retries := d.replied(flow("10.1.0.1", 40001, 3*time.Second), 2); retries != 2 {
+		t.Fatalf("expected 2 retries, got %d", retries)
+	}
+	if retries := d.replied(flow("10.1.0.1", 40001, 4*time.Second), 2); retries != 0 {
+		t.Fatalf("expected only the first reply to be counted, got %d", retries)
+	}
+	d.closed(flow("10.1.0.1", 40002, time.Second))
+	if retries := d.replied(flow("10.1.0.1", 40002, 7*time.Second), 2); retries != 0 {
+		t.Fatalf("expected a destroyed connection to be forgotten, got %d", retries)
+	}
+	d.replied(flow("10.1.0.2", 40003, time.Second), 2)
+	// the retries of destinations beyond the maximum are estimated but not counted
+	if retries := d.replied(flow("10.1.0.3", 40004, time.Second), 2); retries != 1 {
+		t.Fatalf("expected 1 retry, got %d", retries)
+	}
+	if len(d.counts) != 2 || d.counts[string(net.ParseIP("10.1.0.1"))] != 2 || d.counts[string(net.ParseIP("10.1.0.2"))] != 1 {
+		t.Fatalf("unexpected counts %v", d.counts)
+	}
+
+	// connections that never complete are forgotten, counts are not
+	d.opened(flow("10.1.0.1", 40005, 0))
+	d.expire(start.Add(handshakeTimeout + time.Second))
+	if len(d.handshakes) != 0 || len(d.counts) != 2 {
+		t.Fatalf("expected only the handshake to expire: %d handshakes, %d counts", len(d.handshakes), len(d.counts))
+	}
+	d.reset()
+	if len(d.counts) != 0 {
+		t.Fatal("expected reset to forget the counts")
+	}
+}
@@ -0,0 +1,161 @@
+package conntrack
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// ScanDetection configures how sources that may be scanning the network are detected. A
+// source is a suspect if, within Window, its unreplied connections reach at least
+// Addresses distinct destination addresses or at least Ports distinct ports on a single
+// destination address. Ports are counted per destination so that a client of many services
+// on different addresses is not mistaken for a port scan.
+type ScanDetection struct {
+	Window    time.Duration
+	Addresses int
+	Ports     int
+	// Exclude stops recording the failures of suspects, so that a scan does not fill the
+	// down target tables. Failures recorded before the source was detected expire
+	// normally.
+	Exclude bool
+}
+
+// WithDefaults sets default values for scan detection.
+func (s ScanDetection) WithDefaults() ScanDetection {
+	if s.Window == 0 {
+		s.Window = time.Minute
+	}
+	if s.Addresses == 0 {
+		s.Addresses = 64
+	}
+	if s.Ports == 0 {
+		s.Ports = 64
+	}
+	return s
+}
+
+// scanDetector counts the distinct destinations of the unreplied connections of each
+// source within a window.
+type scanDetector struct {
+	lock     sync.Mutex
+	sources  map[string]*scanWindow
+	suspects map[string]scanSuspect
+}
+
+// scanWindow is the activity of a single source since start, as the set of ports of each
+// destination address. The sets stop growing once they reach the thresholds.
+type scanWindow struct {
+	start     time.Time
+	addresses map[string]map[uint16]struct{}
+	// ports is the largest number of ports seen on a single address
+	ports int
+}
+
+// scanSuspect is a source that reached a threshold, reported until expires.
+type scanSuspect struct {
+	addresses int
+	ports     int
+	expires   time.Time
+}
+
+func newScanDetector() *scanDetector {
+	return &scanDetector{
+		sources:  make(map[string]*scanWindow),
+		suspects: make(map[string]scanSuspect),
+	}
+}
+
+// failure records an unreplied connection from src and returns true if src is a suspect.
+// At most maxSources sources are counted at once.
+func (d *scanDetector) failure(opts ScanDetection, maxSources int, now time.Time, src, dst net.IP, port uint16) bool {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	key := string(src)
+	w, ok := d.sources[key]
+	if !ok || now.Sub(w.start) > opts.Window {
+		if !ok && len(d.sources) >= maxSources {
+			_, suspect := d.suspects[key]
+			return suspect
+		}
+		w = &scanWindow{
+			start:     now,
+			addresses: make(map[string]map[uint16]struct{}),
+		}
+		d.sources[key] = w
+	}
+	ports, ok := w.addresses[string(dst)]
+	if !ok && len(w.addresses) < opts.Addresses {
+		ports = make(map[uint16]struct{})
+		w.addresses[string(dst)] = ports
+	}
+	if ports != nil && len(ports) < opts.Ports {
+		ports[port] = struct{}{}
+		if len(ports) > w.ports {
+			w.ports = len(ports)
+		}
+	}
+	if len(w.addresses) < opts.Addresses && w.ports < opts.Ports {
+		_, suspect := d.suspects[key]
+		return suspect
+	}
+
+	if _, ok := d.suspects[key]; !ok {
+		trackerLog.Info("Source may be scanning", "src", src, "addresses", len(w.addresses), "ports", w.ports, "window", opts.Window)
+	}
+	d.suspects[key] = scanSuspect{
+		addresses: len(w.addresses),
+		ports:     w.ports,
+		expires:   w.start.Add(2 * opts.Window),
+	}
+	return true
+}
+
+// expire forgets windows that have ended and suspects that have not reached a threshold
+// in the window after they were detected.
+func (d *scanDetector) expire(opts ScanDetection, now time.Time) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	for key, w := range d.sources {
+		if now.Sub(w.start) > opts.Window {
+			delete(d.sources, key)
+		}
+	}
+	for key, suspect := range d.suspects {
+		if now.After(suspect.expires) {
+			trackerLog.Info("Source is no longer suspected of scanning", "src", net.IP(key))
+			delete(d.suspects, key)
+		}
+	}
+}
+
+// reset forgets all sources, such as when detection is disabled.
+func (d *scanDetector) reset() {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if len(d.sources) > 0 || len(d.suspects) > 0 {
+		d.sources = make(map[string]*scanWindow)
+		d.suspects = make(map[string]scanSuspect)
+	}
+}
+
+// ScanSuspect is a source suspected of scanning, with the number of distinct destination
+// addresses and the largest number of distinct ports on one address it failed to connect
+// to in the window it was detected.
+type ScanSuspect struct {
+	Source    net.IP
+	Addresses int
+	Ports     int
+}
+
+// ScanSuspects returns the sources currently suspected of scanning.
+func (t *ConnectionTracker) ScanSuspects() []ScanSuspect {
+	t.scans.lock.Lock()
+	defer t.scans.lock.Unlock()
+	suspects := make([]ScanSuspect, 0, len(t.scans.suspects))
+	for key, suspect := range t.scans.suspects {
+		suspects = append(suspects, ScanSuspect{Source: net.IP(key), Addresses: suspect.addresses, Ports: suspect.ports})
+	}
+	return suspects
+}
@@ -0,0 +1,64 @@
+package conntrack
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestScanDetector(t *testing.T) {
+	opts := ScanDetection{Window: time.Minute, Addresses: 3, Ports: 3}
+	src := net.ParseIP("10.0.0.1")
+	start := time.Unix(1600000000, 0)
+
+	tests := []struct {
+		name    string
+		dsts    []string
+		ports   []uint16
+		suspect bool
+	}{
+		{name: "one port on each of too few addresses", dsts: []string{"10.1.0.1", "10.1.0.2"}, ports: []uint16{80, 443}},
+		{name: "many addresses", dsts: []string{"10.1.0.1", "10.1.0.2", "10.1.0.3"}, ports: []uint16{80, 80, 80}, suspect: true},
+		{name: "many ports on one address", dsts: []string{"10.1.0.1", "10.1.0.1", "10.1.0.1"}, ports: []uint16{22, 80, 443}, suspect: true},
+		{name: "repeated port on one address", dsts: []string{"10.1.0.1", "10.1.0.1", "10.1.0.1", "10.1.0.1"}, ports: []uint16{80, 80, 80, 80}},
+		{name: "ports spread across addresses", dsts: []string{"10.1.0.1", "10.1.0.1", "10.1.0.2", "10.1.0.2"}, ports: []uint16{22, 80, 443, 8080}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			d := newScanDetector()
+			var suspect bool
+			for i, dst := range test.dsts {
+				suspect = d.failure(opts, 10, start.Add(time.Duration(i)*time.Second), src, net.ParseIP(dst), test.ports[i])
+			}
+			if suspect != test.suspect {
+				t.Fatalf("expected suspect %t, got %t", test.suspect, suspect)
+			}
+		})
+	}
+}
+
+func TestScanDetectorExpire(t *testing.T) {
+	opts := ScanDetection{Window: time.Minute, Addresses: 2, Ports: 2}
+	src := net.ParseIP("10.0.0.1")
+	start := time.Unix(1600000000, 0)
+
+	d := newScanDetector()
+	d.failure(opts, 10, start, src, net.ParseIP("10.1.0.1"), 80)
+	if !d.failure(opts, 10, start, src, net.ParseIP("10.1.0.2"), 80) {
+		t.Fatal("expected a suspect after reaching the address threshold")
+	}
+
+	// a failure in the next window keeps the source a suspect until it expires
+	if !d.failure(opts, 10, start.Add(90*time.Second), src, net.ParseIP("10.1.0.1"), 80) {
+		t.Fatal("expected the source to remain a suspect within twice the window")
+	}
+	d.expire(opts, start.Add(121*time.Second))
+	if len(d.suspects) != 0 || len(d.sources) != 1 {
+		t.Fatalf("expected the suspect to expire and the new window to remain: %d suspects, %d sources", len(d.suspects), len(d.sources))
+	}
+
+	// sources beyond the limit are not counted
+	if d.failure(opts, 1, start.Add(121*time.Second), net.ParseIP("10.0.0.2"), net.ParseIP("10.1.0.1"), 80) || len(d.sources) != 1 {
+		t.Fatal("expected sources beyond the limit to be ignored")
+	}
+}
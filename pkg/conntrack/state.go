@@ -0,0 +1,168 @@
+package conntrack
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// stateVersion is the version of the snapshot format written by SaveState.
+const stateVersion = 1
+
+// trackerState is the persisted form of the destinations a tracker is watching.
+type trackerState struct {
+	Version  int                `json:"version"`
+	Time     time.Time          `json:"time"`
+	Interval time.Duration      `json:"interval"`
+	Down     []destinationState `json:"down"`
+	Current  []destinationState `json:"current"`
+}
+
+type destinationState struct {
+	IP          string            `json:"ip"`
+	Up          bool              `json:"up"`
+	Connections []connectionState `json:"connections"`
+}
+
+type connectionState struct {
+	Protocol uint8       `json:"proto"`
+	Port     uint16      `json:"port"`
+	Failure  UIntCounter `json:"failure"`
+	Success  UIntCounter `json:"success"`
+	Unknown  UIntCounter `json:"unknown"`
+}
+
+// SaveState writes a versioned JSON snapshot of the destinations the tracker is watching to
+// w, so that a restarted tracker can continue to report ongoing outages.
+func (t *ConnectionTracker) SaveState(w io.Writer) error {
+	t.lock.RLock()
+	state := trackerState{
+		Version:  stateVersion,
+		Time:     time.Now(),
+		Interval: t.args.Interval,
+		Down:     snapshotDestinations(t.down),
+		Current:  snapshotDestinations(t.current),
+	}
+	t.lock.RUnlock()
+	return json.NewEncoder(w).Encode(state)
+}
+
+func snapshotDestinations(m map[string]DestinationState) []destinationState {
+	states := make([]destinationState, 0, len(m))
+	for dst, state := range m {
+		s := destinationState{IP: net.IP(dst).String(), Up: state.Up}
+		for target, stats := range state.Connections {
+			s.Connections = append(s.Connections, connectionState{
+				Protocol: target.Protocol,
+				Port:     target.Port,
+				Failure:  stats.Failure,
+				Success:  stats.Success,
+				Unknown:  stats.Unknown,
+			})
+		}
+		states = append(states, s)
+	}
+	return states
+}
+
+// RestoreState replaces the destinations of the tracker with a snapshot written by
+// SaveState. The snapshot is aged by flushing once for every interval that passed since it
+// was written, so destinations that would have expired while the tracker was stopped are
+// dropped. It must be invoked before Listen.
+func (t *ConnectionTracker) RestoreState(r io.Reader) error {
+	var state trackerState
+	if err := json.NewDecoder(r).Decode(&state); err != nil {
+		return fmt.Errorf("unable to decode tracker state: %v", err)
+	}
+	if state.Version != stateVersion {
+		return fmt.Errorf("unsupported tracker state version %d", state.Version)
+	}
+	down, err := restoreDestinations(state.Down)
+	if err != nil {
+		return err
+	}
+	current, err := restoreDestinations(state.Current)
+	if err != nil {
+		return err
+	}
+
+	t.lock.Lock()
+	t.down, t.current = down, current
+	interval, expireAfter := t.args.Interval, int(t.args.ExpireAfter)
+	t.lock.Unlock()
+
+	if state.Interval > 0 {
+		interval = state.Interval
+	}
+	// once every destination has gone ExpireAfter intervals without events, further
+	// flushes change nothing
+	elapsed := int(time.Since(state.Time) / interval)
+	if elapsed > expireAfter+1 {
+		elapsed = expireAfter + 1
+	}
+	for i := 0; i < elapsed; i++ {
+		t.flush()
+	}
+	return nil
+}
+
+func restoreDestinations(states []destinationState) (map[string]DestinationState, error) {
+	m := make(map[string]DestinationState, len(states))
+	for _, s := range states {
+		// events carry IPv4 addresses in their 4 byte form
+		ip := normalizeIP(net.ParseIP(s.IP))
+		if ip == nil {
+			return nil, fmt.Errorf("tracker state has an invalid address %q", s.IP)
+		}
+		state := DestinationState{Up: s.Up}
+		if len(s.Connections) > 0 {
+			state.Connections = make(ConnectionStateMap, len(s.Connections))
+			for _, c := range s.Connections {
+				state.Connections[DestinationKey{Protocol: c.Protocol, Port: c.Port}] = DestinationStatistics{
+					Failure: c.Failure,
+					Success: c.Success,
+					Unknown: c.Unknown,
+				}
+			}
+		}
+		m[string(ip)] = state
+	}
+	return m, nil
+}
+
+// SaveStateFile writes a snapshot of the tracker to path, replacing any previous snapshot
+// atomically.
+func (t *ConnectionTracker) SaveStateFile(path string) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if err := t.SaveState(f); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// RestoreStateFile restores the tracker from the snapshot at path. It returns an error
+// satisfying os.IsNotExist if no snapshot has been written.
+func (t *ConnectionTracker) RestoreStateFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := t.RestoreState(f); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	return nil
+}
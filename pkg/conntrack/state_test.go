@@ -0,0 +1,105 @@
+package conntrack
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/sys/unix"
+)
+
+func TestStateRoundTrip(t *testing.T) {
+	failure := func(tracker *ConnectionTracker, dst net.IP, port uint16) {
+		tracker.handle(&FlowEvent{
+			Type:            FlowDestroy,
+			Protocol:        unix.IPPROTO_TCP,
+			Source:          net.ParseIP("10.0.0.1").To4(),
+			Destination:     dst,
+			SourcePort:      40000,
+			DestinationPort: port,
+		})
+	}
+	v4, v6 := net.ParseIP("10.1.0.1").To4(), net.ParseIP("fd00::10")
+
+	tracker := New(Arguments{})
+	failure(tracker, v4, 80)
+	failure(tracker, v6, 443)
+	tracker.flush()
+	var buf bytes.Buffer
+	if err := tracker.SaveState(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	restored := New(Arguments{})
+	if err := restored.RestoreState(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if len(restored.down) != 2 {
+		t.Fatalf("unexpected down destinations %v", restored.down)
+	}
+	// failures after the restore update the restored destinations, whichever form of the
+	// address they carry
+	failure(restored, v4, 80)
+	failure(restored, net.ParseIP("10.1.0.1"), 8080)
+	failure(restored, v6, 443)
+	restored.flush()
+	if len(restored.down) != 2 || len(restored.down[string(v4)].Connections) != 2 {
+		t.Fatalf("expected the restored destinations to be reused: %v", restored.down)
+	}
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(restored)
+	if _, err := registry.Gather(); err != nil {
+		t.Fatal(err)
+	}
+	if down := collect(t, restored, descTargets); len(down) != 2 || down["10.1.0.1"] != 1 || down["fd00::10"] != 1 {
+		t.Fatalf("unexpected down targets %v", down)
+	}
+
+	// a recovery clears the restored destination
+	restored.handle(&FlowEvent{
+		Type:            FlowUpdate,
+		Protocol:        unix.IPPROTO_TCP,
+		Source:          net.ParseIP("10.0.0.1").To4(),
+		Destination:     v4,
+		SourcePort:      40001,
+		DestinationPort: 80,
+		Status:          statusSeenReply,
+	})
+	restored.handle(&FlowEvent{
+		Type:            FlowUpdate,
+		Protocol:        unix.IPPROTO_TCP,
+		Source:          net.ParseIP("10.0.0.1").To4(),
+		Destination:     v4,
+		SourcePort:      40002,
+		DestinationPort: 8080,
+		Status:          statusSeenReply,
+	})
+	restored.flush()
+	if _, ok := restored.down[string(v4)]; ok {
+		t.Fatalf("expected 10.1.0.1 to recover: %v", restored.down)
+	}
+}
+
+func TestRestoreStateAged(t *testing.T) {
+	tracker := New(Arguments{Interval: time.Second, ExpireAfter: 2})
+	state := `{"version":1,"time":"2020-09-13T12:26:40Z","interval":1000000000,"down":[{"ip":"10.1.0.1","connections":[{"proto":6,"port":80,"failure":0}]}]}`
+	if err := tracker.RestoreState(bytes.NewBufferString(state)); err != nil {
+		t.Fatal(err)
+	}
+	if len(tracker.down) != 0 {
+		t.Fatalf("expected a stale snapshot to expire: %v", tracker.down)
+	}
+
+	for _, state := range []string{
+		`{"version":2}`,
+		`{"version":1,"down":[{"ip":"10.1.0"}]}`,
+		`[]`,
+	} {
+		if err := tracker.RestoreState(bytes.NewBufferString(state)); err == nil {
+			t.Errorf("expected an error for %s", state)
+		}
+	}
+}
@@ -2,7 +2,6 @@ package conntrack
 
 import (
 	"math"
-	_ "net/http/pprof"
 )
 
 type DestinationKey struct {
@@ -64,3 +63,17 @@ func (t ConnectionStateMap) Success(protocol uint8, port uint16) (UIntCounter, U
 	t[key] = stats
 	return stats.Failure, stats.Success, true
 }
+
+// TCP connection states reported by the kernel (enum tcp_conntrack).
+const (
+	tcpStateNone uint8 = iota
+	tcpStateSynSent
+	tcpStateSynRecv
+	tcpStateEstablished
+	tcpStateFinWait
+	tcpStateCloseWait
+	tcpStateLastAck
+	tcpStateTimeWait
+	tcpStateClose
+	tcpStateSynSent2
+)
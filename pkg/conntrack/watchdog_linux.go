@@ -0,0 +1,110 @@
+package conntrack
+
+import (
+	"io/ioutil"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/mdlayher/netlink"
+	"github.com/ti-mo/conntrack"
+)
+
+// eventsSysctl controls whether the kernel delivers conntrack events.
+const eventsSysctl = "/proc/sys/net/netfilter/nf_conntrack_events"
+
+// watchdog closes stalled if Listen has received no events for the stall timeout although
+// the conntrack table shows new connections that must have generated update events. It
+// only acts once the tracker has received at least one event, so idle nodes that have
+// never seen traffic are not restarted.
+func (t *ConnectionTracker) watchdog(stop <-chan struct{}, stalled chan<- struct{}) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	var previous map[uint32]struct{}
+	var checked time.Time
+	var warned bool
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		timeout := t.stallTimeout()
+		last := t.LastEvent()
+		if timeout <= 0 || last.IsZero() {
+			previous = nil
+			continue
+		}
+		if started := time.Unix(0, atomic.LoadInt64(&t.started)); last.Before(started) {
+			last = started
+		}
+		if time.Since(last) < timeout {
+			previous = nil
+			continue
+		}
+		// verify at most once per timeout while idle
+		if time.Since(checked) < timeout {
+			continue
+		}
+		checked = time.Now()
+
+		if data, err := ioutil.ReadFile(eventsSysctl); err == nil && strings.TrimSpace(string(data)) == "0" {
+			if !warned {
+				listenerLog.Warn("No conntrack events received because the kernel is not generating them, events must be enabled for the tracker to work", "idle", timeout, "sysctl", eventsSysctl)
+				warned = true
+			}
+			continue
+		}
+		warned = false
+
+		current, err := repliedFlows()
+		if err != nil {
+			listenerLog.Warn("Unable to verify conntrack event delivery", "err", err)
+			continue
+		}
+		if previous != nil && repliedSince(previous, current) {
+			close(stalled)
+			return
+		}
+		previous = current
+	}
+}
+
+// repliedFlows returns the IDs of the flows in the conntrack table that have seen a reply,
+// each of which generated an update event when the reply arrived.
+func repliedFlows() (map[uint32]struct{}, error) {
+	conn, err := conntrack.Dial(&netlink.Config{DisableNSLockThread: true})
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	flows, err := conn.DumpFilter(conntrack.Filter{})
+	if err != nil {
+		return nil, err
+	}
+	return repliedFlowIDs(flows), nil
+}
+
+// repliedFlowIDs returns the IDs of the flows that have seen a reply.
+func repliedFlowIDs(flows []conntrack.Flow) map[uint32]struct{} {
+	ids := make(map[uint32]struct{}, len(flows))
+	for _, flow := range flows {
+		if flow.Status.SeenReply() {
+			ids[flow.ID] = struct{}{}
+		}
+	}
+	return ids
+}
+
+// repliedSince returns true if current holds a replied flow that previous did not, whose
+// update event should have been received. Flows that were destroyed in between are ignored.
+func repliedSince(previous, current map[uint32]struct{}) bool {
+	for id := range current {
+		if _, ok := previous[id]; !ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,56 @@
+package conntrack
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/ti-mo/conntrack"
+)
+
+func TestRepliedFlowIDs(t *testing.T) {
+	flows := []conntrack.Flow{
+		{ID: 1, Status: conntrack.Status{Value: conntrack.StatusSeenReply}},
+		{ID: 2},
+		{ID: 3, Status: conntrack.Status{Value: conntrack.StatusSeenReply | conntrack.StatusAssured}},
+		{ID: 4, Status: conntrack.Status{Value: conntrack.StatusAssured}},
+	}
+	ids := repliedFlowIDs(flows)
+	if len(ids) != 2 {
+		t.Fatalf("unexpected IDs %v", ids)
+	}
+	for _, id := range []uint32{1, 3} {
+		if _, ok := ids[id]; !ok {
+			t.Errorf("expected flow %d to be replied", id)
+		}
+	}
+}
+
+func TestRepliedSince(t *testing.T) {
+	ids := func(values ...uint32) map[uint32]struct{} {
+		m := make(map[uint32]struct{})
+		for _, id := range values {
+			m[id] = struct{}{}
+		}
+		return m
+	}
+	tests := []struct {
+		previous, current map[uint32]struct{}
+		stalled           bool
+	}{
+		{previous: ids(), current: ids()},
+		{previous: ids(1, 2), current: ids(1, 2)},
+		// destroyed flows do not generate update events that could have been missed
+		{previous: ids(1, 2), current: ids(1)},
+		{previous: ids(1, 2), current: ids()},
+		{previous: ids(1), current: ids(1, 2), stalled: true},
+		{previous: ids(), current: ids(3), stalled: true},
+		// a flow replaced by another with a new ID was replied to in between
+		{previous: ids(1, 2), current: ids(1, 3), stalled: true},
+	}
+	for _, test := range tests {
+		name := fmt.Sprintf("%v to %v", test.previous, test.current)
+		if stalled := repliedSince(test.previous, test.current); stalled != test.stalled {
+			t.Errorf("%s: expected %t, got %t", name, test.stalled, stalled)
+		}
+	}
+}
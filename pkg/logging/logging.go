@@ -0,0 +1,337 @@
+// package logging writes leveled, structured log lines as logfmt or JSON. Each subsystem
+// gets its own named Logger whose verbosity can be set independently, and messages below
+// the warning level can be sampled so that per-event logging can be left on without
+// overwhelming the log pipeline of a busy node.
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Level is the severity of a log message. Higher levels are more verbose.
+type Level int32
+
+// The supported log levels.
+const (
+	LevelError Level = iota
+	LevelWarn
+	LevelInfo
+	LevelDebug
+)
+
+var levelNames = []string{"error", "warn", "info", "debug"}
+
+func (l Level) String() string {
+	if l < 0 || int(l) >= len(levelNames) {
+		return strconv.Itoa(int(l))
+	}
+	return levelNames[l]
+}
+
+// ParseLevel converts a level name such as "debug" into a Level.
+func ParseLevel(s string) (Level, error) {
+	for i, name := range levelNames {
+		if strings.EqualFold(s, name) {
+			return Level(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown log level %q, must be one of %s", s, strings.Join(levelNames, ", "))
+}
+
+// Format is the encoding of log lines.
+type Format string
+
+// The supported log formats.
+const (
+	FormatLogfmt Format = "logfmt"
+	FormatJSON   Format = "json"
+)
+
+// Config controls how and what the loggers write.
+type Config struct {
+	// Output receives the log lines, defaulting to standard error.
+	Output io.Writer
+	// Format is the encoding of log lines, defaulting to logfmt.
+	Format Format
+	// Level is the most verbose level written by subsystems without their own level.
+	Level Level
+	// Subsystems overrides Level for the named subsystems.
+	Subsystems map[string]Level
+	// SampleFirst and SampleThereafter limit each distinct message of a subsystem below the
+	// warning level to the first SampleFirst lines in every second and then every
+	// SampleThereafter line. Sampling is disabled if SampleFirst is zero.
+	SampleFirst      int
+	SampleThereafter int
+}
+
+// ParseSubsystemLevels parses a comma delimited list of subsystem=level pairs, such as
+// "tracker=debug,listener=warn".
+func ParseSubsystemLevels(s string) (map[string]Level, error) {
+	levels := make(map[string]Level)
+	for _, pair := range strings.Split(s, ",") {
+		if len(strings.TrimSpace(pair)) == 0 {
+			continue
+		}
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || len(parts[0]) == 0 {
+			return nil, fmt.Errorf("subsystem levels must be of the form NAME=LEVEL: %q", pair)
+		}
+		level, err := ParseLevel(parts[1])
+		if err != nil {
+			return nil, err
+		}
+		levels[strings.TrimSpace(parts[0])] = level
+	}
+	return levels, nil
+}
+
+// output is the shared destination of every logger.
+type output struct {
+	lock   sync.Mutex
+	w      io.Writer
+	format Format
+	buf    bytes.Buffer
+
+	sampleFirst      int
+	sampleThereafter int
+}
+
+var (
+	lock    sync.Mutex
+	current = &output{w: os.Stderr, format: FormatLogfmt}
+	config  = Config{Level: LevelInfo}
+	loggers = make(map[string]*Logger)
+)
+
+// Configure replaces the configuration of every logger, including loggers that have
+// already been created.
+func Configure(cfg Config) error {
+	switch cfg.Format {
+	case "":
+		cfg.Format = FormatLogfmt
+	case FormatLogfmt, FormatJSON:
+	default:
+		return fmt.Errorf("unknown log format %q, must be %s or %s", cfg.Format, FormatLogfmt, FormatJSON)
+	}
+	if cfg.Output == nil {
+		cfg.Output = os.Stderr
+	}
+	if cfg.SampleFirst < 0 || cfg.SampleThereafter < 0 {
+		return fmt.Errorf("log sampling may not be negative")
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	config = cfg
+	current.lock.Lock()
+	current.w = cfg.Output
+	current.format = cfg.Format
+	current.sampleFirst = cfg.SampleFirst
+	current.sampleThereafter = cfg.SampleThereafter
+	current.lock.Unlock()
+	for name, l := range loggers {
+		atomic.StoreInt32(&l.level, int32(levelFor(name)))
+	}
+	return nil
+}
+
+func levelFor(subsystem string) Level {
+	if level, ok := config.Subsystems[subsystem]; ok {
+		return level
+	}
+	return config.Level
+}
+
+// Logger writes messages for a single subsystem. It is safe for concurrent use.
+type Logger struct {
+	level     int32
+	subsystem string
+
+	lock    sync.Mutex
+	samples map[string]*sample
+}
+
+type sample struct {
+	second int64
+	count  int
+}
+
+// Named returns the logger for a subsystem, creating it if necessary.
+func Named(subsystem string) *Logger {
+	lock.Lock()
+	defer lock.Unlock()
+	if l, ok := loggers[subsystem]; ok {
+		return l
+	}
+	l := &Logger{level: int32(levelFor(subsystem)), subsystem: subsystem}
+	loggers[subsystem] = l
+	return l
+}
+
+// Enabled returns true if messages at level are written, so that expensive fields can be
+// computed only when they are needed.
+func (l *Logger) Enabled(level Level) bool {
+	return level <= Level(atomic.LoadInt32(&l.level))
+}
+
+// Error logs a message with alternating keys and values at the error level.
+func (l *Logger) Error(msg string, keysAndValues ...interface{}) {
+	l.log(LevelError, msg, keysAndValues)
+}
+
+// Warn logs a message with alternating keys and values at the warning level.
+func (l *Logger) Warn(msg string, keysAndValues ...interface{}) {
+	l.log(LevelWarn, msg, keysAndValues)
+}
+
+// Info logs a message with alternating keys and values at the info level.
+func (l *Logger) Info(msg string, keysAndValues ...interface{}) {
+	l.log(LevelInfo, msg, keysAndValues)
+}
+
+// Debug logs a message with alternating keys and values at the debug level.
+func (l *Logger) Debug(msg string, keysAndValues ...interface{}) {
+	l.log(LevelDebug, msg, keysAndValues)
+}
+
+// Fatal logs a message at the error level and exits the process without running deferred
+// functions, so it should only be called before anything needs to be cleaned up.
+func (l *Logger) Fatal(msg string, keysAndValues ...interface{}) {
+	l.log(LevelError, msg, keysAndValues)
+	os.Exit(1)
+}
+
+func (l *Logger) log(level Level, msg string, keysAndValues []interface{}) {
+	if !l.Enabled(level) {
+		return
+	}
+	now := time.Now()
+	if level > LevelWarn && !l.sampled(msg, now) {
+		return
+	}
+	current.write(now, level, l.subsystem, msg, keysAndValues)
+}
+
+// sampled returns true if the message should be written under the sampling policy.
+func (l *Logger) sampled(msg string, now time.Time) bool {
+	current.lock.Lock()
+	first, thereafter := current.sampleFirst, current.sampleThereafter
+	current.lock.Unlock()
+	if first == 0 {
+		return true
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.samples == nil {
+		l.samples = make(map[string]*sample)
+	}
+	s, ok := l.samples[msg]
+	if !ok {
+		s = &sample{}
+		l.samples[msg] = s
+	}
+	if second := now.Unix(); s.second != second {
+		s.second, s.count = second, 0
+	}
+	s.count++
+	if s.count <= first {
+		return true
+	}
+	return thereafter > 0 && (s.count-first)%thereafter == 0
+}
+
+func (o *output) write(now time.Time, level Level, subsystem, msg string, keysAndValues []interface{}) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	b := &o.buf
+	b.Reset()
+	fields := []interface{}{"time", now.UTC().Format(time.RFC3339Nano), "level", level.String(), "subsystem", subsystem, "msg", msg}
+	fields = append(fields, keysAndValues...)
+	if len(fields)%2 != 0 {
+		fields = append(fields, "(missing)")
+	}
+	switch o.format {
+	case FormatJSON:
+		writeJSON(b, fields)
+	default:
+		writeLogfmt(b, fields)
+	}
+	b.WriteByte('\n')
+	o.w.Write(b.Bytes())
+}
+
+func writeLogfmt(b *bytes.Buffer, fields []interface{}) {
+	for i := 0; i < len(fields); i += 2 {
+		if i > 0 {
+			b.WriteByte(' ')
+		}
+		b.WriteString(fmt.Sprint(fields[i]))
+		b.WriteByte('=')
+		s := format(fields[i+1])
+		if len(s) == 0 || strings.ContainsAny(s, " =\"\t\r\n\\") {
+			s = strconv.Quote(s)
+		}
+		b.WriteString(s)
+	}
+}
+
+func writeJSON(b *bytes.Buffer, fields []interface{}) {
+	b.WriteByte('{')
+	for i := 0; i < len(fields); i += 2 {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		key, _ := json.Marshal(fmt.Sprint(fields[i]))
+		b.Write(key)
+		b.WriteByte(':')
+		var value []byte
+		var err error
+		switch v := fields[i+1].(type) {
+		case error, fmt.Stringer:
+			value, err = json.Marshal(format(v))
+		default:
+			value, err = json.Marshal(v)
+		}
+		if err != nil {
+			value, _ = json.Marshal(format(fields[i+1]))
+		}
+		b.Write(value)
+	}
+	b.WriteByte('}')
+}
+
+func format(v interface{}) string {
+	switch t := v.(type) {
+	case string:
+		return t
+	case error:
+		return t.Error()
+	case fmt.Stringer:
+		return t.String()
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// Subsystems returns the names of the loggers that have been created, for help text.
+func Subsystems() []string {
+	lock.Lock()
+	defer lock.Unlock()
+	names := make([]string, 0, len(loggers))
+	for name := range loggers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,136 @@
+package logging
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestEncoders(t *testing.T) {
+	tests := []struct {
+		name   string
+		fields []interface{}
+		logfmt string
+		json   string
+	}{
+		{
+			name:   "simple",
+			fields: []interface{}{"msg", "started", "count", 3},
+			logfmt: `msg=started count=3`,
+			json:   `{"msg":"started","count":3}`,
+		},
+		{
+			name:   "quoted",
+			fields: []interface{}{"msg", "a b", "empty", "", "eq", "a=b", "quote", `"`},
+			logfmt: `msg="a b" empty="" eq="a=b" quote="\""`,
+			json:   `{"msg":"a b","empty":"","eq":"a=b","quote":"\""}`,
+		},
+		{
+			name:   "errors and stringers",
+			fields: []interface{}{"err", fmt.Errorf("failed: %s", "reset"), "ip", net.ParseIP("10.0.0.1"), "wait", time.Second},
+			logfmt: `err="failed: reset" ip=10.0.0.1 wait=1s`,
+			json:   `{"err":"failed: reset","ip":"10.0.0.1","wait":"1s"}`,
+		},
+		{
+			name:   "lists",
+			fields: []interface{}{"policies", []string{"a/web", "a/deny-all"}},
+			logfmt: `policies="[a/web a/deny-all]"`,
+			json:   `{"policies":["a/web","a/deny-all"]}`,
+		},
+		{
+			name:   "unencodable",
+			fields: []interface{}{"ratio", math.NaN(), 1, "key"},
+			logfmt: `ratio=NaN 1=key`,
+			json:   `{"ratio":"NaN","1":"key"}`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var b bytes.Buffer
+			writeLogfmt(&b, test.fields)
+			if b.String() != test.logfmt {
+				t.Errorf("expected logfmt %s, got %s", test.logfmt, b.String())
+			}
+			b.Reset()
+			writeJSON(&b, test.fields)
+			if b.String() != test.json {
+				t.Errorf("expected JSON %s, got %s", test.json, b.String())
+			}
+		})
+	}
+}
+
+func TestSampling(t *testing.T) {
+	defer Configure(Config{Level: LevelInfo})
+	if err := Configure(Config{Output: &bytes.Buffer{}, Level: LevelInfo, SampleFirst: 2, SampleThereafter: 3}); err != nil {
+		t.Fatal(err)
+	}
+	l := &Logger{subsystem: "test"}
+	start := time.Unix(1600000000, 0)
+	var written []int
+	for i := 1; i <= 9; i++ {
+		if l.sampled("flow", start.Add(time.Duration(i)*time.Millisecond)) {
+			written = append(written, i)
+		}
+	}
+	// the first two lines, then every third line after them
+	if fmt.Sprint(written) != "[1 2 5 8]" {
+		t.Fatalf("unexpected lines written %v", written)
+	}
+	// other messages and the next second are counted separately
+	if !l.sampled("other", start) {
+		t.Fatal("expected a different message to be written")
+	}
+	if !l.sampled("flow", start.Add(time.Second)) || !l.sampled("flow", start.Add(time.Second)) || l.sampled("flow", start.Add(time.Second)) {
+		t.Fatal("expected the count to restart every second")
+	}
+
+	if err := Configure(Config{Output: &bytes.Buffer{}, SampleFirst: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if !l.sampled("none", start) || l.sampled("none", start) || l.sampled("none", start) {
+		t.Fatal("expected only the first line without SampleThereafter")
+	}
+}
+
+func TestLogger(t *testing.T) {
+	defer Configure(Config{Level: LevelInfo})
+	var out bytes.Buffer
+	if err := Configure(Config{Output: &out, Format: FormatJSON, Level: LevelWarn, Subsystems: map[string]Level{"verbose": LevelDebug}, SampleFirst: 1}); err != nil {
+		t.Fatal(err)
+	}
+	quiet, verbose := Named("quiet"), Named("verbose")
+	if Named("quiet") != quiet {
+		t.Fatal("expected the same logger for a subsystem")
+	}
+	// loggers are shared by every test, so forget the messages sampled by earlier runs
+	verbose.samples = nil
+	quiet.Info("hidden")
+	verbose.Debug("shown", "key")
+	verbose.Debug("shown")
+	// warnings and errors are never sampled
+	quiet.Warn("warned")
+	quiet.Warn("warned")
+
+	lines := bytes.Split(bytes.TrimSpace(out.Bytes()), []byte("\n"))
+	if len(lines) != 3 {
+		t.Fatalf("unexpected lines %s", out.String())
+	}
+	if !bytes.Contains(lines[0], []byte(`"level":"debug","subsystem":"verbose","msg":"shown","key":"(missing)"}`)) {
+		t.Fatalf("unexpected line %s", lines[0])
+	}
+	if !bytes.Contains(lines[2], []byte(`"level":"warn","subsystem":"quiet","msg":"warned"}`)) {
+		t.Fatalf("unexpected line %s", lines[2])
+	}
+
+	names := fmt.Sprint(Subsystems())
+	if !bytes.Contains([]byte(names), []byte("quiet verbose")) {
+		t.Fatalf("expected the created loggers in %s", names)
+	}
+	if err := Configure(Config{Format: "text"}); err == nil {
+		t.Fatal("expected an unknown format to be rejected")
+	}
+}
@@ -0,0 +1,331 @@
+// package otlp exports the metrics gathered from a Prometheus registry, and optionally the
+// failures observed by a connection tracker, to an OpenTelemetry collector using OTLP over
+// HTTP with JSON encoding.
+package otlp
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/smarterclayton/node-conntrack/pkg/conntrack"
+	"github.com/smarterclayton/node-conntrack/pkg/logging"
+)
+
+var sinkLog = logging.Named("sink")
+
+// scopeName identifies the instrumentation that produced the exported data.
+const scopeName = "github.com/smarterclayton/node-conntrack"
+
+// maxLogRecords caps the number of failures buffered between exports. Failures beyond the
+// cap are dropped and reported as a count on the next export.
+const maxLogRecords = 4096
+
+// Options configure an Exporter.
+type Options struct {
+	// Endpoint is the base URL of the collector, such as http://localhost:4318. Metrics are
+	// sent to /v1/metrics and logs to /v1/logs under it.
+	Endpoint string
+	// Headers are added to every request, such as for authentication.
+	Headers map[string]string
+	// Interval is how often metrics and buffered log records are exported.
+	Interval time.Duration
+	// Timeout bounds each export request.
+	Timeout time.Duration
+	// Logs exports each failure as a log record if true.
+	Logs bool
+	// Resource attributes describe the process, such as service.name and host.name.
+	Resource map[string]string
+}
+
+// Exporter periodically pushes metrics and log records to a collector. It is an Observer
+// so it can receive failures from a tracker.
+type Exporter struct {
+	opts     Options
+	gatherer prometheus.Gatherer
+	client   *http.Client
+	start    time.Time
+
+	lock    sync.Mutex
+	records []conntrack.Event
+	dropped int
+
+	// seriesLock serializes metric exports, which track the start time of every counter
+	// series since the last export
+	seriesLock sync.Mutex
+	series     map[string]counterSeries
+	lastExport time.Time
+}
+
+// counterSeries is the last exported value of a counter and when the counter began
+// accumulating it. Counters of the tracker are removed when they expire and start from zero
+// if they are recreated, so a series that appears after the first export or whose value
+// decreased is reported as starting at the previous export.
+type counterSeries struct {
+	start time.Time
+	value float64
+}
+
+// New creates an exporter of the metrics gathered by gatherer.
+func New(gatherer prometheus.Gatherer, opts Options) (*Exporter, error) {
+	if len(opts.Endpoint) == 0 {
+		return nil, fmt.Errorf("an OTLP endpoint is required")
+	}
+	if !strings.HasPrefix(opts.Endpoint, "http://") && !strings.HasPrefix(opts.Endpoint, "https://") {
+		return nil, fmt.Errorf("the OTLP endpoint must be an http or https URL")
+	}
+	opts.Endpoint = strings.TrimSuffix(opts.Endpoint, "/")
+	if opts.Interval == 0 {
+		opts.Interval = 30 * time.Second
+	}
+	if opts.Timeout == 0 {
+		opts.Timeout = 10 * time.Second
+	}
+	return &Exporter{
+		opts:     opts,
+		gatherer: gatherer,
+		client:   &http.Client{Timeout: opts.Timeout},
+		start:    time.Now(),
+		series:   make(map[string]counterSeries),
+	}, nil
+}
+
+// Observe buffers failures to be exported as log records if logs are enabled.
+func (e *Exporter) Observe(event conntrack.Event) {
+	if !e.opts.Logs || event.Type != conntrack.EventFailure {
+		return
+	}
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if len(e.records) >= maxLogRecords {
+		e.dropped++
+		return
+	}
+	e.records = append(e.records, event)
+}
+
+// Run exports on every interval until ctx is done, and then exports one final time.
+func (e *Exporter) Run(ctx context.Context) {
+	ticker := time.NewTicker(e.opts.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			final, cancel := context.WithTimeout(context.Background(), e.opts.Timeout)
+			e.exportAll(final)
+			cancel()
+			return
+		}
+		e.exportAll(ctx)
+	}
+}
+
+func (e *Exporter) exportAll(ctx context.Context) {
+	if err := e.ExportMetrics(ctx); err != nil {
+		sinkLog.Warn("Unable to export metrics", "endpoint", e.opts.Endpoint, "err", err)
+	}
+	if err := e.ExportLogs(ctx); err != nil {
+		sinkLog.Warn("Unable to export logs", "endpoint", e.opts.Endpoint, "err", err)
+	}
+}
+
+// ExportMetrics gathers the current metrics and sends them to the collector.
+func (e *Exporter) ExportMetrics(ctx context.Context) error {
+	families, err := e.gatherer.Gather()
+	if err != nil {
+		return err
+	}
+	e.seriesLock.Lock()
+	defer e.seriesLock.Unlock()
+	now := time.Now()
+	series := make(map[string]counterSeries, len(e.series))
+	var metrics []metric
+	for _, family := range families {
+		if m, ok := e.convert(family, now, series); ok {
+			metrics = append(metrics, m)
+		}
+	}
+	e.series, e.lastExport = series, now
+	req := metricsRequest{ResourceMetrics: []resourceMetrics{{
+		Resource:     e.resource(),
+		ScopeMetrics: []scopeMetrics{{Scope: scope{Name: scopeName}, Metrics: metrics}},
+	}}}
+	return e.post(ctx, "/v1/metrics", req)
+}
+
+// ExportLogs sends the buffered failures to the collector as log records.
+func (e *Exporter) ExportLogs(ctx context.Context) error {
+	e.lock.Lock()
+	events, dropped := e.records, e.dropped
+	e.records, e.dropped = nil, 0
+	e.lock.Unlock()
+	if len(events) == 0 && dropped == 0 {
+		return nil
+	}
+
+	records := make([]logRecord, 0, len(events)+1)
+	for _, event := range events {
+		records = append(records, failureRecord(event))
+	}
+	if dropped > 0 {
+		records = append(records, logRecord{
+			TimeUnixNano:   unixNano(time.Now()),
+			SeverityNumber: severityWarn,
+			SeverityText:   "WARN",
+			Body:           stringValue(fmt.Sprintf("%d failures were not exported because the buffer was full", dropped)),
+			Attributes:     []keyValue{intAttribute("dropped", int64(dropped))},
+		})
+	}
+	req := logsRequest{ResourceLogs: []resourceLogs{{
+		Resource:  e.resource(),
+		ScopeLogs: []scopeLogs{{Scope: scope{Name: scopeName}, LogRecords: records}},
+	}}}
+	return e.post(ctx, "/v1/logs", req)
+}
+
+func failureRecord(event conntrack.Event) logRecord {
+	attrs := []keyValue{
+		stringAttribute("event.type", string(event.Type)),
+		stringAttribute("source.address", event.Source.String()),
+		stringAttribute("destination.address", event.IP.String()),
+		intAttribute("destination.port", int64(event.Port)),
+		stringAttribute("network.transport", conntrack.ProtocolName(event.Protocol)),
+	}
+	if event.SourcePort > 0 {
+		attrs = append(attrs, intAttribute("source.port", int64(event.SourcePort)))
+	}
+	if event.Zone > 0 {
+		attrs = append(attrs, intAttribute("conntrack.zone", int64(event.Zone)))
+	}
+	if len(event.Reason) > 0 {
+		attrs = append(attrs, stringAttribute("conntrack.reason", event.Reason))
+	}
+	if event.PolicyDenied {
+		attrs = append(attrs, stringAttribute("conntrack.policy.denied", "true"), stringAttribute("conntrack.policy.names", strings.Join(event.Policies, ",")))
+	}
+	if nat := event.NAT; nat != nil {
+		if nat.Destination != nil {
+			attrs = append(attrs, stringAttribute("conntrack.nat.destination.address", nat.Destination.String()), intAttribute("conntrack.nat.destination.port", int64(nat.DestinationPort)))
+		}
+		if nat.Source != nil {
+			attrs = append(attrs, stringAttribute("conntrack.nat.source.address", nat.Source.String()), intAttribute("conntrack.nat.source.port", int64(nat.SourcePort)))
+		}
+	}
+	return logRecord{
+		TimeUnixNano:   unixNano(event.Time),
+		SeverityNumber: severityWarn,
+		SeverityText:   "WARN",
+		Body:           stringValue(fmt.Sprintf("connection to %s port %d failed", event.IP, event.Port)),
+		Attributes:     attrs,
+	}
+}
+
+// convert maps a Prometheus metric family to an OTLP gauge or cumulative sum, recording the
+// counter series it exports in series. Summaries and histograms are not produced by the
+// tracker and are skipped.
+func (e *Exporter) convert(family *dto.MetricFamily, now time.Time, series map[string]counterSeries) (metric, bool) {
+	m := metric{Name: family.GetName(), Description: family.GetHelp()}
+	var points []dataPoint
+	for _, pm := range family.GetMetric() {
+		p := dataPoint{TimeUnixNano: unixNano(now)}
+		if ts := pm.GetTimestampMs(); ts > 0 {
+			p.TimeUnixNano = unixNano(time.Unix(0, ts*int64(time.Millisecond)))
+		}
+		for _, label := range pm.GetLabel() {
+			p.Attributes = append(p.Attributes, stringAttribute(label.GetName(), label.GetValue()))
+		}
+		switch family.GetType() {
+		case dto.MetricType_GAUGE:
+			p.AsDouble = pm.GetGauge().GetValue()
+		case dto.MetricType_UNTYPED:
+			p.AsDouble = pm.GetUntyped().GetValue()
+		case dto.MetricType_COUNTER:
+			p.AsDouble = pm.GetCounter().GetValue()
+			key := seriesKey(family.GetName(), pm.GetLabel())
+			s, ok := e.series[key]
+			if !ok || p.AsDouble < s.value {
+				s.start = e.start
+				if !e.lastExport.IsZero() {
+					s.start = e.lastExport
+				}
+			}
+			s.value = p.AsDouble
+			series[key] = s
+			p.StartTimeUnixNano = unixNano(s.start)
+		default:
+			return m, false
+		}
+		points = append(points, p)
+	}
+	if family.GetType() == dto.MetricType_COUNTER {
+		m.Sum = &sum{DataPoints: points, AggregationTemporality: aggregationCumulative, IsMonotonic: true}
+	} else {
+		m.Gauge = &gauge{DataPoints: points}
+	}
+	return m, true
+}
+
+// seriesKey identifies a series by the name of its family and its labels, which are sorted
+// by name.
+func seriesKey(name string, labels []*dto.LabelPair) string {
+	var b strings.Builder
+	b.WriteString(name)
+	for _, label := range labels {
+		b.WriteByte(0)
+		b.WriteString(label.GetName())
+		b.WriteByte('=')
+		b.WriteString(label.GetValue())
+	}
+	return b.String()
+}
+
+func (e *Exporter) resource() resource {
+	var r resource
+	for k, v := range e.opts.Resource {
+		r.Attributes = append(r.Attributes, stringAttribute(k, v))
+	}
+	return r
+}
+
+func (e *Exporter) post(ctx context.Context, path string, body interface{}) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, e.opts.Endpoint+path, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range e.opts.Headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		message, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("collector returned %s: %s", resp.Status, strings.TrimSpace(string(message)))
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	return nil
+}
+
+func unixNano(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
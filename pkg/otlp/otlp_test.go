@@ -0,0 +1,238 @@
+package otlp
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/smarterclayton/node-conntrack/pkg/conntrack"
+)
+
+// receiver is a stand-in collector that keeps the last request body sent to each path.
+type receiver struct {
+	lock   sync.Mutex
+	bodies map[string][]byte
+	status int
+}
+
+func newReceiver(t *testing.T) (*receiver, *httptest.Server) {
+	r := &receiver{bodies: make(map[string][]byte), status: http.StatusOK}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost || req.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("unexpected request %s %s with content type %q", req.Method, req.URL.Path, req.Header.Get("Content-Type"))
+		}
+		body, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.lock.Lock()
+		defer r.lock.Unlock()
+		r.bodies[req.URL.Path] = body
+		w.WriteHeader(r.status)
+	}))
+	return r, server
+}
+
+func (r *receiver) body(path string) []byte {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.bodies[path]
+}
+
+// counter is a collector of a single counter series whose value can go down or disappear,
+// like the expiring counters of the tracker.
+type counter struct {
+	desc    *prometheus.Desc
+	value   float64
+	present bool
+}
+
+func (c *counter) Describe(ch chan<- *prometheus.Desc) { ch <- c.desc }
+
+func (c *counter) Collect(ch chan<- prometheus.Metric) {
+	if c.present {
+		ch <- prometheus.MustNewConstMetric(c.desc, prometheus.CounterValue, c.value, "10.0.0.1")
+	}
+}
+
+func TestExportMetrics(t *testing.T) {
+	recv, server := newReceiver(t)
+	defer server.Close()
+
+	c := &counter{desc: prometheus.NewDesc("test_total", "A test counter.", []string{"ip"}, nil)}
+	g := prometheus.NewGauge(prometheus.GaugeOpts{Name: "test_gauge", Help: "A test gauge."})
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(c, g)
+	g.Set(7)
+
+	e, err := New(registry, Options{Endpoint: server.URL + "/", Resource: map[string]string{"service.name": "node-conntrack"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var exports []time.Time
+	export := func() map[string]metric {
+		t.Helper()
+		if err := e.ExportMetrics(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		exports = append(exports, e.lastExport)
+		body := recv.body("/v1/metrics")
+		var req metricsRequest
+		if err := json.Unmarshal(body, &req); err != nil {
+			t.Fatal(err)
+		}
+		if len(req.ResourceMetrics) != 1 || len(req.ResourceMetrics[0].ScopeMetrics) != 1 {
+			t.Fatalf("unexpected payload: %s", body)
+		}
+		if attrs := req.ResourceMetrics[0].Resource.Attributes; len(attrs) != 1 || attrs[0].Key != "service.name" {
+			t.Fatalf("unexpected resource: %#v", attrs)
+		}
+		metrics := make(map[string]metric)
+		for _, m := range req.ResourceMetrics[0].ScopeMetrics[0].Metrics {
+			metrics[m.Name] = m
+		}
+		if m := metrics["test_gauge"]; m.Gauge == nil || len(m.Gauge.DataPoints) != 1 || m.Gauge.DataPoints[0].AsDouble != 7 {
+			t.Fatalf("unexpected gauge: %#v", m)
+		}
+		return metrics
+	}
+	point := func(metrics map[string]metric) dataPoint {
+		t.Helper()
+		m := metrics["test_total"]
+		if m.Sum == nil || len(m.Sum.DataPoints) != 1 {
+			t.Fatalf("unexpected sum: %#v", m)
+		}
+		body := recv.body("/v1/metrics")
+		for _, field := range []string{`"aggregationTemporality":2`, `"isMonotonic":true`, `"startTimeUnixNano"`} {
+			if !bytes.Contains(body, []byte(field)) {
+				t.Fatalf("payload is missing %s: %s", field, body)
+			}
+		}
+		p := m.Sum.DataPoints[0]
+		if len(p.Attributes) != 1 || p.Attributes[0].Key != "ip" {
+			t.Fatalf("unexpected attributes: %#v", p.Attributes)
+		}
+		return p
+	}
+
+	c.present, c.value = true, 3
+	if p := point(export()); p.AsDouble != 3 || p.StartTimeUnixNano != unixNano(e.start) {
+		t.Fatalf("a series present at the first export starts with the exporter: %#v", p)
+	}
+	c.value = 5
+	if p := point(export()); p.AsDouble != 5 || p.StartTimeUnixNano != unixNano(e.start) {
+		t.Fatalf("a series that increased keeps its start: %#v", p)
+	}
+	c.value = 1
+	if p := point(export()); p.AsDouble != 1 || p.StartTimeUnixNano != unixNano(exports[1]) {
+		t.Fatalf("a series that decreased starts at the previous export: %#v", p)
+	}
+	c.present = false
+	if m, ok := export()["test_total"]; ok && m.Sum != nil && len(m.Sum.DataPoints) > 0 {
+		t.Fatalf("an expired series is not exported: %#v", m)
+	}
+	c.present, c.value = true, 2
+	if p := point(export()); p.AsDouble != 2 || p.StartTimeUnixNano != unixNano(exports[3]) {
+		t.Fatalf("a recreated series starts at the previous export: %#v", p)
+	}
+}
+
+func TestExportLogs(t *testing.T) {
+	recv, server := newReceiver(t)
+	defer server.Close()
+
+	e, err := New(prometheus.NewRegistry(), Options{Endpoint: server.URL, Logs: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := e.ExportLogs(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if body := recv.body("/v1/logs"); body != nil {
+		t.Fatalf("nothing is sent without failures: %s", body)
+	}
+
+	now := time.Unix(1600000000, 0)
+	e.Observe(conntrack.Event{Time: now, Type: conntrack.EventRecovery, IP: net.ParseIP("10.0.0.3"), Protocol: 6, Port: 80})
+	e.Observe(conntrack.Event{
+		Time:         now,
+		Type:         conntrack.EventFailure,
+		Source:       net.ParseIP("10.0.0.1"),
+		SourcePort:   40000,
+		IP:           net.ParseIP("10.0.0.2"),
+		Protocol:     6,
+		Port:         443,
+		Reason:       conntrack.ReasonUnreplied,
+		PolicyDenied: true,
+		Policies:     []string{"ns/deny"},
+	})
+	if err := e.ExportLogs(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	var req struct {
+		ResourceLogs []struct {
+			ScopeLogs []struct {
+				LogRecords []struct {
+					TimeUnixNano string `json:"timeUnixNano"`
+					SeverityText string `json:"severityText"`
+					Body         struct {
+						StringValue string `json:"stringValue"`
+					} `json:"body"`
+					Attributes []struct {
+						Key   string                 `json:"key"`
+						Value map[string]interface{} `json:"value"`
+					} `json:"attributes"`
+				} `json:"logRecords"`
+			} `json:"scopeLogs"`
+		} `json:"resourceLogs"`
+	}
+	body := recv.body("/v1/logs")
+	if err := json.Unmarshal(body, &req); err != nil {
+		t.Fatal(err)
+	}
+	if len(req.ResourceLogs) != 1 || len(req.ResourceLogs[0].ScopeLogs) != 1 || len(req.ResourceLogs[0].ScopeLogs[0].LogRecords) != 1 {
+		t.Fatalf("expected only the failure to be exported: %s", body)
+	}
+	record := req.ResourceLogs[0].ScopeLogs[0].LogRecords[0]
+	if record.TimeUnixNano != "1600000000000000000" || record.SeverityText != "WARN" || record.Body.StringValue != "connection to 10.0.0.2 port 443 failed" {
+		t.Fatalf("unexpected record: %s", body)
+	}
+	attrs := make(map[string]interface{})
+	for _, attr := range record.Attributes {
+		for _, v := range attr.Value {
+			attrs[attr.Key] = v
+		}
+	}
+	for key, value := range map[string]interface{}{
+		"event.type":              "failure",
+		"source.address":          "10.0.0.1",
+		"source.port":             "40000",
+		"destination.address":     "10.0.0.2",
+		"destination.port":        "443",
+		"network.transport":       "tcp",
+		"conntrack.reason":        "unreplied",
+		"conntrack.policy.denied": "true",
+		"conntrack.policy.names":  "ns/deny",
+	} {
+		if attrs[key] != value {
+			t.Errorf("attribute %s is %v, expected %v", key, attrs[key], value)
+		}
+	}
+
+	recv.status = http.StatusBadRequest
+	e.Observe(conntrack.Event{Time: now, Type: conntrack.EventFailure, IP: net.ParseIP("10.0.0.2"), Protocol: 6, Port: 443})
+	if err := e.ExportLogs(context.Background()); err == nil {
+		t.Fatal("expected an error when the collector rejects the request")
+	}
+}
@@ -0,0 +1,199 @@
+package privileges
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// capNetAdmin is CAP_NET_ADMIN, the only capability kept.
+const capNetAdmin = 12
+
+// linuxCapabilityVersion3 is _LINUX_CAPABILITY_VERSION_3, which uses two data structs.
+const linuxCapabilityVersion3 = 0x20080522
+
+// deniedSyscalls are refused with EPERM by the seccomp filter. The list denies calls that
+// change identity, load code into the kernel, or escape the namespaces of the container,
+// rather than allowing a fixed set, so that changes to the Go runtime cannot break the
+// daemon.
+var deniedSyscalls = []uintptr{
+	unix.SYS_ACCT,
+	unix.SYS_ADD_KEY,
+	unix.SYS_BPF,
+	unix.SYS_CAPSET,
+	unix.SYS_CHROOT,
+	unix.SYS_CLOCK_SETTIME,
+	unix.SYS_DELETE_MODULE,
+	unix.SYS_FINIT_MODULE,
+	unix.SYS_INIT_MODULE,
+	unix.SYS_KEXEC_LOAD,
+	unix.SYS_KEYCTL,
+	unix.SYS_MOUNT,
+	unix.SYS_OPEN_BY_HANDLE_AT,
+	unix.SYS_PERF_EVENT_OPEN,
+	unix.SYS_PERSONALITY,
+	unix.SYS_PIVOT_ROOT,
+	unix.SYS_PROCESS_VM_READV,
+	unix.SYS_PROCESS_VM_WRITEV,
+	unix.SYS_PTRACE,
+	unix.SYS_REBOOT,
+	unix.SYS_REQUEST_KEY,
+	unix.SYS_SETDOMAINNAME,
+	unix.SYS_SETGID,
+	unix.SYS_SETGROUPS,
+	unix.SYS_SETHOSTNAME,
+	unix.SYS_SETNS,
+	unix.SYS_SETREGID,
+	unix.SYS_SETRESGID,
+	unix.SYS_SETRESUID,
+	unix.SYS_SETREUID,
+	unix.SYS_SETTIMEOFDAY,
+	unix.SYS_SETUID,
+	unix.SYS_SWAPOFF,
+	unix.SYS_SWAPON,
+	unix.SYS_UMOUNT2,
+	unix.SYS_UNSHARE,
+	unix.SYS_USERFAULTFD,
+}
+
+// Drop switches every thread of the process to opts.UID and opts.GID, keeping only
+// CAP_NET_ADMIN, and optionally installs the seccomp filter. The process must be running
+// as root with CAP_SETUID, CAP_SETGID, and CAP_SETPCAP. Dropping is applied to all threads
+// of the process, which requires a binary built without cgo.
+func Drop(opts Options) error {
+	if opts.UID <= 0 || opts.GID <= 0 {
+		return fmt.Errorf("a non-root user and group are required")
+	}
+
+	// keep the permitted capabilities across the change of user so CAP_NET_ADMIN survives
+	if err := allThreads(unix.SYS_PRCTL, unix.PR_SET_KEEPCAPS, 1, 0); err != nil {
+		return fmt.Errorf("unable to keep capabilities: %v", err)
+	}
+	last, err := lastCapability()
+	if err != nil {
+		return err
+	}
+	for c := uintptr(0); c <= last; c++ {
+		if c == capNetAdmin {
+			continue
+		}
+		if err := allThreads(unix.SYS_PRCTL, unix.PR_CAPBSET_DROP, c, 0); err != nil && err != unix.EINVAL {
+			return fmt.Errorf("unable to drop capability %d from the bounding set: %v", c, err)
+		}
+	}
+
+	if err := syscall.Setgroups(nil); err != nil {
+		return fmt.Errorf("unable to clear supplementary groups: %v", err)
+	}
+	if err := syscall.Setresgid(opts.GID, opts.GID, opts.GID); err != nil {
+		return fmt.Errorf("unable to change group to %d: %v", opts.GID, err)
+	}
+	if err := syscall.Setresuid(opts.UID, opts.UID, opts.UID); err != nil {
+		return fmt.Errorf("unable to change user to %d: %v", opts.UID, err)
+	}
+
+	header := unix.CapUserHeader{Version: linuxCapabilityVersion3}
+	var data [2]unix.CapUserData
+	data[0].Effective = 1 << capNetAdmin
+	data[0].Permitted = 1 << capNetAdmin
+	if err := allThreads(unix.SYS_CAPSET, uintptr(unsafe.Pointer(&header)), uintptr(unsafe.Pointer(&data[0])), 0); err != nil {
+		return fmt.Errorf("unable to limit capabilities to CAP_NET_ADMIN: %v", err)
+	}
+
+	if err := allThreads(unix.SYS_PRCTL, unix.PR_SET_NO_NEW_PRIVS, 1, 0); err != nil {
+		return fmt.Errorf("unable to prevent privilege escalation: %v", err)
+	}
+	if opts.Seccomp {
+		if err := installSeccomp(); err != nil {
+			return fmt.Errorf("unable to install seccomp filter: %v", err)
+		}
+	}
+	return nil
+}
+
+// allThreads invokes a system call on every thread of the process, since credentials and
+// capabilities are tracked per thread by the kernel.
+func allThreads(trap, a1, a2, a3 uintptr) error {
+	if _, _, errno := syscall.AllThreadsSyscall(trap, a1, a2, a3); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// lastCapability returns the highest capability number supported by the kernel.
+func lastCapability() (uintptr, error) {
+	data, err := ioutil.ReadFile("/proc/sys/kernel/cap_last_cap")
+	if err != nil {
+		return 0, err
+	}
+	last, err := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 8)
+	if err != nil {
+		return 0, fmt.Errorf("unable to read the last capability: %v", err)
+	}
+	return uintptr(last), nil
+}
+
+// Offsets into struct seccomp_data.
+const (
+	seccompDataNr   = 0
+	seccompDataArch = 4
+)
+
+// Seccomp filter return values.
+const (
+	seccompRetAllow = 0x7fff0000
+	seccompRetErrno = 0x00050000
+)
+
+// The seccomp operation and flag that install a filter on every thread.
+const (
+	seccompSetModeFilter   = 1
+	seccompFilterFlagTSync = 1
+)
+
+// installSeccomp denies deniedSyscalls, and every system call made through another
+// architecture's ABI, on all threads of the process.
+func installSeccomp() error {
+	if auditArch == 0 {
+		return fmt.Errorf("the filter is not supported on this architecture")
+	}
+	deny := uint32(seccompRetErrno | uint32(unix.EPERM))
+	n := uint8(len(deniedSyscalls))
+
+	filter := []unix.SockFilter{
+		// deny system calls from other architectures, whose numbers differ
+		stmt(unix.BPF_LD|unix.BPF_W|unix.BPF_ABS, seccompDataArch),
+		jump(unix.BPF_JMP|unix.BPF_JEQ|unix.BPF_K, auditArch, 1, 0),
+		stmt(unix.BPF_RET|unix.BPF_K, deny),
+		stmt(unix.BPF_LD|unix.BPF_W|unix.BPF_ABS, seccompDataNr),
+		// deny the x32 ABI, which shares the architecture of amd64
+		jump(unix.BPF_JMP|unix.BPF_JGE|unix.BPF_K, x32SyscallBit, n+1, 0),
+	}
+	for i, nr := range deniedSyscalls {
+		// on a match, jump to the deny at the end of the list
+		filter = append(filter, jump(unix.BPF_JMP|unix.BPF_JEQ|unix.BPF_K, uint32(nr), n-uint8(i), 0))
+	}
+	filter = append(filter,
+		stmt(unix.BPF_RET|unix.BPF_K, seccompRetAllow),
+		stmt(unix.BPF_RET|unix.BPF_K, deny),
+	)
+
+	prog := unix.SockFprog{Len: uint16(len(filter)), Filter: &filter[0]}
+	if _, _, errno := syscall.RawSyscall(unix.SYS_SECCOMP, seccompSetModeFilter, seccompFilterFlagTSync, uintptr(unsafe.Pointer(&prog))); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+func stmt(code uint16, k uint32) unix.SockFilter {
+	return unix.SockFilter{Code: code, K: k}
+}
+
+func jump(code uint16, k uint32, jt, jf uint8) unix.SockFilter {
+	return unix.SockFilter{Code: code, Jt: jt, Jf: jf, K: k}
+}
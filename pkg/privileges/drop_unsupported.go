@@ -0,0 +1,10 @@
+// +build !linux
+
+package privileges
+
+import "fmt"
+
+// Drop is not supported on non-Linux platforms.
+func Drop(opts Options) error {
+	return fmt.Errorf("dropping privileges is not supported on non-Linux platforms")
+}
@@ -0,0 +1,15 @@
+// package privileges lets the daemon give up the root privileges it needs to start. The
+// process keeps only CAP_NET_ADMIN, which is required to subscribe to and dump conntrack
+// events, switches to an unprivileged user, and installs a seccomp filter that denies
+// system calls the daemon never needs.
+package privileges
+
+// Options describe the privileges to keep.
+type Options struct {
+	// UID and GID are the user and group to switch to.
+	UID int
+	GID int
+	// Seccomp installs a filter that denies system calls used to escalate privileges or
+	// tamper with the host.
+	Seccomp bool
+}
@@ -0,0 +1,9 @@
+// +build linux
+
+package privileges
+
+// auditArch is AUDIT_ARCH_X86_64, the architecture reported to seccomp filters.
+const auditArch = 0xc000003e
+
+// x32SyscallBit marks system calls made through the x32 ABI, which use different numbers.
+const x32SyscallBit = 0x40000000
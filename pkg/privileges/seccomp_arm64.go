@@ -0,0 +1,9 @@
+// +build linux
+
+package privileges
+
+// auditArch is AUDIT_ARCH_AARCH64, the architecture reported to seccomp filters.
+const auditArch = 0xc00000b7
+
+// x32SyscallBit is unused on arm64, where every system call number is below it.
+const x32SyscallBit = 0x40000000
@@ -0,0 +1,8 @@
+// +build linux,!amd64,!arm64
+
+package privileges
+
+// auditArch is zero on architectures the seccomp filter does not support.
+const auditArch = 0
+
+const x32SyscallBit = 0x40000000
@@ -0,0 +1,192 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxCachedReviews bounds the number of remembered review results.
+const maxCachedReviews = 1024
+
+// KubernetesAuth authenticates bearer tokens with a TokenReview and authorizes the request
+// path with a SubjectAccessReview, so that access can be granted with RBAC rules on
+// non-resource URLs such as /metrics. Results are cached briefly to avoid a review per
+// scrape.
+type KubernetesAuth struct {
+	client *Client
+	ttl    time.Duration
+
+	lock  sync.Mutex
+	cache map[string]review
+}
+
+type review struct {
+	authenticated bool
+	allowed       bool
+	expires       time.Time
+}
+
+// ErrUnauthenticated is returned by Allowed when the API server does not recognize a token.
+var ErrUnauthenticated = errors.New("the token was not authenticated")
+
+// NewInClusterAuth uses the service account of the pod to call the Kubernetes API server.
+func NewInClusterAuth() (*KubernetesAuth, error) {
+	client, err := NewInClusterClient()
+	if err != nil {
+		return nil, err
+	}
+	return &KubernetesAuth{
+		client: client,
+		ttl:    time.Minute,
+		cache:  make(map[string]review),
+	}, nil
+}
+
+// CheckToken returns an error if the service account token used for reviews cannot be read.
+func (a *KubernetesAuth) CheckToken() error {
+	return a.client.CheckToken()
+}
+
+// Allowed returns true if the token belongs to a user that may perform verb on path, or
+// ErrUnauthenticated if the token does not belong to a user.
+func (a *KubernetesAuth) Allowed(ctx context.Context, token, verb, path string) (bool, error) {
+	sum := sha256.Sum256([]byte(token))
+	key := hex.EncodeToString(sum[:]) + " " + verb + " " + path
+	now := time.Now()
+	a.lock.Lock()
+	cached, ok := a.cache[key]
+	a.lock.Unlock()
+	if !ok || !now.Before(cached.expires) {
+		authenticated, allowed, err := a.review(ctx, token, verb, path)
+		if err != nil {
+			return false, err
+		}
+		cached = review{authenticated: authenticated, allowed: allowed, expires: now.Add(a.ttl)}
+		a.lock.Lock()
+		if len(a.cache) >= maxCachedReviews {
+			a.cache = make(map[string]review)
+		}
+		a.cache[key] = cached
+		a.lock.Unlock()
+	}
+	if !cached.authenticated {
+		return false, ErrUnauthenticated
+	}
+	return cached.allowed, nil
+}
+
+// userInfo is the user described by authentication.k8s.io/v1 UserInfo.
+type userInfo struct {
+	Username string              `json:"username"`
+	UID      string              `json:"uid"`
+	Groups   []string            `json:"groups"`
+	Extra    map[string][]string `json:"extra,omitempty"`
+}
+
+// tokenReview is the subset of authentication.k8s.io/v1 TokenReview used to authenticate.
+type tokenReview struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+	Spec       struct {
+		Token string `json:"token"`
+	} `json:"spec"`
+	Status struct {
+		Authenticated bool     `json:"authenticated"`
+		User          userInfo `json:"user"`
+		Error         string   `json:"error"`
+	} `json:"status"`
+}
+
+// subjectAccessReview is the subset of authorization.k8s.io/v1 SubjectAccessReview used to
+// authorize access to a non-resource URL.
+type subjectAccessReview struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+	Spec       struct {
+		User                  string              `json:"user"`
+		UID                   string              `json:"uid,omitempty"`
+		Groups                []string            `json:"groups"`
+		Extra                 map[string][]string `json:"extra,omitempty"`
+		NonResourceAttributes struct {
+			Path string `json:"path"`
+			Verb string `json:"verb"`
+		} `json:"nonResourceAttributes"`
+	} `json:"spec"`
+	Status struct {
+		Allowed         bool   `json:"allowed"`
+		Reason          string `json:"reason"`
+		EvaluationError string `json:"evaluationError"`
+	} `json:"status"`
+}
+
+// review returns whether the token belongs to a user and whether that user may perform
+// verb on path.
+func (a *KubernetesAuth) review(ctx context.Context, token, verb, path string) (authenticated, allowed bool, err error) {
+	tr := tokenReview{APIVersion: "authentication.k8s.io/v1", Kind: "TokenReview"}
+	tr.Spec.Token = token
+	if err := a.client.Do(ctx, http.MethodPost, "/apis/authentication.k8s.io/v1/tokenreviews", &tr, &tr); err != nil {
+		return false, false, err
+	}
+	if !tr.Status.Authenticated {
+		return false, false, nil
+	}
+
+	sar := subjectAccessReview{APIVersion: "authorization.k8s.io/v1", Kind: "SubjectAccessReview"}
+	sar.Spec.User = tr.Status.User.Username
+	sar.Spec.UID = tr.Status.User.UID
+	sar.Spec.Groups = tr.Status.User.Groups
+	sar.Spec.Extra = tr.Status.User.Extra
+	sar.Spec.NonResourceAttributes.Path = path
+	sar.Spec.NonResourceAttributes.Verb = verb
+	if err := a.client.Do(ctx, http.MethodPost, "/apis/authorization.k8s.io/v1/subjectaccessreviews", &sar, &sar); err != nil {
+		return true, false, err
+	}
+	if !sar.Status.Allowed && len(sar.Status.EvaluationError) > 0 {
+		serverLog.Debug("Access review failed to evaluate", "user", sar.Spec.User, "path", path, "err", sar.Status.EvaluationError)
+	}
+	return true, sar.Status.Allowed, nil
+}
+
+// Protect requires requests to present a verified client certificate, if the server
+// verifies them, or a bearer token that kube allows to access the request path. If kube is
+// nil only client certificates are accepted.
+func Protect(h http.Handler, kube *KubernetesAuth) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.TLS != nil && len(req.TLS.VerifiedChains) > 0 {
+			h.ServeHTTP(w, req)
+			return
+		}
+		auth := req.Header.Get("Authorization")
+		if kube == nil || !strings.HasPrefix(auth, "Bearer ") {
+			unauthorized(w)
+			return
+		}
+		allowed, err := kube.Allowed(req.Context(), strings.TrimPrefix(auth, "Bearer "), strings.ToLower(req.Method), req.URL.Path)
+		if err == ErrUnauthenticated {
+			unauthorized(w)
+			return
+		}
+		if err != nil {
+			serverLog.Warn("Unable to review access", "path", req.URL.Path, "err", err)
+			http.Error(w, "Unable to review access", http.StatusInternalServerError)
+			return
+		}
+		if !allowed {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		h.ServeHTTP(w, req)
+	})
+}
+
+// unauthorized asks the client for a bearer token.
+func unauthorized(w http.ResponseWriter) {
+	w.Header().Set("WWW-Authenticate", `Bearer realm="node-conntrack"`)
+	http.Error(w, "Unauthorized", http.StatusUnauthorized)
+}
@@ -0,0 +1,175 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// reviewServer returns an API server that authenticates the token "alice" as the user alice,
+// fails to review the token "error", and allows alice to get /metrics. reviews counts the
+// reviews it receives.
+func reviewServer(t *testing.T, reviews *int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(reviews, 1)
+		if req.Header.Get("Authorization") != "Bearer service-account" {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		switch req.URL.Path {
+		case "/apis/authentication.k8s.io/v1/tokenreviews":
+			var tr tokenReview
+			if err := json.NewDecoder(req.Body).Decode(&tr); err != nil {
+				t.Error(err)
+			}
+			switch tr.Spec.Token {
+			case "alice":
+				tr.Status.Authenticated = true
+				tr.Status.User = userInfo{Username: "alice", UID: "1", Groups: []string{"system:authenticated"}}
+			case "error":
+				http.Error(w, "etcdserver: request timed out", http.StatusInternalServerError)
+				return
+			}
+			json.NewEncoder(w).Encode(&tr)
+		case "/apis/authorization.k8s.io/v1/subjectaccessreviews":
+			var sar subjectAccessReview
+			if err := json.NewDecoder(req.Body).Decode(&sar); err != nil {
+				t.Error(err)
+			}
+			attrs := sar.Spec.NonResourceAttributes
+			sar.Status.Allowed = sar.Spec.User == "alice" && len(sar.Spec.Groups) == 1 && attrs.Verb == "get" && attrs.Path == "/metrics"
+			json.NewEncoder(w).Encode(&sar)
+		default:
+			http.NotFound(w, req)
+		}
+	}))
+}
+
+func newTestAuth(server *httptest.Server) *KubernetesAuth {
+	return &KubernetesAuth{
+		client: &Client{host: server.URL, client: server.Client(), token: "service-account", readAt: time.Now().Add(time.Hour)},
+		ttl:    time.Minute,
+		cache:  make(map[string]review),
+	}
+}
+
+func TestProtect(t *testing.T) {
+	var reviews int32
+	server := reviewServer(t, &reviews)
+	defer server.Close()
+	kube := newTestAuth(server)
+	h := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("ok"))
+	})
+	verified := &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{{}}}}
+
+	tests := []struct {
+		name   string
+		kube   *KubernetesAuth
+		method string
+		path   string
+		auth   string
+		tls    *tls.ConnectionState
+		code   int
+	}{
+		{name: "allowed", kube: kube, path: "/metrics", auth: "Bearer alice", code: http.StatusOK},
+		{name: "no token", kube: kube, path: "/metrics", code: http.StatusUnauthorized},
+		{name: "basic auth", kube: kube, path: "/metrics", auth: "Basic YWxpY2U6", code: http.StatusUnauthorized},
+		{name: "unauthenticated token", kube: kube, path: "/metrics", auth: "Bearer bob", code: http.StatusUnauthorized},
+		{name: "denied path", kube: kube, path: "/api/v1/events", auth: "Bearer alice", code: http.StatusForbidden},
+		{name: "denied verb", kube: kube, method: http.MethodPost, path: "/metrics", auth: "Bearer alice", code: http.StatusForbidden},
+		{name: "review error", kube: kube, path: "/metrics", auth: "Bearer error", code: http.StatusInternalServerError},
+		{name: "client certificate", kube: kube, path: "/api/v1/events", tls: verified, code: http.StatusOK},
+		{name: "client certificate only", path: "/metrics", tls: verified, code: http.StatusOK},
+		{name: "token without authenticator", path: "/metrics", auth: "Bearer alice", code: http.StatusUnauthorized},
+		{name: "unverified client certificate", kube: kube, path: "/metrics", tls: &tls.ConnectionState{}, code: http.StatusUnauthorized},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			method := test.method
+			if len(method) == 0 {
+				method = http.MethodGet
+			}
+			req := httptest.NewRequest(method, test.path, nil)
+			if len(test.auth) > 0 {
+				req.Header.Set("Authorization", test.auth)
+			}
+			req.TLS = test.tls
+			w := httptest.NewRecorder()
+			Protect(h, test.kube).ServeHTTP(w, req)
+			if w.Code != test.code {
+				t.Fatalf("expected %d, got %d: %s", test.code, w.Code, w.Body.String())
+			}
+			if w.Code == http.StatusUnauthorized && len(w.Header().Get("WWW-Authenticate")) == 0 {
+				t.Fatal("expected a bearer challenge")
+			}
+		})
+	}
+}
+
+func TestAllowedCache(t *testing.T) {
+	var reviews int32
+	server := reviewServer(t, &reviews)
+	defer server.Close()
+	kube := newTestAuth(server)
+	allowed := func(token, path string) bool {
+		t.Helper()
+		ok, err := kube.Allowed(httptest.NewRequest(http.MethodGet, path, nil).Context(), token, "get", path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ok
+	}
+
+	// an allowed token is reviewed once by each API and then cached
+	if !allowed("alice", "/metrics") || !allowed("alice", "/metrics") {
+		t.Fatal("expected alice to be allowed")
+	}
+	if n := atomic.LoadInt32(&reviews); n != 2 {
+		t.Fatalf("expected one token and one access review, got %d requests", n)
+	}
+	// denials are cached too, by token, verb and path
+	if allowed("alice", "/api/v1/events") || allowed("alice", "/api/v1/events") {
+		t.Fatal("expected alice to be denied")
+	}
+	if n := atomic.LoadInt32(&reviews); n != 4 {
+		t.Fatalf("expected the denial to be cached, got %d requests", n)
+	}
+
+	// an expired result is reviewed again
+	for key, cached := range kube.cache {
+		cached.expires = time.Now().Add(-time.Second)
+		kube.cache[key] = cached
+	}
+	if !allowed("alice", "/metrics") {
+		t.Fatal("expected alice to be allowed")
+	}
+	if n := atomic.LoadInt32(&reviews); n != 6 {
+		t.Fatalf("expected the expired result to be reviewed, got %d requests", n)
+	}
+
+	// unauthenticated tokens are cached
+	for i := 0; i < 2; i++ {
+		if _, err := kube.Allowed(httptest.NewRequest(http.MethodGet, "/metrics", nil).Context(), "bob", "get", "/metrics"); err != ErrUnauthenticated {
+			t.Fatalf("expected bob to be unauthenticated, got %v", err)
+		}
+	}
+	if n := atomic.LoadInt32(&reviews); n != 7 {
+		t.Fatalf("expected one token review, got %d requests", n)
+	}
+
+	// errors are not cached
+	for i := 0; i < 2; i++ {
+		if _, err := kube.Allowed(httptest.NewRequest(http.MethodGet, "/metrics", nil).Context(), "error", "get", "/metrics"); err == nil {
+			t.Fatal("expected a review error")
+		}
+	}
+	if n := atomic.LoadInt32(&reviews); n != 9 {
+		t.Fatalf("expected failed reviews to be retried, got %d requests", n)
+	}
+}
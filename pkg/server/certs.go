@@ -0,0 +1,100 @@
+// package server secures the HTTP endpoints of the daemon with TLS, client certificates,
+// and Kubernetes bearer token authentication.
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"sync/atomic"
+	"time"
+
+	"github.com/smarterclayton/node-conntrack/pkg/logging"
+)
+
+var serverLog = logging.Named("server")
+
+// CertificateReloader serves a certificate and key from disk and picks up new versions of
+// the files, such as when a mounted secret is rotated, without restarting the server.
+type CertificateReloader struct {
+	certFile, keyFile string
+	certData, keyData []byte
+	cert              atomic.Value
+}
+
+// NewCertificateReloader loads the certificate and key, returning an error if they are not
+// a valid pair.
+func NewCertificateReloader(certFile, keyFile string) (*CertificateReloader, error) {
+	r := &CertificateReloader{certFile: certFile, keyFile: keyFile}
+	if _, err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// GetCertificate returns the most recently loaded certificate, for use as
+// tls.Config.GetCertificate.
+func (r *CertificateReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return r.cert.Load().(*tls.Certificate), nil
+}
+
+// Run checks the files for changes on every interval until ctx is done. Invalid changes
+// are logged and the previous certificate continues to be served.
+func (r *CertificateReloader) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+		changed, err := r.reload()
+		if err != nil {
+			serverLog.Warn("Unable to reload the serving certificate", "cert", r.certFile, "key", r.keyFile, "err", err)
+			continue
+		}
+		if changed {
+			serverLog.Info("Reloaded the serving certificate", "cert", r.certFile)
+		}
+	}
+}
+
+// reload loads the files if their contents changed, and returns true if the certificate
+// was replaced.
+func (r *CertificateReloader) reload() (bool, error) {
+	certData, err := ioutil.ReadFile(r.certFile)
+	if err != nil {
+		return false, err
+	}
+	keyData, err := ioutil.ReadFile(r.keyFile)
+	if err != nil {
+		return false, err
+	}
+	if bytes.Equal(certData, r.certData) && bytes.Equal(keyData, r.keyData) {
+		return false, nil
+	}
+	cert, err := tls.X509KeyPair(certData, keyData)
+	if err != nil {
+		return false, err
+	}
+	r.certData, r.keyData = certData, keyData
+	r.cert.Store(&cert)
+	return true, nil
+}
+
+// LoadCertPool reads a PEM bundle of CA certificates.
+func LoadCertPool(path string) (*x509.CertPool, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("%s contains no PEM encoded certificates", path)
+	}
+	return pool, nil
+}
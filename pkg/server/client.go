@@ -0,0 +1,223 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The locations of the credentials mounted into every pod for its service account.
+const (
+	serviceAccountTokenFile = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+	serviceAccountCAFile    = "/var/run/secrets/kubernetes.io/serviceaccount/ca.crt"
+)
+
+// watchTimeout is how long the API server keeps a watch open before the client must
+// resume it.
+const watchTimeout = 5 * time.Minute
+
+// tokenRefreshInterval is how often the service account token is read again, since the
+// kubelet rotates it on disk before it expires.
+const tokenRefreshInterval = time.Minute
+
+// Client calls the Kubernetes API server with the service account of the pod.
+type Client struct {
+	host      string
+	client    *http.Client
+	stream    *http.Client
+	tokenFile string
+
+	lock     sync.Mutex
+	token    string
+	readAt   time.Time
+	warnedAt time.Time
+}
+
+// NewInClusterClient returns a client for the API server of the cluster the pod runs in.
+// The service account token is read immediately so that a token the process cannot read
+// fails at startup rather than on the first request.
+func NewInClusterClient() (*Client, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if len(host) == 0 || len(port) == 0 {
+		return nil, fmt.Errorf("not running in a cluster, KUBERNETES_SERVICE_HOST and KUBERNETES_SERVICE_PORT must be set")
+	}
+	pool, err := LoadCertPool(serviceAccountCAFile)
+	if err != nil {
+		return nil, err
+	}
+	transport := &http.Transport{
+		Proxy:               http.ProxyFromEnvironment,
+		TLSClientConfig:     &tls.Config{RootCAs: pool},
+		TLSHandshakeTimeout: 10 * time.Second,
+	}
+	c := &Client{
+		host:      "https://" + net.JoinHostPort(host, port),
+		client:    &http.Client{Transport: transport, Timeout: 10 * time.Second},
+		stream:    &http.Client{Transport: transport, Timeout: watchTimeout + time.Minute},
+		tokenFile: serviceAccountTokenFile,
+	}
+	if err := c.CheckToken(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// CheckToken reads the service account token from disk and returns an error if it cannot,
+// such as when the process no longer has access to it after dropping privileges.
+func (c *Client) CheckToken() error {
+	data, err := ioutil.ReadFile(c.tokenFile)
+	if err != nil {
+		return fmt.Errorf("unable to read the service account token: %v", err)
+	}
+	token := strings.TrimSpace(string(data))
+	if len(token) == 0 {
+		return fmt.Errorf("the service account token %s is empty", c.tokenFile)
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.token, c.readAt = token, time.Now()
+	return nil
+}
+
+// bearerToken returns the service account token, read again from disk at most once per
+// refresh interval. If the token cannot be read the last one is used.
+func (c *Client) bearerToken() string {
+	c.lock.Lock()
+	now := time.Now()
+	refresh := now.Sub(c.readAt) >= tokenRefreshInterval
+	token := c.token
+	c.lock.Unlock()
+	if !refresh {
+		return token
+	}
+	if err := c.CheckToken(); err != nil {
+		c.lock.Lock()
+		defer c.lock.Unlock()
+		// try again on the next interval rather than on every request
+		c.readAt = now
+		if now.Sub(c.warnedAt) >= time.Hour {
+			serverLog.Warn("Unable to refresh the service account token, using the last one read", "err", err)
+			c.warnedAt = now
+		}
+		return c.token
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.token
+}
+
+// Do sends a request with method to path on the API server with body encoded as JSON, if
+// set, and decodes the response into obj.
+func (c *Client) Do(ctx context.Context, method, path string, body, obj interface{}) error {
+	req, err := c.request(ctx, method, path, body)
+	if err != nil {
+		return err
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusOK {
+		return responseError(path, resp, data)
+	}
+	return json.Unmarshal(data, obj)
+}
+
+// WatchEvent is a change to an object streamed by Watch. Type is ADDED, MODIFIED, DELETED,
+// BOOKMARK, or ERROR, in which case Object is a Status.
+type WatchEvent struct {
+	Type   string          `json:"type"`
+	Object json.RawMessage `json:"object"`
+}
+
+// Watch streams the changes to the objects listed at path after resourceVersion, calling fn
+// with each event until the API server ends the watch, ctx is done, or fn returns an error.
+// The API server ends the watch after a few minutes, after which the caller resumes it from
+// the last resource version it has seen.
+func (c *Client) Watch(ctx context.Context, path, resourceVersion string, fn func(WatchEvent) error) error {
+	u, err := url.Parse(path)
+	if err != nil {
+		return err
+	}
+	query := u.Query()
+	query.Set("watch", "true")
+	query.Set("resourceVersion", resourceVersion)
+	query.Set("allowWatchBookmarks", "true")
+	query.Set("timeoutSeconds", fmt.Sprintf("%d", int(watchTimeout/time.Second)))
+	u.RawQuery = query.Encode()
+
+	req, err := c.request(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.stream.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		data, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return responseError(path, resp, data)
+	}
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		var event WatchEvent
+		if err := decoder.Decode(&event); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		if err := fn(event); err != nil {
+			return err
+		}
+	}
+}
+
+// request returns a request with method to path on the API server with body encoded as
+// JSON, if set, authenticated with the service account token.
+func (c *Client) request(ctx context.Context, method, path string, body interface{}) (*http.Request, error) {
+	var r io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		r = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, c.host+path, r)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Authorization", "Bearer "+c.bearerToken())
+	return req, nil
+}
+
+// responseError returns an error for an unsuccessful response to path with body data.
+func responseError(path string, resp *http.Response, data []byte) error {
+	if len(data) > 1024 {
+		data = data[:1024]
+	}
+	return fmt.Errorf("%s returned %s: %s", path, resp.Status, strings.TrimSpace(string(data)))
+}
@@ -0,0 +1,111 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestClientToken(t *testing.T) {
+	dir, err := ioutil.TempDir("", "token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tokenFile := filepath.Join(dir, "token")
+
+	var got string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		got = req.Header.Get("Authorization")
+		w.Write([]byte(`{}`))
+	}))
+	defer server.Close()
+	c := &Client{host: server.URL, client: server.Client(), tokenFile: tokenFile}
+	get := func() string {
+		t.Helper()
+		var obj struct{}
+		if err := c.Do(context.Background(), http.MethodGet, "/", nil, &obj); err != nil {
+			t.Fatal(err)
+		}
+		return got
+	}
+
+	if err := c.CheckToken(); err == nil {
+		t.Fatal("expected a missing token to fail the check")
+	}
+	if err := ioutil.WriteFile(tokenFile, []byte("first\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.CheckToken(); err != nil {
+		t.Fatal(err)
+	}
+	if auth := get(); auth != "Bearer first" {
+		t.Fatalf("unexpected authorization %q", auth)
+	}
+
+	// a rotated token is not read again until the refresh interval passes
+	if err := ioutil.WriteFile(tokenFile, []byte("second"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if auth := get(); auth != "Bearer first" {
+		t.Fatalf("expected the cached token, got %q", auth)
+	}
+	c.readAt = time.Now().Add(-tokenRefreshInterval)
+	if auth := get(); auth != "Bearer second" {
+		t.Fatalf("expected the rotated token, got %q", auth)
+	}
+
+	// the last token is kept if it can no longer be read
+	os.Remove(tokenFile)
+	c.readAt = time.Now().Add(-tokenRefreshInterval)
+	if auth := get(); auth != "Bearer second" {
+		t.Fatalf("expected the last token, got %q", auth)
+	}
+}
+
+func TestClientWatch(t *testing.T) {
+	var query string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		query = req.URL.RawQuery
+		switch req.URL.Path {
+		case "/missing":
+			http.Error(w, "not found", http.StatusNotFound)
+		default:
+			fmt.Fprintln(w, `{"type":"ADDED","object":{"metadata":{"name":"a"}}}`)
+			fmt.Fprintln(w, `{"type":"BOOKMARK","object":{"metadata":{"resourceVersion":"2"}}}`)
+			fmt.Fprintln(w, `{"type":"DELETED","object":{"metadata":{"name":"a"}}}`)
+		}
+	}))
+	defer server.Close()
+	c := &Client{host: server.URL, client: server.Client(), stream: server.Client()}
+
+	var types []string
+	err := c.Watch(context.Background(), "/api/v1/pods?fieldSelector=spec.nodeName%3Da", "1", func(e WatchEvent) error {
+		types = append(types, e.Type)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(types) != 3 || types[0] != "ADDED" || types[2] != "DELETED" {
+		t.Fatalf("unexpected events %v", types)
+	}
+	if query != "allowWatchBookmarks=true&fieldSelector=spec.nodeName%3Da&resourceVersion=1&timeoutSeconds=300&watch=true" {
+		t.Fatalf("unexpected query %s", query)
+	}
+
+	// an error from the callback ends the watch
+	stop := fmt.Errorf("stop")
+	if err := c.Watch(context.Background(), "/api/v1/pods", "1", func(WatchEvent) error { return stop }); err != stop {
+		t.Fatalf("expected the callback error, got %v", err)
+	}
+	if err := c.Watch(context.Background(), "/missing", "1", func(WatchEvent) error { return nil }); err == nil {
+		t.Fatal("expected an error for an unsuccessful response")
+	}
+}
@@ -0,0 +1,18 @@
+package server
+
+import (
+	"net/http"
+	"net/http/pprof"
+)
+
+// Profiling returns a handler serving the runtime profiles under /debug/pprof/. It should
+// only be served on a separate listener bound to a trusted address.
+func Profiling() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	return mux
+}